@@ -0,0 +1,403 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ApiToken lets a script or another service use the /api/v1/ routes without a browser session.
+// The Name shows up in the logs instead of a matrix user id.
+type ApiToken struct {
+	Name  string
+	Token string
+}
+
+type ApiError struct {
+	Error string
+}
+
+type ApiRoom struct {
+	Id         string
+	Name       string
+	Rows       int
+	Percent    float64
+	Estimated  bool
+	Protected  bool
+	Denylisted bool
+}
+
+type ApiRoomsResponse struct {
+	Rooms     []ApiRoom
+	Total     int
+	TotalRows int
+	Limit     int
+	Offset    int
+}
+
+type ApiDeletionRequest struct {
+	Rooms  []ApiDeletionRoom
+	DryRun bool
+	// Reason is required unless DryRun is set, it is saved in the audit log
+	Reason string
+	// Message is a custom shutdown message, or MessageTemplate names one of the DeleteMessageTemplates
+	Message         string
+	MessageTemplate string
+	NewRoomUserId   string
+	NewRoomName     string
+}
+
+type ApiDeletionRoom struct {
+	Id     string
+	Ban    bool
+	Rejoin bool
+}
+
+type ApiDeletionResponse struct {
+	Id      string
+	Status  string
+	Refused []string
+	Job     *DeleteProgress `json:",omitempty"`
+	Report  *DeletionReport `json:",omitempty"`
+}
+
+type ApiScanRequest struct {
+	MeasureMediaSize bool
+	FullScan         bool
+}
+
+type ApiScanResponse struct {
+	Running      bool
+	JanitorState JanitorState
+}
+
+// rankRoomsByRows sorts rooms by their number of state_groups_state rows, biggest first
+func rankRoomsByRows(rowCountByRoom map[string]int) ([]string, int) {
+	roomIds := []string{}
+	totalRows := 0
+	for roomId, rows := range rowCountByRoom {
+		roomIds = append(roomIds, roomId)
+		totalRows += rows
+	}
+	sort.Slice(roomIds, func(i, j int) bool {
+		if rowCountByRoom[roomIds[i]] == rowCountByRoom[roomIds[j]] {
+			return roomIds[i] < roomIds[j]
+		}
+		return rowCountByRoom[roomIds[i]] > rowCountByRoom[roomIds[j]]
+	})
+	return roomIds, totalRows
+}
+
+func writeJsonResponse(responseWriter http.ResponseWriter, status int, object interface{}) {
+	responseBytes, err := json.Marshal(object)
+	if err != nil {
+		log.Printf("can't serialize api response as json: %s\n", err)
+		responseWriter.Header().Add("Content-Type", "application/json")
+		responseWriter.WriteHeader(http.StatusInternalServerError)
+		responseWriter.Write([]byte(`{"Error":"500 internal server error"}`))
+		return
+	}
+	responseWriter.Header().Add("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	responseWriter.Write(responseBytes)
+}
+
+func writeJsonError(responseWriter http.ResponseWriter, status int, message string) {
+	writeJsonResponse(responseWriter, status, ApiError{Error: message})
+}
+
+// handleApi only lets requests through when they have "Authorization: Bearer <token>" with one of the ApiTokens.
+// Browser sessions don't work here and API tokens don't work on the panel.
+func (app *FrontendApp) handleApi(config *Config, path string, handler func(http.ResponseWriter, *http.Request, string)) {
+	app.Router.HandleFunc(path, func(responseWriter http.ResponseWriter, request *http.Request) {
+		bearerToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+		tokenName := ""
+		for _, apiToken := range config.ApiTokens {
+			if apiToken.Token != "" && subtle.ConstantTimeCompare([]byte(apiToken.Token), []byte(bearerToken)) == 1 {
+				tokenName = apiToken.Name
+			}
+		}
+		if tokenName == "" {
+			writeJsonError(responseWriter, http.StatusUnauthorized, "401 unauthorized")
+			return
+		}
+
+		handler(responseWriter, request, tokenName)
+	})
+}
+
+func registerApiRoutes(app *FrontendApp, config *Config) {
+
+	app.handleApi(config, "/api/v1/usage", func(responseWriter http.ResponseWriter, request *http.Request, tokenName string) {
+		if request.Method != "GET" {
+			writeJsonError(responseWriter, http.StatusMethodNotAllowed, "405 method not allowed")
+			return
+		}
+		diskUsage, err := ReadJsonFile[DiskUsage]("data/diskUsage.json")
+		if err != nil {
+			log.Printf("api: can't read data/diskUsage.json: %s\n", err)
+			writeJsonError(responseWriter, http.StatusInternalServerError, "can't read diskUsage json")
+			return
+		}
+		writeJsonResponse(responseWriter, http.StatusOK, diskUsage)
+	})
+
+	app.handleApi(config, "/api/v1/tables", func(responseWriter http.ResponseWriter, request *http.Request, tokenName string) {
+		if request.Method != "GET" {
+			writeJsonError(responseWriter, http.StatusMethodNotAllowed, "405 method not allowed")
+			return
+		}
+		tables, err := ReadJsonFile[[]DBTableSize]("data/dbTableSizes.json")
+		if err != nil {
+			log.Printf("api: can't read data/dbTableSizes.json: %s\n", err)
+			writeJsonError(responseWriter, http.StatusInternalServerError, "can't read dbTableSizes json")
+			return
+		}
+		if tables == nil {
+			tables = []DBTableSize{}
+		}
+		writeJsonResponse(responseWriter, http.StatusOK, tables)
+	})
+
+	app.handleApi(config, "/api/v1/rooms", func(responseWriter http.ResponseWriter, request *http.Request, tokenName string) {
+		if request.Method != "GET" {
+			writeJsonError(responseWriter, http.StatusMethodNotAllowed, "405 method not allowed")
+			return
+		}
+
+		limit := 20
+		offset := 0
+		if value := request.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 || parsed > 500 {
+				writeJsonError(responseWriter, http.StatusBadRequest, "limit has to be a number between 1 and 500")
+				return
+			}
+			limit = parsed
+		}
+		if value := request.URL.Query().Get("offset"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				writeJsonError(responseWriter, http.StatusBadRequest, "offset has to be a positive number")
+				return
+			}
+			offset = parsed
+		}
+
+		rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+		if err != nil {
+			log.Printf("api: can't read data/stateGroupsStateRowCountByRoom.json: %s\n", err)
+			writeJsonError(responseWriter, http.StatusInternalServerError, "can't read rowCountByRoom json")
+			return
+		}
+		scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+		if err != nil {
+			log.Printf("api: can't read data/stateGroupsStateScan.json: %s\n", err)
+		}
+		protection, err := getRoomProtection(app.DB, config)
+		if err != nil {
+			log.Printf("api: can't getRoomProtection: %s\n", err)
+			writeJsonError(responseWriter, http.StatusInternalServerError, "can't read roomProtection json")
+			return
+		}
+
+		roomIds, totalRows := rankRoomsByRows(rowCountByRoom)
+		response := ApiRoomsResponse{
+			Rooms:     []ApiRoom{},
+			Total:     len(roomIds),
+			TotalRows: totalRows,
+			Limit:     limit,
+			Offset:    offset,
+		}
+		pageRoomIds := []string{}
+		for i := offset; i < len(roomIds) && i < offset+limit; i++ {
+			pageRoomIds = append(pageRoomIds, roomIds[i])
+		}
+		err = protection.loadAliases(pageRoomIds, false)
+		if err != nil {
+			log.Printf("api: can't load the aliases of %d rooms: %s\n", len(pageRoomIds), err)
+		}
+		for _, roomId := range pageRoomIds {
+			protected, _ := protection.isRoomProtected(roomId)
+			room := ApiRoom{
+				Id:         roomId,
+				Name:       app.getMatrixRoomNameWithCache(roomId),
+				Rows:       rowCountByRoom[roomId],
+				Estimated:  scanState.EstimatedRoomIds[roomId],
+				Protected:  protected,
+				Denylisted: !protected && protection.isRoomDenylisted(roomId),
+			}
+			if totalRows > 0 {
+				room.Percent = (float64(room.Rows) / float64(totalRows)) * float64(100)
+			}
+			response.Rooms = append(response.Rooms, room)
+		}
+
+		writeJsonResponse(responseWriter, http.StatusOK, response)
+	})
+
+	app.handleApi(config, "/api/v1/deletions", func(responseWriter http.ResponseWriter, request *http.Request, tokenName string) {
+		if request.Method != "POST" {
+			writeJsonError(responseWriter, http.StatusMethodNotAllowed, "405 method not allowed")
+			return
+		}
+
+		var deletionRequest ApiDeletionRequest
+		err := json.NewDecoder(request.Body).Decode(&deletionRequest)
+		if err != nil {
+			writeJsonError(responseWriter, http.StatusBadRequest, fmt.Sprintf("can't parse request body as json: %s", err))
+			return
+		}
+		if len(deletionRequest.Rooms) == 0 {
+			writeJsonError(responseWriter, http.StatusBadRequest, "Rooms is required")
+			return
+		}
+
+		toDelete := []MatrixRoom{}
+		for _, room := range deletionRequest.Rooms {
+			if !strings.HasPrefix(room.Id, "!") {
+				writeJsonError(responseWriter, http.StatusBadRequest, fmt.Sprintf("'%s' is not a room id", room.Id))
+				return
+			}
+			toDelete = append(toDelete, MatrixRoom{
+				Id:         room.Id,
+				Ban:        room.Ban,
+				Rejoin:     room.Rejoin && !room.Ban,
+				IdWithName: fmt.Sprintf("%s: %s", room.Id, app.getMatrixRoomNameWithCache(room.Id)),
+				Status:     "...",
+			})
+		}
+		toDelete, refused, err := removeProtectedRooms(app.DB, config, toDelete)
+		if err != nil {
+			log.Printf("api: can't check protected rooms: %s\n", err)
+			writeJsonError(responseWriter, http.StatusInternalServerError, "can't check protected rooms")
+			return
+		}
+		if len(toDelete) == 0 {
+			writeJsonError(responseWriter, http.StatusUnprocessableEntity, strings.Join(refused, "\n"))
+			return
+		}
+
+		if deletionRequest.DryRun {
+			report, err := buildDeletionReport(app.DB, toDelete)
+			if err != nil {
+				log.Printf("api: can't build deletion report: %s\n", err)
+				writeJsonError(responseWriter, http.StatusInternalServerError, "can't build deletion report")
+				return
+			}
+			writeJsonResponse(responseWriter, http.StatusOK, ApiDeletionResponse{Status: "dryRun", Refused: refused, Report: &report})
+			return
+		}
+
+		if strings.TrimSpace(deletionRequest.Reason) == "" {
+			writeJsonError(responseWriter, http.StatusBadRequest, "Reason is required")
+			return
+		}
+		reason := defaultDeleteJobReason(config)
+		reason.Reason = deletionRequest.Reason
+		reason.ShutdownMessage = deletionRequest.Message
+		if deletionRequest.NewRoomUserId != "" {
+			reason.NewRoomUserId = deletionRequest.NewRoomUserId
+			reason.NewRoomName = deletionRequest.NewRoomName
+		}
+		if deletionRequest.MessageTemplate != "" {
+			reason.ShutdownMessage, err = findDeleteMessageTemplate(config, deletionRequest.MessageTemplate)
+			if err != nil {
+				writeJsonError(responseWriter, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		reason, err = validateDeleteJobReason(config, reason)
+		if err != nil {
+			writeJsonError(responseWriter, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// if another job exists, this one waits in the queue behind it
+		log.Printf("api: token '%s' started deleting %d rooms\n", tokenName, len(toDelete))
+		deleteProgress, err := startRoomDeletes(app.DB, config, toDelete, fmt.Sprintf("api:%s", tokenName), reason)
+		if err != nil {
+			log.Printf("api: can't start room deletes: %s\n", err)
+			writeJsonError(responseWriter, http.StatusInternalServerError, "can't start room deletes")
+			return
+		}
+
+		status := DeleteJobStatusQueued
+		current, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+		if err != nil {
+			log.Printf("api: can't read data/deleteRooms.json: %s\n", err)
+		} else if current.Id == deleteProgress.Id {
+			status = DeleteJobStatusRunning
+		}
+		writeJsonResponse(responseWriter, http.StatusAccepted, ApiDeletionResponse{
+			Id:      deleteProgress.Id,
+			Status:  status,
+			Refused: refused,
+			Job:     &deleteProgress,
+		})
+	})
+
+	app.handleApi(config, "/api/v1/deletions/", func(responseWriter http.ResponseWriter, request *http.Request, tokenName string) {
+		if request.Method != "GET" {
+			writeJsonError(responseWriter, http.StatusMethodNotAllowed, "405 method not allowed")
+			return
+		}
+		id := strings.TrimPrefix(request.URL.Path, "/api/v1/deletions/")
+
+		deleteProgress, found, err := findDeleteJob(id)
+		if err != nil {
+			log.Printf("api: can't find delete job '%s': %s\n", id, err)
+			writeJsonError(responseWriter, http.StatusInternalServerError, "can't read the delete jobs")
+			return
+		}
+		if id != "" && found {
+			writeJsonResponse(responseWriter, http.StatusOK, ApiDeletionResponse{Id: id, Status: deleteProgress.Status, Job: &deleteProgress})
+			return
+		}
+
+		writeJsonError(responseWriter, http.StatusNotFound, fmt.Sprintf("delete job '%s' not found", id))
+	})
+
+	app.handleApi(config, "/api/v1/scans", func(responseWriter http.ResponseWriter, request *http.Request, tokenName string) {
+		if request.Method == "POST" {
+			if isRunningScheduledTask {
+				writeJsonError(responseWriter, http.StatusConflict, "the data gathering task is already running")
+				return
+			}
+			scanRequest := ApiScanRequest{}
+			if request.ContentLength != 0 {
+				err := json.NewDecoder(request.Body).Decode(&scanRequest)
+				if err != nil {
+					writeJsonError(responseWriter, http.StatusBadRequest, fmt.Sprintf("can't parse request body as json: %s", err))
+					return
+				}
+			}
+			log.Printf("api: token '%s' started the data gathering task\n", tokenName)
+			appendAuditLog(
+				fmt.Sprintf("api:%s", tokenName), AuditActionRescan, "",
+				fmt.Sprintf("measureMediaSize: %t, fullScan: %t", scanRequest.MeasureMediaSize, scanRequest.FullScan),
+			)
+			go runScheduledTask(app.DB, config, scanRequest.MeasureMediaSize, scanRequest.FullScan)
+		} else if request.Method != "GET" {
+			writeJsonError(responseWriter, http.StatusMethodNotAllowed, "405 method not allowed")
+			return
+		}
+
+		janitorState, err := ReadJsonFile[JanitorState]("data/janitorState.json")
+		if err != nil {
+			log.Printf("api: can't read data/janitorState.json: %s\n", err)
+			writeJsonError(responseWriter, http.StatusInternalServerError, "can't read janitorState json")
+			return
+		}
+		status := http.StatusOK
+		if request.Method == "POST" {
+			status = http.StatusAccepted
+		}
+		writeJsonResponse(responseWriter, status, ApiScanResponse{Running: isRunningScheduledTask || request.Method == "POST", JanitorState: janitorState})
+	})
+}
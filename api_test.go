@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApiNeedsAToken(t *testing.T) {
+	janitor := newTestJanitor(t, nil)
+	panel := newTestPanel(t, janitor)
+
+	for _, authorization := range []string{"", "Bearer wrong", fmt.Sprintf("Basic %s", testApiToken)} {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("%s/api/v1/usage", panel.Server.URL), nil)
+		if authorization != "" {
+			request.Header.Set("Authorization", authorization)
+		}
+		response, _ := panel.do(t, request)
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("'%s' got HTTP %d instead of 401", authorization, response.StatusCode)
+		}
+	}
+
+	response, _ := panel.api(t, "GET", "/api/v1/usage", "")
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("the api token got HTTP %d", response.StatusCode)
+	}
+}
+
+func TestPanelLogin(t *testing.T) {
+	janitor := newTestJanitor(t, nil)
+	janitor.Synapse.AddUser("alice", "alice's password")
+	janitor.Synapse.AddUser("mallory", "mallory's password")
+	panel := newTestPanel(t, janitor)
+
+	response, _ := panel.get(t, "/jobs")
+	if response.StatusCode != http.StatusFound {
+		t.Errorf("/jobs without logging in got HTTP %d instead of a redirect", response.StatusCode)
+	}
+
+	panel.logIn(t, "mallory", "mallory's password")
+	if panel.Cookie != "" {
+		t.Errorf("mallory is not in the admin room but got a session")
+	}
+	panel.logIn(t, "alice", "wrong")
+	if panel.Cookie != "" {
+		t.Errorf("alice got a session with the wrong password")
+	}
+
+	response = panel.logIn(t, "alice", "alice's password")
+	if response.StatusCode != http.StatusFound || panel.Cookie == "" {
+		t.Fatalf("alice can't log in: HTTP %d", response.StatusCode)
+	}
+	response, body := panel.get(t, "/jobs")
+	if response.StatusCode != http.StatusOK || !strings.Contains(body, "no delete job has finished yet") {
+		t.Errorf("/jobs got HTTP %d: %s", response.StatusCode, body)
+	}
+
+	auditLog, err := ReadJsonLines[AuditEntry]("data/auditLog.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []string{}
+	for _, entry := range auditLog {
+		actions = append(actions, fmt.Sprintf("%s %s", entry.UserID, entry.Action))
+	}
+	expectedActions := "mallory loginFailed, alice loginFailed, alice login"
+	if strings.Join(actions, ", ") != expectedActions {
+		t.Errorf("expected the audit log to be '%s', got '%s'", expectedActions, strings.Join(actions, ", "))
+	}
+	if problem := verifyAuditLog(auditLog); problem != "" {
+		t.Errorf("the audit log hash chain is broken: %s", problem)
+	}
+}
+
+func TestApiDeletions(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.addRoom(t, "!spam:example.com", "Spam", 4, 5, "@spammer:example.com")
+	panel := newTestPanel(t, janitor)
+
+	response, body := panel.api(t, "POST", "/api/v1/deletions", `{"Rooms": [{"Id": "!spam:example.com"}]}`)
+	if response.StatusCode != http.StatusBadRequest || !strings.Contains(body, "Reason is required") {
+		t.Errorf("a deletion without a reason got HTTP %d: %s", response.StatusCode, body)
+	}
+
+	response, body = panel.api(t, "POST", "/api/v1/deletions", fmt.Sprintf(`{"Rooms": [{"Id": "%s"}], "Reason": "test"}`, testAdminRoomId))
+	if response.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("deleting the admin room got HTTP %d: %s", response.StatusCode, body)
+	}
+
+	response, body = panel.api(t, "POST", "/api/v1/deletions", `{"Rooms": [{"Id": "!spam:example.com"}], "DryRun": true}`)
+	var dryRun ApiDeletionResponse
+	json.Unmarshal([]byte(body), &dryRun)
+	if response.StatusCode != http.StatusOK || dryRun.Report == nil || len(dryRun.Report.Rooms) != 1 || dryRun.Report.Rooms[0].StateGroups != 4 {
+		t.Fatalf("the dry run got HTTP %d: %s", response.StatusCode, body)
+	}
+	if len(janitor.Synapse.Room("!spam:example.com").DeleteRequests) != 0 {
+		t.Fatalf("the dry run deleted the room")
+	}
+
+	response, body = panel.api(t, "POST", "/api/v1/deletions", `{"Rooms": [{"Id": "!spam:example.com", "Ban": true}], "Reason": "spam"}`)
+	var started ApiDeletionResponse
+	json.Unmarshal([]byte(body), &started)
+	if response.StatusCode != http.StatusAccepted || started.Id == "" {
+		t.Fatalf("the deletion got HTTP %d: %s", response.StatusCode, body)
+	}
+
+	waitForDeleteJob(t, started.Id, DeleteJobStatusComplete, DeleteJobStatusFailed)
+	response, body = panel.api(t, "GET", fmt.Sprintf("/api/v1/deletions/%s", started.Id), "")
+	var status ApiDeletionResponse
+	json.Unmarshal([]byte(body), &status)
+	if response.StatusCode != http.StatusOK || status.Status != DeleteJobStatusComplete || status.Job.Reason != "spam" {
+		t.Errorf("the deletion status got HTTP %d: %s", response.StatusCode, body)
+	}
+	if status.Job.SubmittedBy != "api:tests" || status.Job.StateGroupsStateStatus.RowsDeleted != 20 {
+		t.Errorf("unexpected job %+v", status.Job)
+	}
+
+	response, _ = panel.api(t, "GET", "/api/v1/deletions/unknown", "")
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("an unknown job got HTTP %d", response.StatusCode)
+	}
+}
+
+func TestApiRoomsAfterAScan(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.addRoom(t, "!big:example.com", "Big", 10, 10, "@alice:example.com")
+	janitor.addRoom(t, "!small:example.com", "Small", 1, 10, "@alice:example.com")
+	panel := newTestPanel(t, janitor)
+
+	response, body := panel.api(t, "POST", "/api/v1/scans", `{"FullScan": true}`)
+	if response.StatusCode != http.StatusAccepted {
+		t.Fatalf("starting a scan got HTTP %d: %s", response.StatusCode, body)
+	}
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		_, body = panel.api(t, "GET", "/api/v1/scans", "")
+		var scan ApiScanResponse
+		json.Unmarshal([]byte(body), &scan)
+		if !scan.Running && scan.JanitorState.LastScheduledTaskRunUnixMilli != 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the scan did not finish after 30 seconds: %s", body)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	response, body = panel.api(t, "GET", "/api/v1/rooms?limit=1", "")
+	var rooms ApiRoomsResponse
+	json.Unmarshal([]byte(body), &rooms)
+	if response.StatusCode != http.StatusOK || rooms.Total != 2 || rooms.TotalRows != 110 || len(rooms.Rooms) != 1 {
+		t.Fatalf("/api/v1/rooms got HTTP %d: %s", response.StatusCode, body)
+	}
+	if rooms.Rooms[0].Id != "!big:example.com" || rooms.Rooms[0].Name != "Big" || rooms.Rooms[0].Rows != 100 {
+		t.Errorf("unexpected biggest room %+v", rooms.Rooms[0])
+	}
+}
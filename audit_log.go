@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	AuditActionLogin               = "login"
+	AuditActionLoginFailed         = "loginFailed"
+	AuditActionLogout              = "logout"
+	AuditActionRescan              = "rescan"
+	AuditActionOrphanScan          = "orphanScan"
+	AuditActionDeleteSubmitted     = "deleteSubmitted"
+	AuditActionDeleteCancelled     = "deleteCancelled"
+	AuditActionDeletePaused        = "deletePaused"
+	AuditActionDeleteResumed       = "deleteResumed"
+	AuditActionDeleteRoomRetried   = "deleteRoomRetried"
+	AuditActionDeleteRoomDropped   = "deleteRoomDropped"
+	AuditActionProtectionChanged   = "protectionChanged"
+	AuditActionCleanupProposed     = "cleanupProposed"
+	AuditActionCleanupApproved     = "cleanupApproved"
+	AuditActionCleanupRejected     = "cleanupRejected"
+	AuditActionMaintenanceQueued   = "maintenanceQueued"
+	AuditActionMediaCleanupStarted = "mediaCleanupStarted"
+)
+
+// AuditEntry is one line of data/auditLog.jsonl. Every entry carries the hash of the one before it,
+// so editing or removing a line in the middle breaks the chain from that line onwards.
+type AuditEntry struct {
+	Seq       int64
+	UnixMilli int64
+	// UserID is the matrix user for things done on the panel or through the bot,
+	// "api:<token name>", "policy:<policy name>" or "cli" otherwise
+	UserID       string
+	Action       string
+	Target       string
+	Details      string
+	PreviousHash string
+	Hash         string
+}
+
+// auditLogKey is the AuditLogKey from the config. When it is set, the hashes are HMACs keyed with it,
+// so someone who can write to the data folder but can't read the config can't rebuild the chain after editing it.
+var auditLogKey []byte
+
+// the log is read back before every append instead of keeping the last hash in memory,
+// because the command line tools append to the same log as the running janitor.
+// auditLogMutex only works inside one process, so appends also hold a lock on auditLogLockPath.
+var auditLogMutex sync.Mutex
+
+const auditLogLockPath = "data/auditLog.jsonl.lock"
+
+// lockAuditLog takes an exclusive flock on auditLogLockPath, it waits for any other process that is appending.
+func lockAuditLog() (func(), error) {
+	err := os.MkdirAll("data", 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(auditLogLockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open %s", auditLogLockPath)
+	}
+	err = unix.Flock(int(file.Fd()), unix.LOCK_EX)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "can't lock %s", auditLogLockPath)
+	}
+	return func() {
+		unix.Flock(int(file.Fd()), unix.LOCK_UN)
+		file.Close()
+	}, nil
+}
+
+// appendAuditLog records a privileged action. It never fails the action itself, errors are only logged.
+func appendAuditLog(userId, action, target, details string) {
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+	unlock, err := lockAuditLog()
+	if err != nil {
+		log.Printf("ERROR!: can't append '%s' by %s to the audit log: %s\n", action, userId, err)
+		return
+	}
+	defer unlock()
+
+	entry := AuditEntry{
+		UnixMilli: time.Now().UnixMilli(),
+		UserID:    userId,
+		Action:    action,
+		Target:    target,
+		Details:   details,
+	}
+	last, err := readLastAuditEntry()
+	if err != nil {
+		log.Printf("ERROR!: can't append '%s' by %s to the audit log: %s\n", action, userId, err)
+		return
+	}
+	if last != nil {
+		entry.Seq = last.Seq + 1
+		entry.PreviousHash = last.Hash
+	}
+	entry.Hash, err = hashAuditEntry(entry)
+	if err != nil {
+		log.Printf("ERROR!: can't append '%s' by %s to the audit log: %s\n", action, userId, err)
+		return
+	}
+	err = AppendJsonLine("data/auditLog.jsonl", entry)
+	if err != nil {
+		log.Printf("ERROR!: can't append '%s' by %s to the audit log: %s\n", action, userId, err)
+	}
+}
+
+func readLastAuditEntry() (*AuditEntry, error) {
+	jsonBytes, err := storage.Get("data/auditLog.jsonl")
+	if err != nil {
+		return nil, err
+	}
+	jsonBytes = bytes.TrimSpace(jsonBytes)
+	if len(jsonBytes) == 0 {
+		return nil, nil
+	}
+	lastLine := jsonBytes[bytes.LastIndexByte(jsonBytes, '\n')+1:]
+	var entry AuditEntry
+	err = json.Unmarshal(lastLine, &entry)
+	if err != nil {
+		return nil, errors.Wrap(err, "json parse error on the last line of data/auditLog.jsonl")
+	}
+	return &entry, nil
+}
+
+// hashAuditEntry is the sha256 (or the HMAC-SHA256 keyed with auditLogKey) of the entry as json with an empty Hash field.
+// PreviousHash is part of that json, which is what chains the entries together.
+func hashAuditEntry(entry AuditEntry) (string, error) {
+	entry.Hash = ""
+	jsonBytes, err := json.Marshal(entry)
+	if err != nil {
+		return "", errors.Wrap(err, "can't serialize audit entry as json")
+	}
+	if len(auditLogKey) > 0 {
+		mac := hmac.New(sha256.New, auditLogKey)
+		mac.Write(jsonBytes)
+		return hex.EncodeToString(mac.Sum(nil)), nil
+	}
+	hash := sha256.Sum256(jsonBytes)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// verifyAuditLog checks the whole hash chain. It returns an empty string when the chain is intact,
+// otherwise it describes the first entry that doesn't match.
+func verifyAuditLog(entries []AuditEntry) string {
+	previousHash := ""
+	for i, entry := range entries {
+		if entry.Seq != int64(i) {
+			return fmt.Sprintf("entry %d has sequence number %d, entries are missing or out of order", i, entry.Seq)
+		}
+		if entry.PreviousHash != previousHash {
+			return fmt.Sprintf("entry %d does not point at the hash of entry %d", i, i-1)
+		}
+		hash, err := hashAuditEntry(entry)
+		if err != nil {
+			return err.Error()
+		}
+		if hash != entry.Hash {
+			return fmt.Sprintf("entry %d was changed after it was written", i)
+		}
+		previousHash = entry.Hash
+	}
+	return ""
+}
+
+type AuditLogFilter struct {
+	UserID string
+	Action string
+	Search string
+}
+
+func parseAuditLogFilter(request *http.Request) AuditLogFilter {
+	return AuditLogFilter{
+		UserID: strings.TrimSpace(request.URL.Query().Get("user")),
+		Action: strings.TrimSpace(request.URL.Query().Get("action")),
+		Search: strings.TrimSpace(request.URL.Query().Get("search")),
+	}
+}
+
+// ExportURL is the csv export of the entries that match the filter
+func (filter AuditLogFilter) ExportURL() string {
+	query := url.Values{"format": []string{"csv"}}
+	if filter.UserID != "" {
+		query.Set("user", filter.UserID)
+	}
+	if filter.Action != "" {
+		query.Set("action", filter.Action)
+	}
+	if filter.Search != "" {
+		query.Set("search", filter.Search)
+	}
+	return fmt.Sprintf("/audit/export?%s", query.Encode())
+}
+
+func (filter AuditLogFilter) matches(entry AuditEntry) bool {
+	if filter.UserID != "" && !strings.EqualFold(entry.UserID, filter.UserID) {
+		return false
+	}
+	if filter.Action != "" && entry.Action != filter.Action {
+		return false
+	}
+	if filter.Search != "" {
+		search := strings.ToLower(filter.Search)
+		if !strings.Contains(strings.ToLower(entry.Target), search) && !strings.Contains(strings.ToLower(entry.Details), search) {
+			return false
+		}
+	}
+	return true
+}
+
+func registerAuditLogRoutes(app *FrontendApp) {
+	app.handleWithSession("/audit", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		entries, err := ReadJsonLines[AuditEntry]("data/auditLog.jsonl")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading auditLog jsonl"
+		}
+		filter := parseAuditLogFilter(request)
+
+		// newest first, and only the recent ones
+		matching := []AuditEntry{}
+		for i := len(entries) - 1; i >= 0 && len(matching) < 500; i-- {
+			if filter.matches(entries[i]) {
+				matching = append(matching, entries[i])
+			}
+		}
+
+		actions := []string{
+			AuditActionLogin, AuditActionLoginFailed, AuditActionLogout, AuditActionRescan, AuditActionOrphanScan,
+			AuditActionDeleteSubmitted, AuditActionDeleteCancelled, AuditActionDeletePaused, AuditActionDeleteResumed,
+			AuditActionDeleteRoomRetried, AuditActionDeleteRoomDropped, AuditActionProtectionChanged,
+			AuditActionCleanupProposed, AuditActionCleanupApproved, AuditActionCleanupRejected, AuditActionMaintenanceQueued, AuditActionMediaCleanupStarted,
+		}
+
+		auditTemplateData := struct {
+			Filter       AuditLogFilter
+			Actions      []string
+			Entries      []AuditEntry
+			Total        int
+			ChainProblem string
+			Keyed        bool
+		}{filter, actions, matching, len(entries), verifyAuditLog(entries), len(auditLogKey) > 0}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "audit.html", auditTemplateData)
+	})
+
+	// the jsonl export is the log exactly as it is stored, so the hash chain can be checked outside of the janitor.
+	// the csv export is for reading, it only has the entries that match the filter.
+	app.handleWithSession("/audit/export", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		date := time.Now().UTC().Format("2006-01-02")
+		if request.URL.Query().Get("format") != "csv" {
+			jsonBytes, err := storage.Get("data/auditLog.jsonl")
+			if err != nil {
+				app.unhandledError(responseWriter, request, err)
+				return
+			}
+			responseWriter.Header().Set("Content-Type", "application/x-ndjson")
+			responseWriter.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"janitor-audit-%s.jsonl\"", date))
+			responseWriter.Write(jsonBytes)
+			return
+		}
+
+		entries, err := ReadJsonLines[AuditEntry]("data/auditLog.jsonl")
+		if err != nil {
+			app.unhandledError(responseWriter, request, err)
+			return
+		}
+		filter := parseAuditLogFilter(request)
+
+		responseWriter.Header().Set("Content-Type", "text/csv")
+		responseWriter.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"janitor-audit-%s.csv\"", date))
+		writer := csv.NewWriter(responseWriter)
+		writer.Write([]string{"seq", "time", "user", "action", "target", "details", "hash"})
+		for _, entry := range entries {
+			if !filter.matches(entry) {
+				continue
+			}
+			writer.Write([]string{
+				strconv.FormatInt(entry.Seq, 10), time.UnixMilli(entry.UnixMilli).UTC().Format(time.RFC3339),
+				entry.UserID, entry.Action, entry.Target, entry.Details, entry.Hash,
+			})
+		}
+		writer.Flush()
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// buildAuditChain hashes the entries the same way appendAuditLog does, with the current auditLogKey
+func buildAuditChain(t *testing.T, count int) []AuditEntry {
+	entries := []AuditEntry{}
+	previousHash := ""
+	for i := 0; i < count; i++ {
+		entry := AuditEntry{
+			Seq:          int64(i),
+			UnixMilli:    int64(1700000000000 + i),
+			UserID:       "@alice:example.com",
+			Action:       AuditActionRescan,
+			Details:      fmt.Sprintf("entry %d", i),
+			PreviousHash: previousHash,
+		}
+		hash, err := hashAuditEntry(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Hash = hash
+		previousHash = hash
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestVerifyAuditLog(t *testing.T) {
+	testCases := []struct {
+		name    string
+		key     string
+		change  func(entries []AuditEntry) []AuditEntry
+		problem string
+	}{
+		{
+			name:   "intact",
+			change: func(entries []AuditEntry) []AuditEntry { return entries },
+		},
+		{
+			name:   "empty",
+			change: func(entries []AuditEntry) []AuditEntry { return []AuditEntry{} },
+		},
+		{
+			name: "edited",
+			change: func(entries []AuditEntry) []AuditEntry {
+				entries[2].Details = "something else"
+				return entries
+			},
+			problem: "entry 2 was changed after it was written",
+		},
+		{
+			name: "edited and rehashed",
+			change: func(entries []AuditEntry) []AuditEntry {
+				entries[2].Details = "something else"
+				entries[2].Hash, _ = hashAuditEntry(entries[2])
+				return entries
+			},
+			problem: "entry 3 does not point at the hash of entry 2",
+		},
+		{
+			name: "removed",
+			change: func(entries []AuditEntry) []AuditEntry {
+				return append(entries[:1], entries[2:]...)
+			},
+			problem: "entry 1 has sequence number 2",
+		},
+		{
+			name: "out of order",
+			change: func(entries []AuditEntry) []AuditEntry {
+				entries[1], entries[2] = entries[2], entries[1]
+				return entries
+			},
+			problem: "entry 1 has sequence number 2",
+		},
+		{
+			name:   "keyed",
+			key:    "0123456789abcdef",
+			change: func(entries []AuditEntry) []AuditEntry { return entries },
+		},
+		{
+			name: "keyed and rebuilt without the key",
+			key:  "0123456789abcdef",
+			change: func(entries []AuditEntry) []AuditEntry {
+				auditLogKey = nil
+				defer func() { auditLogKey = []byte("0123456789abcdef") }()
+				return buildAuditChain(t, len(entries))
+			},
+			problem: "entry 0 was changed after it was written",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			auditLogKey = []byte(testCase.key)
+			defer func() { auditLogKey = nil }()
+
+			entries := testCase.change(buildAuditChain(t, 4))
+			problem := verifyAuditLog(entries)
+			if testCase.problem == "" && problem != "" {
+				t.Errorf("expected an intact chain, got: %s", problem)
+			}
+			if testCase.problem != "" && !strings.Contains(problem, testCase.problem) {
+				t.Errorf("expected '%s', got '%s'", testCase.problem, problem)
+			}
+		})
+	}
+}
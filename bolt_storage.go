@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStorage keeps every key in a single embedded bbolt database file. Every write is its own transaction.
+// Lines that are appended to a key are each stored under their own key, in a bucket for that key inside boltStorageLinesBucket,
+// so appending to a long log doesn't rewrite the whole log. Get returns the value that was Put followed by the appended lines.
+type BoltStorage struct {
+	DB *bolt.DB
+}
+
+var boltStorageBucket = []byte("janitor")
+var boltStorageLinesBucket = []byte("janitorLines")
+
+const boltStorageMigratedKey = "storage/migratedFromDataFolder"
+
+func NewBoltStorage(path string) (*BoltStorage, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltStorageBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(boltStorageLinesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "can't create bucket in %s", path)
+	}
+	return &BoltStorage{DB: db}, nil
+}
+
+func (boltStorage *BoltStorage) Get(key string) ([]byte, error) {
+	var value []byte
+	err := boltStorage.DB.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(boltStorageBucket).Get([]byte(key))
+		if stored != nil {
+			// the slice returned by bolt is only valid until the end of the transaction
+			value = append([]byte{}, stored...)
+		}
+		lines := tx.Bucket(boltStorageLinesBucket).Bucket([]byte(key))
+		if lines == nil {
+			return nil
+		}
+		if value == nil {
+			value = []byte{}
+		}
+		// the line keys are big endian sequence numbers, so ForEach visits them in the order they were appended
+		return lines.ForEach(func(_, line []byte) error {
+			value = append(value, line...)
+			return nil
+		})
+	})
+	return value, err
+}
+
+// Put replaces the value and drops any lines that were appended to it
+func (boltStorage *BoltStorage) Put(key string, value []byte) error {
+	return boltStorage.DB.Update(func(tx *bolt.Tx) error {
+		err := deleteBoltStorageLines(tx, key)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltStorageBucket).Put([]byte(key), value)
+	})
+}
+
+func (boltStorage *BoltStorage) Append(key string, value []byte) error {
+	return boltStorage.DB.Update(func(tx *bolt.Tx) error {
+		lines, err := tx.Bucket(boltStorageLinesBucket).CreateBucketIfNotExists([]byte(key))
+		if err != nil {
+			return err
+		}
+		sequence, err := lines.NextSequence()
+		if err != nil {
+			return err
+		}
+		lineKey := make([]byte, 8)
+		binary.BigEndian.PutUint64(lineKey, sequence)
+		return lines.Put(lineKey, value)
+	})
+}
+
+func (boltStorage *BoltStorage) Delete(key string) error {
+	return boltStorage.DB.Update(func(tx *bolt.Tx) error {
+		err := deleteBoltStorageLines(tx, key)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltStorageBucket).Delete([]byte(key))
+	})
+}
+
+func deleteBoltStorageLines(tx *bolt.Tx, key string) error {
+	err := tx.Bucket(boltStorageLinesBucket).DeleteBucket([]byte(key))
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+func (boltStorage *BoltStorage) Close() error {
+	return boltStorage.DB.Close()
+}
+
+// migrateDataFolderToStorage copies every file under the data folder into the given storage, once.
+// The files are left where they are, so switching back to the file storage still works.
+// Files that don't parse as json are skipped, they would have blocked the janitor anyways.
+func migrateDataFolderToStorage(dataFolder string, target Storage, skipPath string) error {
+	migrated, err := target.Get(boltStorageMigratedKey)
+	if err != nil {
+		return err
+	}
+	if migrated != nil {
+		return nil
+	}
+
+	// skipPath is compared as an absolute path, so "./data/janitor.db" or an absolute StoragePath still match
+	absoluteSkipPath, err := filepath.Abs(skipPath)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("migrating the files in %s into the storage...\n", dataFolder)
+	count := 0
+	err = filepath.WalkDir(dataFolder, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		absolutePath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || absolutePath == absoluteSkipPath || strings.HasSuffix(path, ".tmp") || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		fileBytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(path, ".json") && !json.Valid(fileBytes) {
+			log.Printf("migrateDataFolderToStorage(): skipping %s because it is not valid json\n", path)
+			return nil
+		}
+		count++
+		return target.Put(filepath.ToSlash(path), fileBytes)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	log.Printf("migrated %d files from %s into the storage\n", count, dataFolder)
+	return target.Put(boltStorageMigratedKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+}
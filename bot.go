@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BotState struct {
+	SyncSince string
+}
+
+// JanitorBot posts to the AdminMatrixRoomId room and takes commands from the admins in it,
+// using the same account as the MatrixAdminToken.
+type JanitorBot struct {
+	DB     *DBModel
+	Config *Config
+	UserId string
+}
+
+const botCommandPrefix = "!janitor"
+
+const botHelp = `!janitor status: disk usage, the last scan and any delete job in progress
+!janitor top [N]: the N rooms with the most state_groups_state rows
+!janitor scan: run the data gathering task now
+!janitor delete ROOM_ID [ban]: show what deleting the room would remove
+!janitor delete ROOM_ID [ban] confirm REASON: delete the room, the reason is saved in the audit log`
+
+// janitorBot is nil unless BotEnabled is set
+var janitorBot *JanitorBot
+
+// botNotifications holds the messages that botNotify has not posted yet
+var botNotifications = make(chan string, 100)
+
+func initBot(config *Config, db *DBModel) *JanitorBot {
+	userId, err := matrixAdmin.WhoAmI()
+	if err != nil {
+		log.Fatalf("BotEnabled is set but can't find out who the MatrixAdminToken belongs to: %+v", err)
+	}
+	bot := &JanitorBot{
+		DB:     db,
+		Config: config,
+		UserId: userId,
+	}
+	go bot.postNotifications()
+	return bot
+}
+
+// botNotify posts a message to the admin room when the bot is enabled.
+// It never waits on synapse: the message is posted in the background, and dropped if too many are waiting already,
+// because it is called from the middle of delete jobs and maintenance.
+func botNotify(format string, args ...interface{}) {
+	if janitorBot == nil {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	select {
+	case botNotifications <- message:
+	default:
+		log.Printf("ERROR!: bot is not keeping up with the notifications, dropped: %s\n", message)
+	}
+}
+
+// postNotifications posts what botNotify queued up, one message at a time. SendNotice does not retry,
+// so while synapse is down the messages fail one after the other instead of piling up.
+func (bot *JanitorBot) postNotifications() {
+	for message := range botNotifications {
+		err := matrixAdmin.SendNotice(bot.Config.AdminMatrixRoomId, message)
+		if err != nil {
+			log.Printf("ERROR!: bot can't post to the admin room: %s\n", err)
+		}
+	}
+}
+
+// Run listens for commands in the admin room forever.
+func (bot *JanitorBot) Run() {
+	botState, err := ReadJsonFile[BotState]("data/botState.json")
+	if err != nil {
+		log.Printf("ERROR!: bot can't read data/botState.json: %s\n", err)
+	}
+
+	failures := 0
+	for {
+		nextBatch, events, err := matrixAdmin.SyncRoomMessages(bot.Config.AdminMatrixRoomId, botState.SyncSince, 30000)
+		if err != nil {
+			if failures < 12 {
+				failures++
+			}
+			log.Printf("ERROR!: bot can't sync: %s\n", err)
+			time.Sleep(time.Second * time.Duration(5*failures))
+			continue
+		}
+		failures = 0
+
+		// when there is no since token yet, the messages are old ones from before the bot started
+		if botState.SyncSince != "" {
+			for _, event := range events {
+				bot.handleMessage(event)
+			}
+		}
+
+		if nextBatch != botState.SyncSince {
+			botState.SyncSince = nextBatch
+			err = WriteJsonFile("data/botState.json", botState)
+			if err != nil {
+				log.Printf("ERROR!: bot can't write data/botState.json: %s\n", err)
+			}
+		}
+	}
+}
+
+func (bot *JanitorBot) handleMessage(event RoomMessageEvent) {
+	fields := strings.Fields(event.Content.Body)
+	if event.Sender == bot.UserId || len(fields) == 0 || fields[0] != botCommandPrefix {
+		return
+	}
+
+	// same rule as logging into the panel: only users from this homeserver who are in the admin room
+	if !strings.HasSuffix(event.Sender, fmt.Sprintf(":%s", bot.Config.MatrixServerPublicDomain)) {
+		botNotify("%s: only users from %s can use the janitor", event.Sender, bot.Config.MatrixServerPublicDomain)
+		return
+	}
+	members, err := matrixAdmin.GetRoomMembers(bot.Config.AdminMatrixRoomId)
+	if err != nil {
+		log.Printf("ERROR!: bot can't get the members of the admin room: %s\n", err)
+		botNotify("can't check who is in this room: %s", err)
+		return
+	}
+	isMember := false
+	for _, member := range members {
+		isMember = isMember || member == event.Sender
+	}
+	if !isMember {
+		return
+	}
+
+	log.Printf("bot: %s sent '%s'\n", event.Sender, event.Content.Body)
+
+	command := ""
+	args := []string{}
+	if len(fields) > 1 {
+		command = fields[1]
+		args = fields[2:]
+	}
+
+	switch command {
+	case "status":
+		botNotify("%s", bot.statusMessage())
+	case "top":
+		limit := 10
+		if len(args) > 0 {
+			parsed, err := strconv.Atoi(args[0])
+			if err != nil || parsed < 1 || parsed > 50 {
+				botNotify("N has to be a number between 1 and 50")
+				return
+			}
+			limit = parsed
+		}
+		botNotify("%s", bot.topRoomsMessage(limit))
+	case "scan":
+		if isRunningScheduledTask {
+			botNotify("the data gathering task is already running")
+			return
+		}
+		botNotify("%s started the data gathering task", event.Sender)
+		appendAuditLog(event.Sender, AuditActionRescan, "", "from the bot")
+		go runScheduledTask(bot.DB, bot.Config, false, false)
+	case "delete":
+		bot.handleDelete(event.Sender, args)
+	default:
+		botNotify("%s", botHelp)
+	}
+}
+
+func (bot *JanitorBot) handleDelete(sender string, args []string) {
+	if len(args) == 0 || !strings.HasPrefix(args[0], "!") {
+		botNotify("usage: !janitor delete ROOM_ID [ban] [confirm REASON]")
+		return
+	}
+	roomId := args[0]
+	ban := false
+	confirm := false
+	// everything after confirm is the reason
+	reasonWords := []string{}
+	for _, arg := range args[1:] {
+		if confirm {
+			reasonWords = append(reasonWords, arg)
+			continue
+		}
+		ban = ban || arg == "ban"
+		confirm = confirm || arg == "confirm"
+	}
+	if confirm && len(reasonWords) == 0 {
+		botNotify("a reason is required: !janitor delete ROOM_ID [ban] confirm REASON")
+		return
+	}
+
+	name, err := matrixAdmin.GetRoomName(roomId)
+	if err != nil {
+		log.Printf("bot: can't get name for %s: %s\n", roomId, err)
+	}
+	rooms, refused, err := removeProtectedRooms(bot.DB, bot.Config, []MatrixRoom{{
+		Id:         roomId,
+		Ban:        ban,
+		IdWithName: fmt.Sprintf("%s: %s", roomId, name),
+		Status:     "...",
+	}})
+	if err != nil {
+		botNotify("can't check whether %s is protected: %s", roomId, err)
+		return
+	}
+	if len(rooms) == 0 {
+		botNotify("%s", strings.Join(refused, "\n"))
+		return
+	}
+
+	if !confirm {
+		report, err := buildDeletionReport(bot.DB, rooms)
+		if err != nil {
+			botNotify("can't build the deletion report for %s: %s", roomId, err)
+			return
+		}
+		banText := ""
+		if ban {
+			banText = " ban"
+		}
+		botNotify(
+			"DRY RUN for %s: %d state groups, %d state_groups_state rows, about %s, %d local users will be kicked.\n"+
+				"send `!janitor delete %s%s confirm REASON` to delete it.",
+			rooms[0].IdWithName, report.StateGroups, report.StateGroupsStateRows, formatBytes(report.EstimatedBytes),
+			report.LocalMembers, roomId, banText,
+		)
+		return
+	}
+
+	log.Printf("bot: %s is deleting %s (ban: %t)\n", sender, roomId, ban)
+	deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil {
+		botNotify("can't read deleteRooms json: %s", err)
+		return
+	}
+	reason := defaultDeleteJobReason(bot.Config)
+	reason.Reason = strings.Join(reasonWords, " ")
+	job, err := startRoomDeletes(bot.DB, bot.Config, rooms, sender, reason)
+	if err != nil {
+		botNotify("can't delete %s: %s", roomId, err)
+		return
+	}
+	if len(deleteProgress.Rooms) > 0 {
+		botNotify("delete job %s is queued behind delete job %s", job.Id, deleteProgress.Id)
+	}
+}
+
+func (bot *JanitorBot) statusMessage() string {
+	lines := []string{}
+
+	diskUsage, err := ReadJsonFile[DiskUsage]("data/diskUsage.json")
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("can't read diskUsage json: %s", err))
+	} else {
+		lines = append(lines, diskUsageSummary(diskUsage))
+	}
+
+	janitorState, err := ReadJsonFile[JanitorState]("data/janitorState.json")
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("can't read janitorState json: %s", err))
+	} else {
+		running := ""
+		if isRunningScheduledTask {
+			running = " (running right now)"
+		}
+		lines = append(lines, fmt.Sprintf("last scan: %s%s", formatUnixMilli(janitorState.LastScheduledTaskRunUnixMilli), running))
+	}
+
+	deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("can't read deleteRooms json: %s", err))
+	} else if len(deleteProgress.Rooms) > 0 {
+		lines = append(lines, deleteProgressSummary(deleteProgress))
+	} else {
+		lines = append(lines, "no delete job in progress")
+	}
+
+	queue, err := ReadJsonFile[[]DeleteProgress]("data/deleteJobQueue.json")
+	if err != nil {
+		lines = append(lines, fmt.Sprintf("can't read deleteJobQueue json: %s", err))
+	} else if len(queue) > 0 {
+		lines = append(lines, fmt.Sprintf("%d more delete jobs are queued", len(queue)))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func (bot *JanitorBot) topRoomsMessage(limit int) string {
+	rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		return fmt.Sprintf("can't read rowCountByRoom json: %s", err)
+	}
+	roomIds, totalRows := rankRoomsByRows(rowCountByRoom)
+	if len(roomIds) > limit {
+		roomIds = roomIds[:limit]
+	}
+
+	lines := []string{fmt.Sprintf("top %d rooms by state_groups_state rows:", len(roomIds))}
+	for _, roomId := range roomIds {
+		name, err := matrixAdmin.GetRoomName(roomId)
+		if err != nil {
+			log.Printf("bot: can't get name for %s: %s\n", roomId, err)
+		}
+		percent := float64(0)
+		if totalRows > 0 {
+			percent = (float64(rowCountByRoom[roomId]) / float64(totalRows)) * float64(100)
+		}
+		lines = append(lines, fmt.Sprintf("%d rows (%.1f%%) %s %s", rowCountByRoom[roomId], percent, roomId, name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func diskUsageSummary(diskUsage DiskUsage) string {
+	freeBytes := diskUsage.DiskSizeBytes - (diskUsage.PostgresBytes + diskUsage.MediaBytes + diskUsage.OtherBytes)
+	freePercent := float64(0)
+	if diskUsage.DiskSizeBytes > 0 {
+		freePercent = (float64(freeBytes) / float64(diskUsage.DiskSizeBytes)) * float64(100)
+	}
+	return fmt.Sprintf(
+		"disk: %s free of %s (%.0f%%), postgres %s, media %s, other %s",
+		formatBytes(freeBytes), formatBytes(diskUsage.DiskSizeBytes), freePercent,
+		formatBytes(diskUsage.PostgresBytes), formatBytes(diskUsage.MediaBytes), formatBytes(diskUsage.OtherBytes),
+	)
+}
+
+func deleteProgressSummary(deleteProgress DeleteProgress) string {
+	roomIds := []string{}
+	for _, room := range deleteProgress.Rooms {
+		roomIds = append(roomIds, room.Id)
+	}
+	summary := fmt.Sprintf("delete job %s is in phase %s: %s", deleteProgress.Id, deleteProgress.Phase, strings.Join(roomIds, ", "))
+	if deleteProgress.Phase == DeletePhaseStateGroupsState {
+		summary += fmt.Sprintf(
+			" (%d%% of %d state groups, %d rows deleted)", deleteProgress.StateGroupsStateProgress,
+			deleteProgress.StateGroupsToDelete, deleteProgress.StateGroupsStateStatus.RowsDeleted,
+		)
+	}
+	if deleteProgress.Paused {
+		summary += fmt.Sprintf(", paused by %s", deleteProgress.PausedBy)
+	} else if deleteProgress.Error != "" {
+		summary += fmt.Sprintf(", stopped: %s", deleteProgress.Error)
+	}
+	return summary
+}
+
+// scheduledTaskSummary is posted to the admin room after every run of the data gathering task
+func scheduledTaskSummary(diskUsage DiskUsage, tables []DBTableSize, duration time.Duration) string {
+	lines := []string{
+		fmt.Sprintf("🧹 the data gathering task finished in %s", duration.Round(time.Second)),
+		diskUsageSummary(diskUsage),
+	}
+
+	sortedTables := append([]DBTableSize{}, tables...)
+	sort.Slice(sortedTables, func(i, j int) bool {
+		return sortedTables[i].Bytes > sortedTables[j].Bytes
+	})
+	if len(sortedTables) > 5 {
+		sortedTables = sortedTables[:5]
+	}
+	tableTexts := []string{}
+	for _, table := range sortedTables {
+		tableTexts = append(tableTexts, fmt.Sprintf("%s %s", table.Name, formatBytes(table.Bytes)))
+	}
+	lines = append(lines, fmt.Sprintf("largest tables: %s", strings.Join(tableTexts, ", ")))
+
+	snapshots, err := ReadJsonLines[HistorySnapshot]("data/history.jsonl")
+	if err != nil {
+		log.Printf("ERROR!: scheduledTaskSummary can't read data/history.jsonl: %s\n", err)
+	}
+	growingRooms := getFastestGrowingRooms(snapshots, 5)
+	if len(growingRooms) > 0 {
+		lines = append(lines, "fastest growing rooms:")
+		for _, room := range growingRooms {
+			name, err := matrixAdmin.GetRoomName(room.Id)
+			if err != nil {
+				log.Printf("scheduledTaskSummary(): can't get name for %s: %s\n", room.Id, err)
+			}
+			lines = append(lines, fmt.Sprintf("  +%d rows/day, %d rows: %s %s", room.RowsPerDay, room.Rows, room.Id, name))
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shengdoushi/base58"
+)
+
+type CleanupPolicy struct {
+	Name    string
+	Enabled bool
+
+	// the policy only runs while the free space on the disk is below this percentage. 0 means always
+	DiskFreeBelowPercent float64
+
+	// only rooms with at least this many state_groups_state rows are selected
+	MinStateGroupsStateRows int
+
+	// only rooms that none of the users on this homeserver are in are selected
+	OnlyRoomsWithoutLocalMembers bool
+
+	// these rooms are never selected by this policy
+	AllowlistRoomIds []string
+
+	Ban            bool
+	CooldownHours  int
+	MaxRoomsPerRun int
+
+	// if this is more than 0, the selected rooms are not deleted until this many admins have approved it on /policies
+	ApprovalsRequired int
+}
+
+type CleanupPolicyState struct {
+	LastRunUnixMilli map[string]int64
+	PendingCleanups  []PendingCleanup
+}
+
+type PendingCleanup struct {
+	Id                string
+	PolicyName        string
+	Rooms             []MatrixRoom
+	CreatedUnixMilli  int64
+	ApprovalsRequired int
+	Approvals         []string
+}
+
+// cleanupPolicyMutex is held while data/cleanupPolicies.json is read, changed and written back,
+// so an approval on the panel can't be lost to a policy run that read the file before it
+var cleanupPolicyMutex sync.Mutex
+
+// runCleanupPolicies is called at the end of every scheduled task. Each enabled policy whose conditions are met
+// picks rooms from the latest state_groups_state counts and either starts deleting them or asks for approval.
+func runCleanupPolicies(db *DBModel, config *Config) {
+	if len(config.CleanupPolicies) == 0 {
+		return
+	}
+
+	cleanupPolicyMutex.Lock()
+	defer cleanupPolicyMutex.Unlock()
+
+	policyState, err := ReadJsonFile[CleanupPolicyState]("data/cleanupPolicies.json")
+	if err != nil {
+		log.Printf("ERROR!: runCleanupPolicies can't read data/cleanupPolicies.json: %s\n", err)
+		return
+	}
+	if policyState.LastRunUnixMilli == nil {
+		policyState.LastRunUnixMilli = map[string]int64{}
+	}
+
+	// approved cleanups go first, they are queued behind the delete job that is running if there is one
+	startApprovedCleanups(db, config, &policyState)
+
+	diskUsage, err := ReadJsonFile[DiskUsage]("data/diskUsage.json")
+	if err != nil {
+		log.Printf("ERROR!: runCleanupPolicies can't read data/diskUsage.json: %s\n", err)
+		return
+	}
+	rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		log.Printf("ERROR!: runCleanupPolicies can't read data/stateGroupsStateRowCountByRoom.json: %s\n", err)
+		return
+	}
+
+	roomIdsByRows := []string{}
+	for roomId := range rowCountByRoom {
+		roomIdsByRows = append(roomIdsByRows, roomId)
+	}
+	sort.Slice(roomIdsByRows, func(i, j int) bool {
+		return rowCountByRoom[roomIdsByRows[i]] > rowCountByRoom[roomIdsByRows[j]]
+	})
+
+	for _, policy := range config.CleanupPolicies {
+		if !policy.Enabled {
+			continue
+		}
+
+		lastRun := time.UnixMilli(policyState.LastRunUnixMilli[policy.Name])
+		if time.Since(lastRun) < time.Hour*time.Duration(policy.CooldownHours) {
+			log.Printf("runCleanupPolicies(): policy '%s' is cooling down since %s\n", policy.Name, lastRun.Format(time.RFC3339))
+			continue
+		}
+
+		if policy.DiskFreeBelowPercent > 0 && diskUsage.DiskSizeBytes > 0 {
+			freeBytes := diskUsage.DiskSizeBytes - (diskUsage.PostgresBytes + diskUsage.MediaBytes + diskUsage.OtherBytes)
+			freePercent := (float64(freeBytes) / float64(diskUsage.DiskSizeBytes)) * float64(100)
+			if freePercent >= policy.DiskFreeBelowPercent {
+				continue
+			}
+		}
+
+		deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+		if err != nil {
+			log.Printf("ERROR!: runCleanupPolicies can't read data/deleteRooms.json: %s\n", err)
+			return
+		}
+		if len(deleteProgress.Rooms) > 0 && policy.ApprovalsRequired == 0 {
+			log.Printf("runCleanupPolicies(): policy '%s' skipped because a delete job is already in progress\n", policy.Name)
+			continue
+		}
+
+		rooms := selectRoomsForCleanupPolicy(db, config, policy, &policyState, deleteProgress, roomIdsByRows, rowCountByRoom)
+		if len(rooms) == 0 {
+			continue
+		}
+
+		roomIds := []string{}
+		for _, room := range rooms {
+			roomIds = append(roomIds, room.Id)
+		}
+
+		if policy.ApprovalsRequired > 0 {
+			pending := PendingCleanup{
+				Id:                newCleanupId(),
+				PolicyName:        policy.Name,
+				Rooms:             rooms,
+				CreatedUnixMilli:  time.Now().UnixMilli(),
+				ApprovalsRequired: policy.ApprovalsRequired,
+				Approvals:         []string{},
+			}
+			policyState.PendingCleanups = append(policyState.PendingCleanups, pending)
+			policyState.LastRunUnixMilli[policy.Name] = time.Now().UnixMilli()
+			appendAuditLog(
+				fmt.Sprintf("policy:%s", policy.Name), AuditActionCleanupProposed, pending.Id,
+				fmt.Sprintf("%d approvals required: %s", policy.ApprovalsRequired, strings.Join(roomIds, ", ")),
+			)
+			continue
+		}
+
+		// starting the job is recorded in the audit log as a deleteSubmitted by policy:<name>
+		_, err = startRoomDeletes(db, config, rooms, fmt.Sprintf("policy:%s", policy.Name), cleanupPolicyDeleteReason(config, policy.Name))
+		if err != nil {
+			log.Printf("ERROR!: runCleanupPolicies can't start room deletes for policy '%s': %s\n", policy.Name, err)
+			continue
+		}
+		// a policy that couldn't start its job tries again the next time, instead of waiting out its interval
+		policyState.LastRunUnixMilli[policy.Name] = time.Now().UnixMilli()
+	}
+
+	err = WriteJsonFile("data/cleanupPolicies.json", policyState)
+	if err != nil {
+		log.Printf("ERROR!: runCleanupPolicies can't write data/cleanupPolicies.json: %s\n", err)
+	}
+}
+
+func selectRoomsForCleanupPolicy(
+	db *DBModel, config *Config, policy CleanupPolicy, policyState *CleanupPolicyState, deleteProgress DeleteProgress,
+	roomIdsByRows []string, rowCountByRoom map[string]int,
+) []MatrixRoom {
+	maxRooms := policy.MaxRoomsPerRun
+	if maxRooms <= 0 {
+		maxRooms = 1
+	}
+
+	excluded := map[string]bool{config.AdminMatrixRoomId: true}
+	for _, roomId := range policy.AllowlistRoomIds {
+		excluded[roomId] = true
+	}
+	for _, pending := range policyState.PendingCleanups {
+		for _, room := range pending.Rooms {
+			excluded[room.Id] = true
+		}
+	}
+	for _, room := range deleteProgress.Rooms {
+		excluded[room.Id] = true
+	}
+	queuedRoomIds, err := getDeleteJobRoomIds()
+	if err != nil {
+		log.Printf("ERROR!: runCleanupPolicies can't getDeleteJobRoomIds: %s\n", err)
+		return []MatrixRoom{}
+	}
+	for roomId := range queuedRoomIds {
+		excluded[roomId] = true
+	}
+
+	protection, err := getRoomProtection(db, config)
+	if err != nil {
+		log.Printf("ERROR!: runCleanupPolicies can't getRoomProtection: %s\n", err)
+		return []MatrixRoom{}
+	}
+
+	rooms := []MatrixRoom{}
+	for _, roomId := range roomIdsByRows {
+		if len(rooms) >= maxRooms || rowCountByRoom[roomId] < policy.MinStateGroupsStateRows {
+			break
+		}
+		if excluded[roomId] {
+			continue
+		}
+		if protected, _ := protection.isRoomProtected(roomId); protected {
+			continue
+		}
+		if policy.OnlyRoomsWithoutLocalMembers {
+			localMembers, err := matrixAdmin.GetLocalRoomMembers(roomId)
+			if err != nil {
+				log.Printf("runCleanupPolicies(): policy '%s' skipping %s because can't get local members: %s\n", policy.Name, roomId, err)
+				continue
+			}
+			if len(localMembers) > 0 {
+				continue
+			}
+		}
+
+		name, err := matrixAdmin.GetRoomName(roomId)
+		if err != nil {
+			log.Printf("runCleanupPolicies(): can't get name for %s: %s\n", roomId, err)
+		}
+		rooms = append(rooms, MatrixRoom{
+			Id:         roomId,
+			IdWithName: fmt.Sprintf("%s: %s", roomId, name),
+			Rows:       rowCountByRoom[roomId],
+			Ban:        policy.Ban,
+			Status:     "...",
+		})
+	}
+
+	return rooms
+}
+
+// startApprovedCleanups starts the first pending cleanup that has enough approvals, or queues it if another delete job exists.
+func startApprovedCleanups(db *DBModel, config *Config, policyState *CleanupPolicyState) {
+	for i, pending := range policyState.PendingCleanups {
+		if len(pending.Approvals) < pending.ApprovalsRequired {
+			continue
+		}
+		reason := cleanupPolicyDeleteReason(config, pending.PolicyName)
+		reason.Reason = fmt.Sprintf("%s, approved by %s", reason.Reason, strings.Join(pending.Approvals, ", "))
+		_, err := startRoomDeletes(db, config, pending.Rooms, fmt.Sprintf("policy:%s", pending.PolicyName), reason)
+		if err != nil {
+			log.Printf("startApprovedCleanups(): can't start approved cleanup %s yet: %s\n", pending.Id, err)
+			return
+		}
+
+		policyState.PendingCleanups = append(policyState.PendingCleanups[:i], policyState.PendingCleanups[i+1:]...)
+		return
+	}
+}
+
+func cleanupPolicyDeleteReason(config *Config, policyName string) DeleteJobReason {
+	return DeleteJobReason{
+		Reason:        fmt.Sprintf("cleanup policy %s", policyName),
+		NewRoomUserId: config.DeleteNewRoomUserId,
+		NewRoomName:   config.DeleteNewRoomName,
+	}
+}
+
+func newCleanupId() string {
+	idBuffer := make([]byte, 8)
+	rand.Read(idBuffer)
+	return base58.Encode(idBuffer, base58.BitcoinAlphabet)
+}
+
+func registerCleanupPolicyRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/policies", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		if request.Method == "POST" {
+			cleanupPolicyMutex.Lock()
+			defer cleanupPolicyMutex.Unlock()
+
+			// writing back a state that could not be read would throw away every pending cleanup and its approvals
+			policyState, err := ReadJsonFile[CleanupPolicyState]("data/cleanupPolicies.json")
+			if err != nil {
+				log.Printf("can't read data/cleanupPolicies.json: %s\n", err)
+				app.setFlash(responseWriter, session, "error", "an error occurred reading cleanupPolicies json")
+				http.Redirect(responseWriter, request, "/policies", http.StatusFound)
+				return
+			}
+
+			cleanupId := request.PostFormValue("id")
+			action := request.PostFormValue("action")
+
+			for i, pending := range policyState.PendingCleanups {
+				if pending.Id != cleanupId {
+					continue
+				}
+				roomIds := []string{}
+				for _, room := range pending.Rooms {
+					roomIds = append(roomIds, room.Id)
+				}
+
+				if action == "reject" {
+					policyState.PendingCleanups = append(policyState.PendingCleanups[:i], policyState.PendingCleanups[i+1:]...)
+					appendAuditLog(session.UserID, AuditActionCleanupRejected, pending.Id, strings.Join(roomIds, ", "))
+				} else if action == "approve" {
+					alreadyApproved := false
+					for _, userId := range pending.Approvals {
+						alreadyApproved = alreadyApproved || userId == session.UserID
+					}
+					if !alreadyApproved {
+						policyState.PendingCleanups[i].Approvals = append(pending.Approvals, session.UserID)
+						appendAuditLog(session.UserID, AuditActionCleanupApproved, pending.Id, strings.Join(roomIds, ", "))
+					}
+					startApprovedCleanups(app.DB, config, &policyState)
+				}
+				break
+			}
+
+			err = WriteJsonFile("data/cleanupPolicies.json", policyState)
+			if err != nil {
+				log.Printf("can't write data/cleanupPolicies.json: %s\n", err)
+				app.setFlash(responseWriter, session, "error", "an error occurred saving cleanupPolicies json")
+			}
+			http.Redirect(responseWriter, request, "/policies", http.StatusFound)
+			return
+		}
+
+		policyState, err := ReadJsonFile[CleanupPolicyState]("data/cleanupPolicies.json")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading cleanupPolicies json"
+		}
+
+		auditEntries, err := ReadJsonLines[AuditEntry]("data/auditLog.jsonl")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading auditLog jsonl"
+		}
+		// newest first, and only the recent ones that have to do with the policies
+		recentAuditEntries := []AuditEntry{}
+		for i := len(auditEntries) - 1; i >= 0 && len(recentAuditEntries) < 100; i-- {
+			entry := auditEntries[i]
+			switch {
+			case entry.Action == AuditActionCleanupProposed, entry.Action == AuditActionCleanupApproved, entry.Action == AuditActionCleanupRejected:
+			case entry.Action == AuditActionDeleteSubmitted && strings.HasPrefix(entry.UserID, "policy:"):
+			default:
+				continue
+			}
+			recentAuditEntries = append(recentAuditEntries, entry)
+		}
+
+		lastRunByPolicy := map[string]string{}
+		for name, unixMilli := range policyState.LastRunUnixMilli {
+			lastRunByPolicy[name] = time.UnixMilli(unixMilli).UTC().Format("2006-01-02 15:04 MST")
+		}
+
+		policiesTemplateData := struct {
+			Policies        []CleanupPolicy
+			LastRunByPolicy map[string]string
+			PendingCleanups []PendingCleanup
+			AuditEntries    []AuditEntry
+		}{config.CleanupPolicies, lastRunByPolicy, policyState.PendingCleanups, recentAuditEntries}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "policies.html", policiesTemplateData)
+	})
+}
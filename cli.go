@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const commandLineUsage = `usage: matrix-synapse-diskspace-janitor [command] [flags]
+
+without a command, the web panel and the scheduled task are started.
+
+commands:
+  scan                      run the data gathering task once, in the foreground
+  top-rooms                 list the rooms with the most state_groups_state rows
+  delete-room ROOM_ID...    delete rooms and their state groups, in the foreground
+  status                    show disk usage, when the last scan ran, and any job in progress
+  purge-orphans             find state groups of rooms that don't exist anymore and delete them, in the foreground
+
+run a command with -h to see its flags.
+`
+
+// parseCommandFlags lets flags come after positional arguments, like "delete-room !abc:example.com --ban"
+func parseCommandFlags(flagSet *flag.FlagSet, args []string) ([]string, error) {
+	positional := []string{}
+	for {
+		err := flagSet.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = flagSet.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func printJson(object interface{}) int {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(object)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't serialize output as json: %s\n", err)
+		return 1
+	}
+	return 0
+}
+
+// runCommand runs one of the commands from commandLineUsage and returns the exit code.
+func runCommand(config *Config, command string, args []string) int {
+	switch command {
+	case "scan":
+		return runScanCommand(config, args)
+	case "top-rooms":
+		return runTopRoomsCommand(config, args)
+	case "delete-room":
+		return runDeleteRoomCommand(config, args)
+	case "status":
+		return runStatusCommand(config, args)
+	case "purge-orphans":
+		return runPurgeOrphansCommand(config, args)
+	case "help", "-h", "--help":
+		fmt.Print(commandLineUsage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command '%s'\n\n%s", command, commandLineUsage)
+		return 2
+	}
+}
+
+func runScanCommand(config *Config, args []string) int {
+	flagSet := flag.NewFlagSet("scan", flag.ContinueOnError)
+	measureMediaSize := flagSet.Bool("media", false, "measure the size of the media folder too")
+	fullScan := flagSet.Bool("full", false, "recount all of state_groups_state instead of only the new rows")
+	_, err := parseCommandFlags(flagSet, args)
+	if err != nil {
+		return 2
+	}
+
+	db := initDatabase(config)
+	matrixAdmin = initMatrixAdmin(config)
+	appendAuditLog("cli", AuditActionRescan, "", fmt.Sprintf("measureMediaSize: %t, fullScan: %t", *measureMediaSize, *fullScan))
+	runScheduledTask(db, config, *measureMediaSize, *fullScan)
+	return 0
+}
+
+type topRoom struct {
+	Id        string
+	Name      string `json:",omitempty"`
+	Rows      int
+	Percent   float64
+	Estimated bool
+}
+
+func runTopRoomsCommand(config *Config, args []string) int {
+	flagSet := flag.NewFlagSet("top-rooms", flag.ContinueOnError)
+	limit := flagSet.Int("limit", 10, "how many rooms to list")
+	asJson := flagSet.Bool("json", false, "print json instead of a table")
+	withNames := flagSet.Bool("names", true, "look up the name of every room through the synapse admin API")
+	_, err := parseCommandFlags(flagSet, args)
+	if err != nil {
+		return 2
+	}
+
+	rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't read data/stateGroupsStateRowCountByRoom.json: %s\n", err)
+		return 1
+	}
+	scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't read data/stateGroupsStateScan.json: %s\n", err)
+		return 1
+	}
+
+	totalRowCount := 0
+	rooms := []topRoom{}
+	for roomId, rows := range rowCountByRoom {
+		totalRowCount += rows
+		rooms = append(rooms, topRoom{Id: roomId, Rows: rows, Estimated: scanState.EstimatedRoomIds[roomId]})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Rows > rooms[j].Rows
+	})
+	if *limit > 0 && len(rooms) > *limit {
+		rooms = rooms[:*limit]
+	}
+
+	if *withNames {
+		matrixAdmin = initMatrixAdmin(config)
+	}
+	for i := range rooms {
+		if totalRowCount > 0 {
+			rooms[i].Percent = (float64(rooms[i].Rows) / float64(totalRowCount)) * float64(100)
+		}
+		if *withNames {
+			name, err := matrixAdmin.GetRoomName(rooms[i].Id)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "can't get name for %s: %s\n", rooms[i].Id, err)
+			}
+			rooms[i].Name = name
+		}
+	}
+
+	if *asJson {
+		return printJson(rooms)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ROWS\tPERCENT\tROOM\tNAME")
+	for _, room := range rooms {
+		rows := fmt.Sprintf("%d", room.Rows)
+		if room.Estimated {
+			rows = fmt.Sprintf("~%d", room.Rows)
+		}
+		fmt.Fprintf(writer, "%s\t%.1f%%\t%s\t%s\n", rows, room.Percent, room.Id, room.Name)
+	}
+	writer.Flush()
+	return 0
+}
+
+func runDeleteRoomCommand(config *Config, args []string) int {
+	flagSet := flag.NewFlagSet("delete-room", flag.ContinueOnError)
+	ban := flagSet.Bool("ban", false, "block the rooms so they can't be joined again")
+	rejoin := flagSet.Bool("rejoin", false, "after the rooms are purged, make the local users who were kicked join them again")
+	dryRun := flagSet.Bool("dry-run", false, "only show what would be deleted")
+	asJson := flagSet.Bool("json", false, "print the dry run report as json")
+	reasonText := flagSet.String("reason", "", "why the rooms are deleted, it is saved in the audit log (required)")
+	messageTemplate := flagSet.String("message-template", "", "the name of one of the DeleteMessageTemplates to post to the rooms")
+	message := flagSet.String("message", "", "a custom message to post to the rooms before they are shut down")
+	newRoomUserId := flagSet.String("new-room-user", config.DeleteNewRoomUserId, "a local user that creates a room for the kicked users to land in")
+	newRoomName := flagSet.String("new-room-name", config.DeleteNewRoomName, "the name of that room")
+	roomIds, err := parseCommandFlags(flagSet, args)
+	if err != nil {
+		return 2
+	}
+	if len(roomIds) == 0 {
+		fmt.Fprintln(os.Stderr, "delete-room needs at least one room id")
+		return 2
+	}
+	if strings.TrimSpace(*reasonText) == "" && !*dryRun {
+		fmt.Fprintln(os.Stderr, "delete-room needs a --reason")
+		return 2
+	}
+	reason := DeleteJobReason{Reason: *reasonText, ShutdownMessage: *message, NewRoomUserId: *newRoomUserId, NewRoomName: *newRoomName}
+	if *messageTemplate != "" {
+		reason.ShutdownMessage, err = findDeleteMessageTemplate(config, *messageTemplate)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	db := initDatabase(config)
+	matrixAdmin = initMatrixAdmin(config)
+
+	rooms := []MatrixRoom{}
+	for _, roomId := range roomIds {
+		name, err := matrixAdmin.GetRoomName(roomId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't get name for %s: %s\n", roomId, err)
+		}
+		rooms = append(rooms, MatrixRoom{
+			Id:         roomId,
+			Ban:        *ban,
+			Rejoin:     *rejoin && !*ban,
+			IdWithName: fmt.Sprintf("%s: %s", roomId, name),
+			Status:     "...",
+		})
+	}
+
+	rooms, refused, err := removeProtectedRooms(db, config, rooms)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't check protected rooms: %s\n", err)
+		return 1
+	}
+	for _, message := range refused {
+		fmt.Fprintln(os.Stderr, message)
+	}
+	if len(rooms) == 0 {
+		return 1
+	}
+
+	if *dryRun {
+		report, err := buildDeletionReport(db, rooms)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "can't build deletion report: %s\n", err)
+			return 1
+		}
+		if *asJson {
+			return printJson(report)
+		}
+
+		fmt.Println("DRY RUN: nothing has been deleted.")
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ROOM\tSTATE GROUPS\tSTATE_GROUPS_STATE ROWS\tLOCAL MEMBERS\tESTIMATED SPACE")
+		for _, roomReport := range report.Rooms {
+			fmt.Fprintf(
+				writer, "%s\t%d\t%d\t%d\t%s\n", roomReport.Room.IdWithName, roomReport.StateGroups,
+				roomReport.StateGroupsStateRows, len(roomReport.LocalMembers), formatBytes(roomReport.EstimatedBytes),
+			)
+		}
+		fmt.Fprintf(
+			writer, "total\t%d\t%d\t%d\t%s\n", report.StateGroups, report.StateGroupsStateRows,
+			report.LocalMembers, formatBytes(report.EstimatedBytes),
+		)
+		writer.Flush()
+		return 0
+	}
+
+	job, startNow, err := queueRoomDeletes(config, rooms, "cli", reason)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't start room deletes: %s\n", err)
+		return 1
+	}
+	return runDeleteJobFromCommand(db, config, job, startNow)
+}
+
+// runDeleteJobFromCommand works on a delete job that a command just saved, unless it is waiting behind another job
+func runDeleteJobFromCommand(db *DBModel, config *Config, job DeleteProgress, startNow bool) int {
+	if !startNow {
+		fmt.Printf("delete job %s is queued behind another delete job, the janitor will start it when the others are done\n", job.Id)
+		return 0
+	}
+
+	doRoomDeletes(db, config)
+
+	deleteProgress, found, err := findDeleteJob(job.Id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't find delete job %s: %s\n", job.Id, err)
+		return 1
+	}
+	if !found || deleteProgress.Status != DeleteJobStatusComplete {
+		fmt.Fprintf(
+			os.Stderr, "the delete job is %s in phase '%s': %s\n",
+			deleteProgress.Status, deleteProgress.Phase, deleteProgress.Error,
+		)
+		if deleteProgress.Status == DeleteJobStatusRunning || deleteProgress.Status == DeleteJobStatusFailed {
+			fmt.Fprintln(os.Stderr, "it will be resumed the next time the janitor starts")
+		}
+		return 1
+	}
+	return 0
+}
+
+type janitorStatus struct {
+	DiskUsage                  DiskUsage
+	AvailableBytes             int64
+	LastScheduledTask          string
+	LastScheduledTaskDuration  string
+	LastStateGroupsStateScan   string
+	LastFullStateGroupsScan    string
+	DeleteJobPhase             string `json:",omitempty"`
+	DeleteJobRooms             []string
+	DeleteJobStateGroupsDone   int
+	DeleteJobStateGroupsTotal  int
+	MediaCleanupPhase          string `json:",omitempty"`
+	MediaCleanupLocalFilesDone int
+	MediaCleanupLocalFiles     int
+}
+
+func runStatusCommand(config *Config, args []string) int {
+	flagSet := flag.NewFlagSet("status", flag.ContinueOnError)
+	asJson := flagSet.Bool("json", false, "print json instead of text")
+	_, err := parseCommandFlags(flagSet, args)
+	if err != nil {
+		return 2
+	}
+
+	errors := []string{}
+	diskUsage, err := ReadJsonFile[DiskUsage]("data/diskUsage.json")
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	janitorState, err := ReadJsonFile[JanitorState]("data/janitorState.json")
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	mediaCleanup, err := ReadJsonFile[MediaCleanupProgress]("data/mediaCleanup.json")
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	availableBytes, _, err := GetAvaliableDiskSpace(config.MediaFolder)
+	if err != nil {
+		errors = append(errors, err.Error())
+	}
+	for _, message := range errors {
+		fmt.Fprintln(os.Stderr, message)
+	}
+
+	status := janitorStatus{
+		DiskUsage:                  diskUsage,
+		AvailableBytes:             availableBytes,
+		LastScheduledTask:          formatUnixMilli(janitorState.LastScheduledTaskRunUnixMilli),
+		LastScheduledTaskDuration:  (time.Duration(janitorState.LastScheduledTaskDurationMilli) * time.Millisecond).String(),
+		LastStateGroupsStateScan:   formatUnixMilli(janitorState.LastStateGroupsStateScanSuccessUnixMilli),
+		LastFullStateGroupsScan:    formatUnixMilli(scanState.LastFullScanUnixMilli),
+		DeleteJobRooms:             []string{},
+		DeleteJobPhase:             deleteProgress.Phase,
+		DeleteJobStateGroupsDone:   deleteProgress.StateGroupsStateIndex,
+		DeleteJobStateGroupsTotal:  deleteProgress.StateGroupsToDelete,
+		MediaCleanupPhase:          mediaCleanup.Phase,
+		MediaCleanupLocalFilesDone: mediaCleanup.LocalMediaIndex,
+		MediaCleanupLocalFiles:     len(mediaCleanup.LocalMedia),
+	}
+	for _, room := range deleteProgress.Rooms {
+		status.DeleteJobRooms = append(status.DeleteJobRooms, room.Id)
+	}
+	if len(deleteProgress.Rooms) > 0 && status.DeleteJobPhase == "" {
+		status.DeleteJobPhase = DeletePhaseShutdown
+	}
+
+	if *asJson {
+		exitCode := printJson(status)
+		if len(errors) > 0 {
+			return 1
+		}
+		return exitCode
+	}
+
+	fmt.Printf("disk:            %s free of %s\n", formatBytes(status.AvailableBytes), formatBytes(diskUsage.DiskSizeBytes))
+	fmt.Printf("postgres:        %s\n", formatBytes(diskUsage.PostgresBytes))
+	fmt.Printf("media:           %s\n", formatBytes(diskUsage.MediaBytes))
+	fmt.Printf("last scan:       %s (took %s)\n", status.LastScheduledTask, status.LastScheduledTaskDuration)
+	fmt.Printf("last full count: %s\n", status.LastFullStateGroupsScan)
+	if status.DeleteJobPhase != "" {
+		fmt.Printf(
+			"delete job:      phase '%s', %d/%d state groups, rooms %s\n", status.DeleteJobPhase,
+			status.DeleteJobStateGroupsDone, status.DeleteJobStateGroupsTotal, strings.Join(status.DeleteJobRooms, ", "),
+		)
+	} else {
+		fmt.Println("delete job:      none")
+	}
+	if status.MediaCleanupPhase != "" {
+		fmt.Printf(
+			"media cleanup:   phase '%s', %d/%d local files\n", status.MediaCleanupPhase,
+			status.MediaCleanupLocalFilesDone, status.MediaCleanupLocalFiles,
+		)
+	}
+
+	if len(errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runPurgeOrphansCommand(config *Config, args []string) int {
+	flagSet := flag.NewFlagSet("purge-orphans", flag.ContinueOnError)
+	dryRun := flagSet.Bool("dry-run", false, "only show what would be deleted")
+	asJson := flagSet.Bool("json", false, "print the scan result as json")
+	_, err := parseCommandFlags(flagSet, args)
+	if err != nil {
+		return 2
+	}
+
+	db := initDatabase(config)
+	matrixAdmin = initMatrixAdmin(config)
+
+	scan, err := scanOrphanedStateGroups(db)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't scan for orphaned state groups: %s\n", err)
+		return 1
+	}
+
+	if *asJson {
+		printJson(scan)
+	} else {
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ROOM\tSTATE GROUPS\tSTATE_GROUPS_STATE ROWS\tESTIMATED SPACE")
+		for _, room := range scan.Rooms {
+			fmt.Fprintf(writer, "%s\t%d\t%d\t%s\n", room.RoomId, room.StateGroups, room.StateGroupsStateRows, formatBytes(room.EstimatedBytes))
+		}
+		fmt.Fprintf(writer, "total\t%d\t%d\t%s\n", scan.StateGroups, scan.StateGroupsStateRows, formatBytes(scan.EstimatedBytes))
+		writer.Flush()
+	}
+	if *dryRun || len(scan.Rooms) == 0 {
+		return 0
+	}
+
+	roomIds := []string{}
+	for _, room := range scan.Rooms {
+		roomIds = append(roomIds, room.RoomId)
+	}
+	job, startNow, err := queueOrphanPurge(db, config, roomIds, "cli")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "can't purge orphaned state groups: %s\n", err)
+		return 1
+	}
+	return runDeleteJobFromCommand(db, config, job, startNow)
+}
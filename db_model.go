@@ -4,38 +4,66 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	errors "git.sequentialread.com/forest/pkg-errors"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type DBModel struct {
 	DB *sql.DB
-}
-
-type StateGroupsStateStream struct {
-	EstimatedCount int
-	Channel        chan StateGroupsStateRow
-}
 
-type StateGroupsStateRow struct {
-	StateGroup int64
-	Type       string
-	StateKey   string
-	RoomID     string
-	EventId    string
+	DeleteWorkers             int
+	DeleteMaxBatchSize        int
+	DeleteBatchTargetDuration time.Duration
 }
 
 type DeleteStateGroupsStateStatus struct {
 	StateGroupsDeleted int64
 	RowsDeleted        int64
-	Errors             int64
+	// Errors counts every failed attempt, including the ones that worked when they were retried
+	Errors int64
+	// Error is set when a batch still failed after it was retried, no more batches are handed out after that
+	Error string
+}
+
+type StateGroupRowCounts struct {
+	StateGroupsState   int64
+	StateGroupEdges    int64
+	EventToStateGroups int64
+}
+
+type LocalMedia struct {
+	MediaId             string
+	MediaLength         int64
+	CreatedUnixMilli    int64
+	LastAccessUnixMilli int64
+	UserId              string
+	UploadName          string
+}
+
+type RoomStats struct {
+	RoomId         string
+	Name           string
+	CanonicalAlias string
+	JoinedMembers  int
+	LocalMembers   int
 }
 
 type DBTableSize struct {
 	Schema string
 	Name   string
-	Bytes  int64
+	// Bytes is only the main data of the table, without indexes or TOAST
+	Bytes                   int64
+	TotalBytes              int64
+	IndexBytes              int64
+	ToastBytes              int64
+	LiveTuples              int64
+	DeadTuples              int64
+	LastAutovacuumUnixMilli int64
+	EstimatedBloatBytes     int64
 }
 
 func initDatabase(config *Config) *DBModel {
@@ -48,56 +76,305 @@ func initDatabase(config *Config) *DBModel {
 		log.Fatalf("failed to open database connection: %+v", err)
 	}
 
+	deleteWorkers := config.DeleteWorkers
+	if deleteWorkers <= 0 {
+		deleteWorkers = 4
+	}
+	deleteMaxBatchSize := config.DeleteMaxBatchSize
+	if deleteMaxBatchSize <= 0 {
+		deleteMaxBatchSize = 1000
+	}
+	deleteBatchTargetMilliseconds := config.DeleteBatchTargetMilliseconds
+	if deleteBatchTargetMilliseconds <= 0 {
+		deleteBatchTargetMilliseconds = 2000
+	}
+
 	return &DBModel{
-		DB: db,
+		DB:                        db,
+		DeleteWorkers:             deleteWorkers,
+		DeleteMaxBatchSize:        deleteMaxBatchSize,
+		DeleteBatchTargetDuration: time.Millisecond * time.Duration(deleteBatchTargetMilliseconds),
+	}
+}
+
+// GetStateGroupsStateRowCountByRoom counts the state_groups_state rows for each room, but only for state groups
+// with an id greater than aboveStateGroup. State group ids only ever go up, so passing in the maxStateGroup
+// returned by the previous call only counts the rows that were added since then.
+// The counting happens on the database server, only one row per room is sent back.
+func (model *DBModel) GetStateGroupsStateRowCountByRoom(aboveStateGroup int64) (rowCountByRoom map[string]int, maxStateGroup int64, err error) {
+
+	rows, err := model.DB.Query(
+		"SELECT room_id, count(*), max(state_group) FROM state_groups_state WHERE state_group > $1 GROUP BY room_id",
+		aboveStateGroup,
+	)
+	if err != nil {
+		return nil, -1, errors.Wrap(err, "could not count state_groups_state rows by room_id")
+	}
+	defer rows.Close()
+
+	rowCountByRoom = map[string]int{}
+	maxStateGroup = aboveStateGroup
+	for rows.Next() {
+		var roomId string
+		var count int
+		var roomMaxStateGroup int64
+		err := rows.Scan(&roomId, &count, &roomMaxStateGroup)
+		if err != nil {
+			log.Printf("error scanning a state_groups_state row count: %s \n", err)
+		} else {
+			rowCountByRoom[roomId] = count
+			if roomMaxStateGroup > maxStateGroup {
+				maxStateGroup = roomMaxStateGroup
+			}
+		}
 	}
+
+	return rowCountByRoom, maxStateGroup, nil
 }
 
-func (model *DBModel) StateGroupsStateStream() (*StateGroupsStateStream, error) {
-	var estimatedCount int
-	err := model.DB.QueryRow(`
-		SELECT reltuples::bigint FROM pg_class WHERE oid = 'public.state_groups_state'::regclass;
-	`).Scan(&estimatedCount)
+// GetEstimatedRowCount uses the planner statistics instead of count(*) so it returns instantly even on huge tables
+func (model *DBModel) GetEstimatedRowCount(table string) (int64, error) {
+	var estimatedCount int64
+	err := model.DB.QueryRow(
+		"SELECT reltuples::bigint FROM pg_class WHERE oid = to_regclass($1);", fmt.Sprintf("public.%s", table),
+	).Scan(&estimatedCount)
 
 	if err != nil {
-		return nil, errors.Wrap(err, "could not get estimated row count of state_groups_state")
+		return -1, errors.Wrapf(err, "could not get estimated row count of %s", table)
 	}
+	return estimatedCount, nil
+}
 
-	rows, err := model.DB.Query("SELECT state_group, type, state_key, room_id FROM state_groups_state")
+// GetStateGroupRowCounts counts the rows that reference the given state groups in each of the tables
+// that doRoomDeletes cleans up
+func (model *DBModel) GetStateGroupRowCounts(stateGroupIds []int64) (StateGroupRowCounts, error) {
+	counts := StateGroupRowCounts{}
+
+	err := model.DB.QueryRow(
+		"SELECT count(*) FROM state_groups_state where state_group = ANY($1);", pq.Array(stateGroupIds),
+	).Scan(&counts.StateGroupsState)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not select from state_groups_state")
+		return counts, errors.Wrap(err, "could not count state_groups_state by state_group")
 	}
-	toReturn := StateGroupsStateStream{
-		EstimatedCount: estimatedCount,
-		Channel:        make(chan StateGroupsStateRow, 50000),
+
+	err = model.DB.QueryRow(
+		"SELECT count(*) FROM state_group_edges where state_group = ANY($1);", pq.Array(stateGroupIds),
+	).Scan(&counts.StateGroupEdges)
+	if err != nil {
+		return counts, errors.Wrap(err, "could not count state_group_edges by state_group")
+	}
+
+	err = model.DB.QueryRow(
+		"SELECT count(*) FROM event_to_state_groups where state_group = ANY($1);", pq.Array(stateGroupIds),
+	).Scan(&counts.EventToStateGroups)
+	if err != nil {
+		return counts, errors.Wrap(err, "could not count event_to_state_groups by state_group")
 	}
 
-	go func(rows *sql.Rows, channel chan StateGroupsStateRow) {
-		defer rows.Close()
+	return counts, nil
+}
 
-		for rows.Next() {
-			var stateGroup int64
-			var tyype string
-			var stateKey string
-			var roomID string
-			err := rows.Scan(&stateGroup, &tyype, &stateKey, &roomID)
-			if err != nil {
-				log.Printf("error scanning a state_groups_state row: %s \n", err)
-			} else {
-				channel <- StateGroupsStateRow{
-					StateGroup: stateGroup,
-					Type:       tyype,
-					StateKey:   stateKey,
-					RoomID:     roomID,
-				}
-			}
+// GetOrphanedStateGroupCountByRoom counts the state groups that belong to rooms which are not in the rooms table anymore,
+// for example because they were purged through the synapse admin API without the janitor.
+func (model *DBModel) GetOrphanedStateGroupCountByRoom() (map[string]int64, error) {
+
+	rows, err := model.DB.Query(
+		`SELECT state_groups.room_id, count(*) FROM state_groups
+		WHERE NOT EXISTS (SELECT 1 FROM rooms WHERE rooms.room_id = state_groups.room_id)
+		GROUP BY state_groups.room_id`,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not count state_groups for rooms that don't exist")
+	}
+	defer rows.Close()
+
+	countByRoom := map[string]int64{}
+	for rows.Next() {
+		var roomId string
+		var count int64
+		err := rows.Scan(&roomId, &count)
+		if err != nil {
+			log.Printf("error scanning an orphaned state_groups count: %s \n", err)
+		} else {
+			countByRoom[roomId] = count
 		}
+	}
 
-		close(channel)
+	return countByRoom, nil
+}
 
-	}(rows, toReturn.Channel)
+// GetRoomAliases returns every alias that each room goes by: the aliases on this homeserver that point to it,
+// and the canonical alias and alt_aliases from its current m.room.canonical_alias state event.
+// Rooms without any alias are not in the returned map.
+func (model *DBModel) GetRoomAliases(roomIds []string) (map[string][]string, error) {
 
-	return &toReturn, nil
+	rows, err := model.DB.Query(
+		`SELECT room_id, room_alias FROM room_aliases WHERE room_id = ANY($1)
+		UNION
+		SELECT room_id, canonical_alias FROM room_stats_state WHERE room_id = ANY($1) AND canonical_alias IS NOT NULL
+		UNION
+		SELECT current_state_events.room_id, alt_alias.value
+		FROM current_state_events
+		JOIN event_json ON event_json.event_id = current_state_events.event_id
+		CROSS JOIN LATERAL jsonb_array_elements_text(
+			CASE WHEN jsonb_typeof(event_json.json::jsonb -> 'content' -> 'alt_aliases') = 'array'
+			THEN event_json.json::jsonb -> 'content' -> 'alt_aliases' ELSE '[]'::jsonb END
+		) AS alt_alias(value)
+		WHERE current_state_events.room_id = ANY($1)
+		AND current_state_events.type = 'm.room.canonical_alias' AND current_state_events.state_key = ''`,
+		pq.Array(roomIds),
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select room aliases")
+	}
+	defer rows.Close()
+
+	aliasesByRoom := map[string][]string{}
+	for rows.Next() {
+		var roomId string
+		var alias string
+		err := rows.Scan(&roomId, &alias)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not scan a room alias")
+		}
+		aliasesByRoom[roomId] = append(aliasesByRoom[roomId], alias)
+	}
+	return aliasesByRoom, rows.Err()
+}
+
+// GetExistingRoomIds returns which of the rooms are in the rooms table. A room that synapse forgot can come back,
+// for example when someone joins it again over federation, and then its state groups are in use again.
+func (model *DBModel) GetExistingRoomIds(roomIds []string) (map[string]bool, error) {
+
+	rows, err := model.DB.Query("SELECT room_id FROM rooms WHERE room_id = ANY($1);", pq.Array(roomIds))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select rooms by room_id")
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var roomId string
+		err := rows.Scan(&roomId)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not scan a room_id")
+		}
+		existing[roomId] = true
+	}
+	return existing, rows.Err()
+}
+
+// CountStateGroupsStateRowsForRoom counts the state_groups_state rows that belong to the room's state groups
+func (model *DBModel) CountStateGroupsStateRowsForRoom(roomId string) (int64, error) {
+	var count int64
+	err := model.DB.QueryRow(
+		"SELECT count(*) FROM state_groups_state WHERE state_group IN (SELECT id FROM state_groups WHERE room_id = $1);", roomId,
+	).Scan(&count)
+	if err != nil {
+		return -1, errors.Wrapf(err, "could not count state_groups_state rows for %s", roomId)
+	}
+	return count, nil
+}
+
+// GetRoomStats reads the name, alias and member counts of every room from the stats tables that synapse keeps up to date,
+// so the room list doesn't have to ask the admin API about each room.
+func (model *DBModel) GetRoomStats() (map[string]RoomStats, error) {
+	rows, err := model.DB.Query(
+		`SELECT rooms.room_id, coalesce(room_stats_state.name, ''), coalesce(room_stats_state.canonical_alias, ''),
+			coalesce(room_stats_current.joined_members, 0), coalesce(room_stats_current.local_users_in_room, 0)
+		FROM rooms
+		LEFT JOIN room_stats_state ON room_stats_state.room_id = rooms.room_id
+		LEFT JOIN room_stats_current ON room_stats_current.room_id = rooms.room_id`,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select room stats")
+	}
+	defer rows.Close()
+
+	statsByRoom := map[string]RoomStats{}
+	for rows.Next() {
+		var stats RoomStats
+		err := rows.Scan(&stats.RoomId, &stats.Name, &stats.CanonicalAlias, &stats.JoinedMembers, &stats.LocalMembers)
+		if err != nil {
+			log.Printf("error scanning a room stats row: %s \n", err)
+		} else {
+			statsByRoom[stats.RoomId] = stats
+		}
+	}
+
+	return statsByRoom, nil
+}
+
+// CountStateGroupsForRoom counts the rows in state_groups that belong to the room
+func (model *DBModel) CountStateGroupsForRoom(roomId string) (int64, error) {
+	var count int64
+	err := model.DB.QueryRow("SELECT count(*) FROM state_groups WHERE room_id = $1;", roomId).Scan(&count)
+	if err != nil {
+		return -1, errors.Wrapf(err, "could not count state_groups for %s", roomId)
+	}
+	return count, nil
+}
+
+// GetStateGroupsStateRowCountByTypeForRoom counts the state_groups_state rows of the room's state groups by event type,
+// which shows whether the state is mostly membership events or something else.
+func (model *DBModel) GetStateGroupsStateRowCountByTypeForRoom(roomId string) (map[string]int64, error) {
+	rows, err := model.DB.Query(
+		`SELECT type, count(*) FROM state_groups_state
+		WHERE state_group IN (SELECT id FROM state_groups WHERE room_id = $1)
+		GROUP BY type`, roomId,
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not count state_groups_state rows by type for %s", roomId)
+	}
+	defer rows.Close()
+
+	countByType := map[string]int64{}
+	for rows.Next() {
+		var eventType string
+		var count int64
+		err := rows.Scan(&eventType, &count)
+		if err != nil {
+			log.Printf("error scanning a state_groups_state count by type: %s \n", err)
+		} else {
+			countByType[eventType] = count
+		}
+	}
+
+	return countByType, nil
+}
+
+// GetEventCountByTypeForRoom counts the room's rows in the events table by event type
+func (model *DBModel) GetEventCountByTypeForRoom(roomId string) (map[string]int64, error) {
+	rows, err := model.DB.Query("SELECT type, count(*) FROM events WHERE room_id = $1 GROUP BY type", roomId)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not count events by type for %s", roomId)
+	}
+	defer rows.Close()
+
+	countByType := map[string]int64{}
+	for rows.Next() {
+		var eventType string
+		var count int64
+		err := rows.Scan(&eventType, &count)
+		if err != nil {
+			log.Printf("error scanning an events count by type: %s \n", err)
+		} else {
+			countByType[eventType] = count
+		}
+	}
+
+	return countByType, nil
+}
+
+// GetEventTimeRangeForRoom returns the origin_server_ts of the oldest and the newest event in the room, or 0 and 0 if it has none
+func (model *DBModel) GetEventTimeRangeForRoom(roomId string) (oldestUnixMilli int64, newestUnixMilli int64, err error) {
+	err = model.DB.QueryRow(
+		"SELECT coalesce(min(origin_server_ts), 0), coalesce(max(origin_server_ts), 0) FROM events WHERE room_id = $1;", roomId,
+	).Scan(&oldestUnixMilli, &newestUnixMilli)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "could not get the oldest and newest event for %s", roomId)
+	}
+	return oldestUnixMilli, newestUnixMilli, nil
 }
 
 func (model *DBModel) GetStateGroupsForRoom(roomId string) (stateGroupIds []int64, err error) {
@@ -168,36 +445,140 @@ func (model *DBModel) DeleteStateGroupsForRoom(roomId string) (int64, error) {
 	return rowsDeleted, nil
 }
 
-// TODO this maybe should be parallelized to reduce back-and-forth?  (latency-to-db issues)
-// But operating on a sorted list of stateGroup IDs seems to work pretty well
-// I'll leave it as-is for now
-func (model *DBModel) DeleteStateGroupsState(stateGroupIds []int64, startAt int) chan DeleteStateGroupsStateStatus {
+// deleteStateGroupsStateRetryDelay is how long a failed batch waits before it is retried in smaller batches
+var deleteStateGroupsStateRetryDelay = time.Second
+
+type stateGroupsStateBatch struct {
+	Start int
+	End   int
+}
+
+type stateGroupsStateBatchResult struct {
+	Start       int
+	End         int
+	RowsDeleted int64
+	Duration    time.Duration
+	// Failures counts the failed attempts, Err is only set if the batch did not work in the end
+	Failures int64
+	Err      error
+}
+
+// DeleteStateGroupsState deletes all the state_groups_state rows belonging to the given (sorted) state group ids,
+// starting at index startAt. The ids are handed out in batches to a pool of DeleteWorkers workers, each batch is
+// deleted with a single `state_group = ANY($1)` statement inside its own transaction.
+// The batch size starts small and grows up to DeleteMaxBatchSize, but it is cut in half whenever a batch takes
+// longer than DeleteBatchTargetDuration, so one giant room can't lock up the table for minutes at a time.
+//
+// StateGroupsDeleted on the returned statuses is always a "low watermark":
+// every index below it has been processed, so it is safe to pass it back in as startAt after a restart.
+// A batch that fails is retried in smaller batches. If it still fails, the low watermark stays in front of it,
+// no more batches are handed out and the last status has the Error set.
+//
+// When stop is closed, no more batches are handed out. The batches that are already running are finished
+// and the returned channel is closed once they are done.
+func (model *DBModel) DeleteStateGroupsState(stateGroupIds []int64, startAt int, stop <-chan struct{}) chan DeleteStateGroupsStateStatus {
 
 	toReturn := make(chan DeleteStateGroupsStateStatus, 100)
 
+	// a DBModel that was not made by initDatabase doesn't have the defaults, and 0 of either would never finish
+	workers := model.DeleteWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	maxBatchSize := int64(model.DeleteMaxBatchSize)
+	if maxBatchSize < 1 {
+		maxBatchSize = 1
+	}
+
 	go func(stateGroupIds []int64, startAt int, channel chan DeleteStateGroupsStateStatus) {
+		batchSize := int64(10)
+		if batchSize > maxBatchSize {
+			batchSize = maxBatchSize
+		}
+
+		batches := make(chan stateGroupsStateBatch)
+		results := make(chan stateGroupsStateBatchResult)
+		// closed when a batch failed for good, so the batches after it are not deleted
+		failed := make(chan struct{})
+
+		go func() {
+			defer close(batches)
+			for i := startAt; i < len(stateGroupIds); {
+				end := i + int(atomic.LoadInt64(&batchSize))
+				if end > len(stateGroupIds) {
+					end = len(stateGroupIds)
+				}
+				select {
+				case batches <- stateGroupsStateBatch{Start: i, End: end}:
+				case <-stop:
+					return
+				case <-failed:
+					return
+				}
+				i = end
+			}
+		}()
+
+		waitGroup := sync.WaitGroup{}
+		for i := 0; i < workers; i++ {
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				for batch := range batches {
+					results <- model.deleteStateGroupsStateBatchWithRetries(stateGroupIds, batch, 1)
+				}
+			}()
+		}
+		go func() {
+			waitGroup.Wait()
+			close(results)
+		}()
+
 		var rowsDeleted int64 = 0
 		var errorCount int64 = 0
-		for i := startAt; i < len(stateGroupIds); i++ {
-			result, err := model.DB.Exec(
-				"DELETE FROM state_groups_state where state_group = $1;", stateGroupIds[i],
-			)
-			if err != nil {
-				fmt.Println(errors.Wrap(err, "could not delete from state_groups_state by state_group"))
-				errorCount += 1
-				continue
+		failure := ""
+		lowWatermark := startAt
+		finishedBatches := map[int]int{}
+
+		for result := range results {
+			rowsDeleted += result.RowsDeleted
+			errorCount += result.Failures
+			if result.Err != nil {
+				if failure == "" {
+					failure = result.Err.Error()
+					close(failed)
+				}
+			} else {
+				finishedBatches[result.Start] = result.End
 			}
-			affected, err := result.RowsAffected()
-			if err != nil {
-				fmt.Println(errors.Wrap(err, "could not get # of rows affected for delete from state_groups_state by state_group"))
-				errorCount += 1
-				continue
+
+			currentBatchSize := atomic.LoadInt64(&batchSize)
+			if result.Duration > model.DeleteBatchTargetDuration {
+				if currentBatchSize > 1 {
+					atomic.StoreInt64(&batchSize, currentBatchSize/2)
+				}
+			} else if result.Duration < model.DeleteBatchTargetDuration/2 && currentBatchSize < maxBatchSize {
+				newBatchSize := currentBatchSize + currentBatchSize/4 + 1
+				if newBatchSize > maxBatchSize {
+					newBatchSize = maxBatchSize
+				}
+				atomic.StoreInt64(&batchSize, newBatchSize)
 			}
-			rowsDeleted += affected
+
+			for {
+				end, hasEnd := finishedBatches[lowWatermark]
+				if !hasEnd {
+					break
+				}
+				delete(finishedBatches, lowWatermark)
+				lowWatermark = end
+			}
+
 			channel <- DeleteStateGroupsStateStatus{
-				StateGroupsDeleted: int64(i) + 1,
+				StateGroupsDeleted: int64(lowWatermark),
 				RowsDeleted:        rowsDeleted,
 				Errors:             errorCount,
+				Error:              failure,
 			}
 		}
 		close(toReturn)
@@ -206,35 +587,246 @@ func (model *DBModel) DeleteStateGroupsState(stateGroupIds []int64, startAt int)
 	return toReturn
 }
 
+// deleteStateGroupsStateBatchWithRetries deletes a batch, and when that fails it waits a bit and tries again
+// with the two halves of the batch, down to a single state group which gets retriesLeft more tries.
+// The halves are deleted in order and the second one is not tried once the first one failed.
+// Deleting is idempotent, so whatever a failed attempt did delete doesn't matter.
+func (model *DBModel) deleteStateGroupsStateBatchWithRetries(stateGroupIds []int64, batch stateGroupsStateBatch, retriesLeft int) stateGroupsStateBatchResult {
+	result := model.deleteStateGroupsStateBatch(stateGroupIds[batch.Start:batch.End], batch)
+	if result.Err == nil {
+		return result
+	}
+	log.Println(result.Err)
+	result.Failures = 1
+
+	halves := []stateGroupsStateBatch{
+		{Start: batch.Start, End: batch.Start + (batch.End-batch.Start)/2},
+		{Start: batch.Start + (batch.End-batch.Start)/2, End: batch.End},
+	}
+	if batch.End-batch.Start == 1 {
+		if retriesLeft <= 0 {
+			return result
+		}
+		retriesLeft--
+		halves = []stateGroupsStateBatch{batch}
+	}
+
+	time.Sleep(deleteStateGroupsStateRetryDelay)
+	retried := stateGroupsStateBatchResult{Start: batch.Start, End: batch.End, Duration: result.Duration, Failures: 1}
+	for _, half := range halves {
+		halfResult := model.deleteStateGroupsStateBatchWithRetries(stateGroupIds, half, retriesLeft)
+		retried.RowsDeleted += halfResult.RowsDeleted
+		retried.Duration += halfResult.Duration
+		retried.Failures += halfResult.Failures
+		if halfResult.Err != nil {
+			retried.Err = halfResult.Err
+			return retried
+		}
+	}
+	return retried
+}
+
+func (model *DBModel) deleteStateGroupsStateBatch(stateGroupIds []int64, batch stateGroupsStateBatch) (result stateGroupsStateBatchResult) {
+	result = stateGroupsStateBatchResult{
+		Start: batch.Start,
+		End:   batch.End,
+	}
+	startTime := time.Now()
+	defer func() {
+		result.Duration = time.Since(startTime)
+	}()
+
+	tx, err := model.DB.Begin()
+	if err != nil {
+		result.Err = errors.Wrap(err, "could not begin transaction to delete from state_groups_state")
+		return result
+	}
+
+	sqlResult, err := tx.Exec("DELETE FROM state_groups_state where state_group = ANY($1);", pq.Array(stateGroupIds))
+	if err != nil {
+		tx.Rollback()
+		result.Err = errors.Wrapf(err, "could not delete from state_groups_state by state_group (%d-%d)", stateGroupIds[0], stateGroupIds[len(stateGroupIds)-1])
+		return result
+	}
+	affected, err := sqlResult.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		result.Err = errors.Wrap(err, "could not get # of rows affected for delete from state_groups_state by state_group")
+		return result
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		result.Err = errors.Wrap(err, "could not commit delete from state_groups_state by state_group")
+		return result
+	}
+
+	result.RowsDeleted = affected
+	return result
+}
+
+// GetRemoteMediaCachePurgeCutoff works out the before_ts for synapse's purge_media_cache which stays within the limits:
+// the cached remote media that was accessed least recently, up to maxFiles files and maxBytes bytes (0 means no byte limit).
+// synapse purges everything last accessed before the cutoff, so media accessed at the same moment as the first one over the limit is left too.
+// Returns the cutoff and the number of files and bytes that were accessed before it.
+func (model *DBModel) GetRemoteMediaCachePurgeCutoff(
+	lastAccessBeforeUnixMilli int64, maxFiles int, maxBytes int64,
+) (cutoff int64, files int64, bytez int64, err error) {
+
+	rows, err := model.DB.Query(
+		`SELECT last_access_ts, coalesce(media_length, 0) FROM remote_media_cache
+		WHERE last_access_ts < $1 ORDER BY last_access_ts ASC LIMIT $2`,
+		lastAccessBeforeUnixMilli, maxFiles+1,
+	)
+	if err != nil {
+		return -1, -1, -1, errors.Wrap(err, "could not select from remote_media_cache by last_access_ts")
+	}
+	defer rows.Close()
+
+	lastAccesses := []int64{}
+	lengths := []int64{}
+	cutoff = lastAccessBeforeUnixMilli
+	var totalBytes int64
+	for rows.Next() {
+		var lastAccess, length int64
+		err := rows.Scan(&lastAccess, &length)
+		if err != nil {
+			return -1, -1, -1, errors.Wrap(err, "could not scan remote_media_cache row")
+		}
+		if len(lastAccesses) >= maxFiles || (maxBytes > 0 && totalBytes+length > maxBytes) {
+			cutoff = lastAccess
+			break
+		}
+		lastAccesses = append(lastAccesses, lastAccess)
+		lengths = append(lengths, length)
+		totalBytes += length
+	}
+	if err := rows.Err(); err != nil {
+		return -1, -1, -1, errors.Wrap(err, "could not select from remote_media_cache by last_access_ts")
+	}
+
+	for i, lastAccess := range lastAccesses {
+		if lastAccess < cutoff {
+			files++
+			bytez += lengths[i]
+		}
+	}
+	return cutoff, files, bytez, nil
+}
+
+// GetLocalMediaCandidates lists local media that has not been used since the given time, biggest first.
+// Media that was marked safe from quarantine, or that is someone's profile picture, is never listed.
+func (model *DBModel) GetLocalMediaCandidates(lastAccessBeforeUnixMilli int64, minBytes int64, limit int, serverName string) ([]LocalMedia, error) {
+
+	rows, err := model.DB.Query(
+		`SELECT media_id, media_length, created_ts, coalesce(last_access_ts, created_ts), coalesce(user_id, ''), coalesce(upload_name, '')
+		FROM local_media_repository
+		WHERE coalesce(last_access_ts, created_ts) < $1 AND media_length >= $2 AND NOT safe_from_quarantine
+		AND 'mxc://' || $4::text || '/' || media_id NOT IN (SELECT avatar_url FROM profiles WHERE avatar_url IS NOT NULL)
+		ORDER BY media_length DESC LIMIT $3`,
+		lastAccessBeforeUnixMilli, minBytes, limit, serverName,
+	)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not select from local_media_repository")
+	}
+	defer rows.Close()
+
+	media := []LocalMedia{}
+	for rows.Next() {
+		var item LocalMedia
+		err := rows.Scan(&item.MediaId, &item.MediaLength, &item.CreatedUnixMilli, &item.LastAccessUnixMilli, &item.UserId, &item.UploadName)
+		if err != nil {
+			log.Printf("error scanning a local_media_repository row: %s \n", err)
+		} else {
+			media = append(media, item)
+		}
+	}
+
+	return media, nil
+}
+
 // https://dataedo.com/kb/query/postgresql/list-of-tables-by-their-size
 func (model *DBModel) GetDBTableSizes() (tables []DBTableSize, err error) {
 
 	rows, err := model.DB.Query(
-		`select schemaname as table_schema, relname as table_name, pg_relation_size(relid) as data_size 
-		from pg_catalog.pg_statio_user_tables
+		`select tables.schemaname, tables.relname, pg_relation_size(tables.relid), pg_total_relation_size(tables.relid),
+			pg_indexes_size(tables.relid), coalesce(pg_total_relation_size(nullif(class.reltoastrelid, 0)), 0),
+			tables.n_live_tup, tables.n_dead_tup, coalesce((extract(epoch from tables.last_autovacuum)*1000)::bigint, 0),
+			coalesce(widths.row_width, 0)
+		from pg_catalog.pg_stat_user_tables as tables
+		join pg_catalog.pg_class as class on class.oid = tables.relid
+		left join (
+			select schemaname, tablename, sum(avg_width)::bigint as row_width from pg_catalog.pg_stats group by schemaname, tablename
+		) as widths on widths.schemaname = tables.schemaname and widths.tablename = tables.relname
 		`,
 	)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not get table sizes as bytes")
 	}
+	defer rows.Close()
 
 	tables = []DBTableSize{}
 	for rows.Next() {
-		var schema string
-		var name string
-		var bytez int64
+		var table DBTableSize
+		var rowWidth int64
 
-		err := rows.Scan(&schema, &name, &bytez)
+		err := rows.Scan(
+			&table.Schema, &table.Name, &table.Bytes, &table.TotalBytes, &table.IndexBytes, &table.ToastBytes,
+			&table.LiveTuples, &table.DeadTuples, &table.LastAutovacuumUnixMilli, &rowWidth,
+		)
 		if err != nil {
 			log.Printf("error scanning a table size row: %s \n", err)
 		} else {
-			tables = append(tables, DBTableSize{
-				Schema: schema,
-				Name:   name,
-				Bytes:  bytez,
-			})
+			table.EstimatedBloatBytes = estimateBloatBytes(table, rowWidth)
+			tables = append(tables, table)
 		}
 	}
 
 	return tables, nil
 }
+
+// estimateBloatBytes guesses how much of the table is taken up by dead rows and free space that postgres
+// is holding on to. rowWidth is the sum of the average column widths from pg_stats, which is 0 when the
+// table was never analyzed, in that case only the dead tuples are counted.
+func estimateBloatBytes(table DBTableSize, rowWidth int64) int64 {
+	if rowWidth > 0 {
+		// every row has a 24 byte header and a 4 byte pointer to it in the page, and rows are aligned to 8 bytes
+		bytesPerRow := ((24+rowWidth+7)/8)*8 + 4
+		// each 8kB page also has a 24 byte header
+		expectedBytes := int64(float64(table.LiveTuples*bytesPerRow) * float64(8192) / float64(8192-24))
+		if table.Bytes > expectedBytes {
+			return table.Bytes - expectedBytes
+		}
+		return 0
+	}
+	if table.LiveTuples+table.DeadTuples > 0 {
+		return int64(float64(table.Bytes) * float64(table.DeadTuples) / float64(table.LiveTuples+table.DeadTuples))
+	}
+	return 0
+}
+
+// GetTableTotalSize includes the indexes and TOAST data of the table, which VACUUM FULL and pg_repack rewrite as well
+func (model *DBModel) GetTableTotalSize(table string) (int64, error) {
+	var bytez int64
+	err := model.DB.QueryRow(
+		"SELECT coalesce(pg_total_relation_size(to_regclass($1)), 0);", fmt.Sprintf("public.%s", table),
+	).Scan(&bytez)
+	if err != nil {
+		return -1, errors.Wrapf(err, "could not get total size of %s", table)
+	}
+	return bytez, nil
+}
+
+// VacuumTable runs VACUUM (ANALYZE) on the table, or VACUUM (FULL, ANALYZE) which rewrites the whole table and gives
+// the space back to the operating system, but holds an exclusive lock on the table until it is done.
+func (model *DBModel) VacuumTable(table string, full bool) error {
+	options := "ANALYZE"
+	if full {
+		options = "FULL, ANALYZE"
+	}
+	_, err := model.DB.Exec(fmt.Sprintf("VACUUM (%s) public.%s;", options, pq.QuoteIdentifier(table)))
+	if err != nil {
+		return errors.Wrapf(err, "could not VACUUM (%s) %s", options, table)
+	}
+	return nil
+}
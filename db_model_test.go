@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEstimateBloatBytes(t *testing.T) {
+	testCases := []struct {
+		name     string
+		table    DBTableSize
+		rowWidth int64
+		bloat    int64
+	}{
+		{"never analyzed, no rows", DBTableSize{Bytes: 8192}, 0, 0},
+		{"never analyzed, counts the dead tuples", DBTableSize{Bytes: 1000, LiveTuples: 75, DeadTuples: 25}, 0, 250},
+		{"never analyzed, no dead tuples", DBTableSize{Bytes: 1000, LiveTuples: 75}, 0, 0},
+		// 100 bytes of columns + the 24 byte header, aligned to 128, + the 4 byte pointer = 132 bytes per row,
+		// and 1000 rows of that fill 132000 * 8192 / 8168 = 132387 bytes of pages
+		{"analyzed, bigger than the live rows", DBTableSize{Bytes: 200000, LiveTuples: 1000}, 100, 200000 - 132387},
+		{"analyzed, smaller than the live rows", DBTableSize{Bytes: 100000, LiveTuples: 1000}, 100, 0},
+		{"analyzed, dead tuples are part of the bloat", DBTableSize{Bytes: 200000, LiveTuples: 1000, DeadTuples: 500}, 100, 200000 - 132387},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			bloat := estimateBloatBytes(testCase.table, testCase.rowWidth)
+			if bloat != testCase.bloat {
+				t.Errorf("estimateBloatBytes(%+v, %d) = %d, expected %d", testCase.table, testCase.rowWidth, bloat, testCase.bloat)
+			}
+		})
+	}
+}
+
+// stubStateGroupsDriver is a database/sql driver that only understands the DELETE FROM state_groups_state
+// that deleteStateGroupsStateBatch runs. Every state group has one row, and deleting failingStateGroup always fails.
+type stubStateGroupsDriver struct {
+	mutex             sync.Mutex
+	failingStateGroup int64
+	deleted           map[int64]bool
+}
+
+type stubStateGroupsConn struct{ driver *stubStateGroupsDriver }
+type stubStateGroupsStatement struct{ driver *stubStateGroupsDriver }
+type stubStateGroupsTx struct{}
+
+var stubStateGroups = &stubStateGroupsDriver{}
+
+func init() {
+	sql.Register("janitorStubStateGroups", stubStateGroups)
+}
+
+func (stub *stubStateGroupsDriver) Open(name string) (driver.Conn, error) {
+	return &stubStateGroupsConn{driver: stub}, nil
+}
+
+func (conn *stubStateGroupsConn) Prepare(query string) (driver.Stmt, error) {
+	if !strings.HasPrefix(query, "DELETE FROM state_groups_state") {
+		return nil, fmt.Errorf("the stub driver can't run %s", query)
+	}
+	return &stubStateGroupsStatement{driver: conn.driver}, nil
+}
+func (conn *stubStateGroupsConn) Close() error              { return nil }
+func (conn *stubStateGroupsConn) Begin() (driver.Tx, error) { return stubStateGroupsTx{}, nil }
+func (tx stubStateGroupsTx) Commit() error                  { return nil }
+func (tx stubStateGroupsTx) Rollback() error                { return nil }
+func (statement *stubStateGroupsStatement) Close() error    { return nil }
+func (statement *stubStateGroupsStatement) NumInput() int   { return 1 }
+
+func (statement *stubStateGroupsStatement) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, fmt.Errorf("the stub driver can't query")
+}
+
+// Exec gets the state group ids the way pq.Array sends them, as a "{1,2,3}" string
+func (statement *stubStateGroupsStatement) Exec(args []driver.Value) (driver.Result, error) {
+	array, ok := args[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("expected a postgres array, got %T", args[0])
+	}
+	stateGroupIds := []int64{}
+	for _, value := range strings.Split(strings.Trim(array, "{}"), ",") {
+		stateGroupId, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		stateGroupIds = append(stateGroupIds, stateGroupId)
+	}
+
+	stub := statement.driver
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	for _, stateGroupId := range stateGroupIds {
+		if stateGroupId == stub.failingStateGroup {
+			return nil, fmt.Errorf("canceling statement due to lock timeout")
+		}
+	}
+	var deleted int64
+	for _, stateGroupId := range stateGroupIds {
+		if !stub.deleted[stateGroupId] {
+			stub.deleted[stateGroupId] = true
+			deleted++
+		}
+	}
+	return driver.RowsAffected(deleted), nil
+}
+
+func TestDeleteStateGroupsStateStopsAtAFailedBatch(t *testing.T) {
+	originalRetryDelay := deleteStateGroupsStateRetryDelay
+	deleteStateGroupsStateRetryDelay = time.Millisecond
+	t.Cleanup(func() { deleteStateGroupsStateRetryDelay = originalRetryDelay })
+
+	stubStateGroups.failingStateGroup = 13
+	stubStateGroups.deleted = map[int64]bool{}
+	db, err := sql.Open("janitorStubStateGroups", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// with a single worker, at most the one batch that was already waiting for it is handed out after the failure
+	model := &DBModel{DB: db, DeleteWorkers: 1, DeleteMaxBatchSize: 4, DeleteBatchTargetDuration: time.Second}
+
+	stateGroupIds := []int64{}
+	for i := int64(1); i <= 40; i++ {
+		stateGroupIds = append(stateGroupIds, i)
+	}
+
+	var last DeleteStateGroupsStateStatus
+	for status := range model.DeleteStateGroupsState(stateGroupIds, 0, make(chan struct{})) {
+		if status.StateGroupsDeleted < last.StateGroupsDeleted {
+			t.Errorf("the low watermark went backwards from %d to %d", last.StateGroupsDeleted, status.StateGroupsDeleted)
+		}
+		last = status
+	}
+
+	if last.Error == "" || !strings.Contains(last.Error, "lock timeout") {
+		t.Errorf("the last status doesn't have the error of the failed batch: %+v", last)
+	}
+	// state group 13 is at index 12, the watermark has to stay in front of it so resuming retries it
+	if last.StateGroupsDeleted > 12 {
+		t.Errorf("the low watermark moved past the failed state group: %d", last.StateGroupsDeleted)
+	}
+	if last.Errors < 2 {
+		t.Errorf("the failed batch was not retried, %d failed attempts", last.Errors)
+	}
+	for i := 0; i < int(last.StateGroupsDeleted); i++ {
+		if !stubStateGroups.deleted[stateGroupIds[i]] {
+			t.Errorf("state group %d is below the low watermark but was not deleted", stateGroupIds[i])
+		}
+	}
+	if stubStateGroups.deleted[13] {
+		t.Errorf("the failing state group was deleted")
+	}
+	for i := int64(25); i <= 40; i++ {
+		if stubStateGroups.deleted[i] {
+			t.Errorf("state group %d was deleted, batches were still handed out after the failure", i)
+		}
+	}
+
+	// once the problem is gone, resuming from the low watermark deletes the rest
+	stubStateGroups.failingStateGroup = -1
+	for status := range model.DeleteStateGroupsState(stateGroupIds, int(last.StateGroupsDeleted), make(chan struct{})) {
+		last = status
+	}
+	if last.Error != "" || last.StateGroupsDeleted != int64(len(stateGroupIds)) {
+		t.Errorf("resuming after the failure didn't finish: %+v", last)
+	}
+	for _, stateGroupId := range stateGroupIds {
+		if !stubStateGroups.deleted[stateGroupId] {
+			t.Errorf("state group %d was not deleted after resuming", stateGroupId)
+		}
+	}
+}
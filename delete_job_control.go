@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+const (
+	DeleteJobStopPause  = "pause"
+	DeleteJobStopCancel = "cancel"
+)
+
+// deleteJobStop lets the frontend ask the running doRoomDeletes to stop. The channel is nil when no job is running.
+var deleteJobStop = struct {
+	sync.Mutex
+	channel chan struct{}
+	action  string
+	userId  string
+}{}
+
+// startDeleteJobStop is called by doRoomDeletes when it starts, the returned channel is closed when someone asks it to stop
+func startDeleteJobStop() chan struct{} {
+	deleteJobStop.Lock()
+	defer deleteJobStop.Unlock()
+	deleteJobStop.channel = make(chan struct{})
+	deleteJobStop.action = ""
+	deleteJobStop.userId = ""
+	return deleteJobStop.channel
+}
+
+func finishDeleteJobStop() {
+	deleteJobStop.Lock()
+	defer deleteJobStop.Unlock()
+	deleteJobStop.channel = nil
+}
+
+// requestDeleteJobStop asks the running delete job to pause or cancel the next time it can stop safely.
+// It returns false when no delete job is running.
+func requestDeleteJobStop(action string, userId string) bool {
+	deleteJobStop.Lock()
+	defer deleteJobStop.Unlock()
+	if deleteJobStop.channel == nil {
+		return false
+	}
+	// cancelling wins over pausing if both are asked for before the job gets to stop
+	if deleteJobStop.action == "" {
+		close(deleteJobStop.channel)
+	}
+	if deleteJobStop.action != DeleteJobStopCancel {
+		deleteJobStop.action = action
+		deleteJobStop.userId = userId
+	}
+	return true
+}
+
+func getDeleteJobStopRequest() (string, string) {
+	deleteJobStop.Lock()
+	defer deleteJobStop.Unlock()
+	return deleteJobStop.action, deleteJobStop.userId
+}
+
+// cancelDeleteJob gives up on a delete job that is not running. The job is saved to the job history as a record
+// of how far it got. Rooms that synapse already deleted stay deleted, their leftover state groups show up on the orphans page.
+// It returns true when there is a queued job that should be started next.
+func cancelDeleteJob(deleteProgress DeleteProgress, userId string) (bool, error) {
+	deleteProgress.CancelledUnixMilli = time.Now().UnixMilli()
+	deleteProgress.CancelledBy = userId
+	deleteProgress.Paused = false
+
+	next, err := finishDeleteJob(deleteProgress, DeleteJobStatusCancelled)
+	if err != nil {
+		return false, err
+	}
+
+	summary := cancelledDeleteJobSummary(deleteProgress)
+	log.Println(summary)
+	botNotify("%s", summary)
+	appendAuditLog(userId, AuditActionDeleteCancelled, deleteProgress.Id, summary)
+	return next, nil
+}
+
+func cancelledDeleteJobSummary(deleteProgress DeleteProgress) string {
+	deletedBySynapse := 0
+	for _, room := range deleteProgress.Rooms {
+		if room.DeleteRequested && room.Error == "" {
+			deletedBySynapse++
+		}
+	}
+	return fmt.Sprintf(
+		"%s cancelled delete job %s in phase %s: synapse was asked to delete %d of %d rooms and %d state_groups_state rows were deleted. "+
+			"state groups that are left behind can be purged from the orphans page.",
+		deleteProgress.CancelledBy, deleteProgress.Id, deleteProgress.Phase, deletedBySynapse, len(deleteProgress.Rooms),
+		deleteProgress.StateGroupsStateStatus.RowsDeleted,
+	)
+}
+
+// changeStoppedDeleteJob applies a change to a delete job that is paused or has failed.
+// doRoomDeletes can't start while the change is being made.
+func changeStoppedDeleteJob(change func(deleteProgress *DeleteProgress) error) (DeleteProgress, error) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	if runningJobs.deletes {
+		return DeleteProgress{}, errors.New("the delete job is running, pause it first")
+	}
+	deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil {
+		return deleteProgress, err
+	}
+	if len(deleteProgress.Rooms) == 0 {
+		return deleteProgress, errors.New("there is no delete job")
+	}
+	err = change(&deleteProgress)
+	if err != nil {
+		return deleteProgress, err
+	}
+	return deleteProgress, WriteJsonFile("data/deleteRooms.json", deleteProgress)
+}
+
+// cancelStoppedDeleteJob cancels a delete job that is paused or has failed, it does nothing when there is no delete job.
+// doRoomDeletes can't start while the job is being cancelled.
+func cancelStoppedDeleteJob(userId string) (DeleteProgress, bool, error) {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	if runningJobs.deletes {
+		return DeleteProgress{}, false, errors.New("the delete job is starting, try again")
+	}
+	deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil || len(deleteProgress.Rooms) == 0 {
+		return deleteProgress, false, err
+	}
+	start, err := cancelDeleteJob(deleteProgress, userId)
+	deleteProgress.CancelledBy = userId
+	return deleteProgress, start, err
+}
+
+// findFailedRoom returns the index of a room that synapse couldn't delete, rooms can only be retried or dropped
+// before the job has collected their state groups
+func findFailedRoom(deleteProgress *DeleteProgress, roomId string) (int, error) {
+	if deleteProgress.Phase != DeletePhaseShutdown && deleteProgress.Phase != DeletePhaseWaitForShutdown {
+		return -1, fmt.Errorf("rooms can't be changed anymore in phase %s", deleteProgress.Phase)
+	}
+	for i, room := range deleteProgress.Rooms {
+		if room.Id == roomId {
+			if room.Error == "" {
+				return -1, fmt.Errorf("%s did not fail", roomId)
+			}
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("%s is not part of the delete job", roomId)
+}
+
+func registerDeleteJobRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/deleteJob", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" || request.Method != "POST" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		action := request.PostFormValue("action")
+		roomId := request.PostFormValue("roomId")
+		var err error
+		start := false
+
+		// only used to say which job was changed in the audit log
+		current, readErr := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+		if readErr != nil {
+			log.Printf("can't read data/deleteRooms.json: %s\n", readErr)
+		}
+
+		switch action {
+		case DeleteJobStopPause:
+			if !requestDeleteJobStop(DeleteJobStopPause, session.UserID) {
+				_, err = changeStoppedDeleteJob(func(deleteProgress *DeleteProgress) error {
+					deleteProgress.Status = DeleteJobStatusPaused
+					deleteProgress.Paused = true
+					deleteProgress.PausedBy = session.UserID
+					return nil
+				})
+			}
+		case "resume":
+			_, err = changeStoppedDeleteJob(func(deleteProgress *DeleteProgress) error {
+				deleteProgress.Paused = false
+				return nil
+			})
+			start = true
+		case DeleteJobStopCancel:
+			if requestDeleteJobStop(DeleteJobStopCancel, session.UserID) {
+				app.setFlash(responseWriter, session, "info", "the delete job will be cancelled as soon as it can stop safely")
+			} else {
+				var deleteProgress DeleteProgress
+				deleteProgress, start, err = cancelStoppedDeleteJob(session.UserID)
+				if err == nil && len(deleteProgress.Rooms) > 0 {
+					app.setFlash(responseWriter, session, "info", cancelledDeleteJobSummary(deleteProgress))
+				}
+			}
+		case "retryRoom":
+			_, err = changeStoppedDeleteJob(func(deleteProgress *DeleteProgress) error {
+				i, err := findFailedRoom(deleteProgress, roomId)
+				if err != nil {
+					return err
+				}
+				deleteProgress.Rooms[i].Error = ""
+				deleteProgress.Rooms[i].Status = "..."
+				deleteProgress.Rooms[i].DeleteRequested = false
+				deleteProgress.Rooms[i].DeleteId = ""
+				deleteProgress.Phase = DeletePhaseShutdown
+				deleteProgress.Paused = false
+				return nil
+			})
+			start = true
+		case "dropRoom":
+			var deleteProgress DeleteProgress
+			deleteProgress, err = changeStoppedDeleteJob(func(deleteProgress *DeleteProgress) error {
+				i, err := findFailedRoom(deleteProgress, roomId)
+				if err != nil {
+					return err
+				}
+				deleteProgress.Rooms = append(deleteProgress.Rooms[:i], deleteProgress.Rooms[i+1:]...)
+				return nil
+			})
+			if err == nil {
+				log.Printf("%s dropped %s from delete job %s\n", session.UserID, roomId, deleteProgress.Id)
+				if len(deleteProgress.Rooms) == 0 {
+					_, start, err = cancelStoppedDeleteJob(session.UserID)
+				}
+			}
+		default:
+			err = fmt.Errorf("unknown action '%s'", action)
+		}
+
+		if err != nil {
+			log.Printf("%s can't %s the delete job: %s\n", session.UserID, action, err)
+			app.setFlash(responseWriter, session, "error", fmt.Sprintf("can't %s the delete job: %s", action, err))
+		} else {
+			log.Printf("%s did '%s' on the delete job\n", session.UserID, action)
+			auditActions := map[string]string{
+				DeleteJobStopPause: AuditActionDeletePaused,
+				"resume":           AuditActionDeleteResumed,
+				"retryRoom":        AuditActionDeleteRoomRetried,
+				"dropRoom":         AuditActionDeleteRoomDropped,
+			}
+			if auditAction, has := auditActions[action]; has {
+				appendAuditLog(session.UserID, auditAction, current.Id, roomId)
+			}
+			if start {
+				go doRoomDeletes(app.DB, config)
+			}
+		}
+		http.Redirect(responseWriter, request, "/", http.StatusFound)
+	})
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindFailedRoom(t *testing.T) {
+	rooms := []MatrixRoom{
+		{Id: "!ok:example.com"},
+		{Id: "!failed:example.com", Error: "synapse said no"},
+	}
+
+	testCases := []struct {
+		name   string
+		phase  string
+		roomId string
+		index  int
+		err    string
+	}{
+		{"failed room while shutting down", DeletePhaseShutdown, "!failed:example.com", 1, ""},
+		{"failed room while waiting for the shutdown", DeletePhaseWaitForShutdown, "!failed:example.com", 1, ""},
+		{"room that did not fail", DeletePhaseShutdown, "!ok:example.com", -1, "did not fail"},
+		{"room that is not in the job", DeletePhaseShutdown, "!other:example.com", -1, "is not part of the delete job"},
+		{"after the state groups were collected", DeletePhaseStateGroupsState, "!failed:example.com", -1, "can't be changed anymore"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			deleteProgress := &DeleteProgress{Phase: testCase.phase, Rooms: rooms}
+			index, err := findFailedRoom(deleteProgress, testCase.roomId)
+			if index != testCase.index {
+				t.Errorf("expected index %d, got %d", testCase.index, index)
+			}
+			if testCase.err == "" && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if testCase.err != "" && (err == nil || !strings.Contains(err.Error(), testCase.err)) {
+				t.Errorf("expected an error containing '%s', got %v", testCase.err, err)
+			}
+		})
+	}
+}
+
+func TestCancelStoppedDeleteJob(t *testing.T) {
+	newTestJanitor(t, nil)
+	deleteProgress := DeleteProgress{Id: "job1", Phase: DeletePhaseShutdown, Paused: true, Rooms: []MatrixRoom{{Id: "!a:example.com"}}}
+	err := WriteJsonFile("data/deleteRooms.json", deleteProgress)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// doRoomDeletes has claimed the job but has not started listening for a stop yet
+	runningJobs.Lock()
+	runningJobs.deletes = true
+	runningJobs.Unlock()
+	_, _, err = cancelStoppedDeleteJob("@alice:example.com")
+	if err == nil {
+		t.Errorf("a delete job that is starting was cancelled")
+	}
+	remaining, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil || remaining.Id != "job1" {
+		t.Fatalf("the starting delete job was changed: %+v %v", remaining, err)
+	}
+
+	runningJobs.Lock()
+	runningJobs.deletes = false
+	runningJobs.Unlock()
+	cancelled, start, err := cancelStoppedDeleteJob("@alice:example.com")
+	if err != nil || start || cancelled.Id != "job1" || cancelled.CancelledBy != "@alice:example.com" {
+		t.Fatalf("expected job1 to be cancelled, got %+v %t %v", cancelled, start, err)
+	}
+	remaining, err = ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil || len(remaining.Rooms) != 0 {
+		t.Errorf("the cancelled job is still in deleteRooms.json: %+v %v", remaining, err)
+	}
+}
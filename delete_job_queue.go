@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+const (
+	DeleteJobStatusQueued    = "queued"
+	DeleteJobStatusRunning   = "running"
+	DeleteJobStatusPaused    = "paused"
+	DeleteJobStatusFailed    = "failed"
+	DeleteJobStatusComplete  = "complete"
+	DeleteJobStatusCancelled = "cancelled"
+)
+
+// the job that is being worked on is in data/deleteRooms.json, the ones waiting behind it are in data/deleteJobQueue.json
+// and every job that finished or was cancelled is appended to data/deleteJobHistory.jsonl
+var deleteJobQueueMutex sync.Mutex
+
+// enqueueDeleteJob saves a new delete job. It becomes the current job if there is none, otherwise it waits in the queue.
+// The returned bool is true when the job is the current one and doRoomDeletes should be started.
+func enqueueDeleteJob(job DeleteProgress) (DeleteProgress, bool, error) {
+	deleteJobQueueMutex.Lock()
+	defer deleteJobQueueMutex.Unlock()
+
+	if job.Id == "" {
+		job.Id = newCleanupId()
+	}
+	job.Status = DeleteJobStatusQueued
+	job.SubmittedUnixMilli = time.Now().UnixMilli()
+
+	current, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil {
+		return job, false, err
+	}
+	if len(current.Rooms) == 0 {
+		err = WriteJsonFile("data/deleteRooms.json", job)
+		if err != nil {
+			return job, false, err
+		}
+		appendAuditLog(job.SubmittedBy, AuditActionDeleteSubmitted, job.Id, deleteJobAuditDetails(job))
+		return job, true, nil
+	}
+
+	queue, err := ReadJsonFile[[]DeleteProgress]("data/deleteJobQueue.json")
+	if err != nil {
+		return job, false, err
+	}
+	queue = append(queue, job)
+	log.Printf("enqueueDeleteJob(): job %s from %s is waiting behind %d other jobs\n", job.Id, job.SubmittedBy, len(queue))
+	err = WriteJsonFile("data/deleteJobQueue.json", queue)
+	if err != nil {
+		return job, false, err
+	}
+	appendAuditLog(job.SubmittedBy, AuditActionDeleteSubmitted, job.Id, fmt.Sprintf("queued: %s", deleteJobAuditDetails(job)))
+	return job, false, nil
+}
+
+// deleteJobAuditDetails lists the reason and the rooms of a job for the audit log
+func deleteJobAuditDetails(job DeleteProgress) string {
+	rooms := []string{}
+	for _, room := range job.Rooms {
+		if room.Ban {
+			rooms = append(rooms, fmt.Sprintf("%s (ban)", room.IdWithName))
+		} else {
+			rooms = append(rooms, room.IdWithName)
+		}
+	}
+	return fmt.Sprintf("reason: %s, rooms: %s", job.Reason, strings.Join(rooms, ", "))
+}
+
+// finishDeleteJob records how the current job ended and moves the next queued job up.
+// It returns true when there is a next job for doRoomDeletes to work on.
+func finishDeleteJob(deleteProgress DeleteProgress, status string) (bool, error) {
+	deleteJobQueueMutex.Lock()
+	defer deleteJobQueueMutex.Unlock()
+
+	deleteProgress.Status = status
+	deleteProgress.FinishedUnixMilli = time.Now().UnixMilli()
+
+	// keep the finished job around so the panel can still show who was re-joined
+	err := WriteJsonFile("data/lastDeleteJob.json", deleteProgress)
+	if err != nil {
+		return false, err
+	}
+	err = AppendJsonLine("data/deleteJobHistory.jsonl", deleteProgress)
+	if err != nil {
+		return false, err
+	}
+
+	queue, err := ReadJsonFile[[]DeleteProgress]("data/deleteJobQueue.json")
+	if err != nil {
+		return false, err
+	}
+	if len(queue) == 0 {
+		return false, RemoveJsonFile("data/deleteRooms.json")
+	}
+
+	err = WriteJsonFile("data/deleteRooms.json", queue[0])
+	if err != nil {
+		return false, err
+	}
+	log.Printf("finishDeleteJob(): job %s is next\n", queue[0].Id)
+	return true, WriteJsonFile("data/deleteJobQueue.json", queue[1:])
+}
+
+// removeQueuedDeleteJob takes a job out of the queue before it has started and records it as cancelled
+func removeQueuedDeleteJob(id string, userId string) error {
+	deleteJobQueueMutex.Lock()
+	defer deleteJobQueueMutex.Unlock()
+
+	queue, err := ReadJsonFile[[]DeleteProgress]("data/deleteJobQueue.json")
+	if err != nil {
+		return err
+	}
+	for i, job := range queue {
+		if job.Id != id {
+			continue
+		}
+		job.Status = DeleteJobStatusCancelled
+		job.CancelledBy = userId
+		job.CancelledUnixMilli = time.Now().UnixMilli()
+		job.FinishedUnixMilli = job.CancelledUnixMilli
+		err = AppendJsonLine("data/deleteJobHistory.jsonl", job)
+		if err != nil {
+			return err
+		}
+		err = WriteJsonFile("data/deleteJobQueue.json", append(queue[:i], queue[i+1:]...))
+		if err != nil {
+			return err
+		}
+		appendAuditLog(userId, AuditActionDeleteCancelled, id, "removed from the queue before it started")
+		return nil
+	}
+	return fmt.Errorf("job %s is not in the queue", id)
+}
+
+// findDeleteJob looks for a job in the current job, the queue and the history
+func findDeleteJob(id string) (DeleteProgress, bool, error) {
+	// the current job and whether it is running are read together, so a job that is just starting is not reported as failed
+	runningJobs.Lock()
+	running := runningJobs.deletes
+	current, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	runningJobs.Unlock()
+	if err != nil {
+		return DeleteProgress{}, false, err
+	}
+	if current.Id == id && len(current.Rooms) > 0 {
+		// the saved status can be out of date if the janitor was restarted while the job was running
+		current.Status = DeleteJobStatusRunning
+		if current.Paused {
+			current.Status = DeleteJobStatusPaused
+		} else if current.Error != "" && !running {
+			current.Status = DeleteJobStatusFailed
+		}
+		return current, true, nil
+	}
+	queue, err := ReadJsonFile[[]DeleteProgress]("data/deleteJobQueue.json")
+	if err != nil {
+		return DeleteProgress{}, false, err
+	}
+	for _, job := range queue {
+		if job.Id == id {
+			return job, true, nil
+		}
+	}
+	history, err := ReadJsonLines[DeleteProgress]("data/deleteJobHistory.jsonl")
+	if err != nil {
+		return DeleteProgress{}, false, err
+	}
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].Id == id {
+			return history[i], true, nil
+		}
+	}
+
+	// jobs that finished before there was a job history
+	lastDeleteJob, err := ReadJsonFile[DeleteProgress]("data/lastDeleteJob.json")
+	if err != nil {
+		return DeleteProgress{}, false, err
+	}
+	if lastDeleteJob.Id == id && lastDeleteJob.Status == "" {
+		lastDeleteJob.Status = DeleteJobStatusComplete
+		if lastDeleteJob.CancelledUnixMilli != 0 {
+			lastDeleteJob.Status = DeleteJobStatusCancelled
+		}
+		return lastDeleteJob, true, nil
+	}
+	return DeleteProgress{}, false, nil
+}
+
+// getDeleteJobRoomIds returns the rooms of the current job and of every queued job
+func getDeleteJobRoomIds() (map[string]bool, error) {
+	roomIds := map[string]bool{}
+	current, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil {
+		return nil, err
+	}
+	queue, err := ReadJsonFile[[]DeleteProgress]("data/deleteJobQueue.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range append([]DeleteProgress{current}, queue...) {
+		for _, room := range job.Rooms {
+			roomIds[room.Id] = true
+		}
+	}
+	return roomIds, nil
+}
+
+type DeleteJobPhaseDuration struct {
+	Phase    string
+	Duration time.Duration
+}
+
+// PhaseDurations lists how long the job spent in each phase, in the order that the phases run
+func (deleteProgress DeleteProgress) PhaseDurations() []DeleteJobPhaseDuration {
+	durations := []DeleteJobPhaseDuration{}
+	phases := []string{
+		DeletePhaseShutdown, DeletePhaseWaitForShutdown, DeletePhaseCollectStateGroups,
+		DeletePhaseStateGroupsState, DeletePhaseStateGroups, DeletePhaseRejoin,
+	}
+	for _, phase := range phases {
+		if milliseconds, ok := deleteProgress.PhaseDurationsMilli[phase]; ok {
+			durations = append(durations, DeleteJobPhaseDuration{
+				Phase:    phase,
+				Duration: (time.Duration(milliseconds) * time.Millisecond).Round(time.Second),
+			})
+		}
+	}
+	return durations
+}
+
+func registerDeleteJobHistoryRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/jobs", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		if request.Method == "POST" {
+			jobId := request.PostFormValue("jobId")
+			var err error
+			switch request.PostFormValue("action") {
+			case "dequeue":
+				err = removeQueuedDeleteJob(jobId, session.UserID)
+			default:
+				err = errors.New("unknown action")
+			}
+			if err != nil {
+				log.Printf("%s can't remove job %s from the queue: %s\n", session.UserID, jobId, err)
+				app.setFlash(responseWriter, session, "error", err.Error())
+			} else {
+				log.Printf("%s removed job %s from the queue\n", session.UserID, jobId)
+				botNotify("%s removed delete job %s from the queue", session.UserID, jobId)
+			}
+			http.Redirect(responseWriter, request, "/jobs", http.StatusFound)
+			return
+		}
+
+		current, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading deleteRooms json"
+		}
+		queue, err := ReadJsonFile[[]DeleteProgress]("data/deleteJobQueue.json")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading deleteJobQueue json"
+		}
+		history, err := ReadJsonLines[DeleteProgress]("data/deleteJobHistory.jsonl")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading deleteJobHistory jsonl"
+		}
+		// newest first
+		recentJobs := []DeleteProgress{}
+		for i := len(history) - 1; i >= 0 && len(recentJobs) < 100; i-- {
+			recentJobs = append(recentJobs, history[i])
+		}
+
+		jobsTemplateData := struct {
+			HasCurrent bool
+			Current    DeleteProgress
+			Running    bool
+			Queue      []DeleteProgress
+			History    []DeleteProgress
+		}{len(current.Rooms) > 0, current, isDoingDeletes(), queue, recentJobs}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "jobs.html", jobsTemplateData)
+	})
+}
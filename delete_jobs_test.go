@@ -0,0 +1,241 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDoRoomDeletes(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	spamStateGroups := janitor.addRoom(t, "!spam:example.com", "Spam", 20, 10, "@spammer:example.com", "@alice:example.com", "@bob:remote.org")
+	keepStateGroups := janitor.addRoom(t, "!keep:example.com", "Keep", 5, 10, "@alice:example.com")
+
+	job, startNow, err := queueRoomDeletes(janitor.Config, []MatrixRoom{
+		{Id: "!spam:example.com", IdWithName: "!spam:example.com: Spam", Ban: true},
+	}, "@alice:example.com", DeleteJobReason{Reason: "spam", ShutdownMessage: "{{ .RoomName }} was removed: {{ .Reason }}"})
+	if err != nil || !startNow {
+		t.Fatalf("queueRoomDeletes: %t %v", startNow, err)
+	}
+	doRoomDeletes(janitor.DB, janitor.Config)
+
+	job = waitForDeleteJob(t, job.Id, DeleteJobStatusComplete, DeleteJobStatusFailed)
+	if job.Status != DeleteJobStatusComplete {
+		t.Fatalf("the delete job %s: %s", job.Status, job.Error)
+	}
+	if job.StateGroupsStateStatus.RowsDeleted != 200 || job.StateGroupsStateStatus.Errors != 0 {
+		t.Errorf("expected 200 state_groups_state rows deleted without errors, got %+v", job.StateGroupsStateStatus)
+	}
+	for _, phase := range []string{DeletePhaseShutdown, DeletePhaseWaitForShutdown, DeletePhaseStateGroupsState} {
+		if _, has := job.PhaseDurationsMilli[phase]; !has {
+			t.Errorf("the time spent in phase %s was not recorded", phase)
+		}
+	}
+
+	deleteRequests := janitor.Synapse.Room("!spam:example.com").DeleteRequests
+	if len(deleteRequests) != 1 || !deleteRequests[0].Block || deleteRequests[0].Message != "Spam was removed: spam" {
+		t.Errorf("unexpected delete requests %+v", deleteRequests)
+	}
+	if len(janitor.Synapse.Room("!keep:example.com").DeleteRequests) != 0 {
+		t.Errorf("a room that was not part of the job was deleted")
+	}
+
+	counts, err := janitor.DB.GetStateGroupRowCounts(spamStateGroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (StateGroupRowCounts{}) {
+		t.Errorf("rows of the deleted room are left over: %+v", counts)
+	}
+	if count := countRows(t, janitor.DB, "SELECT count(*) FROM state_groups WHERE room_id = '!spam:example.com'"); count != 0 {
+		t.Errorf("%d state_groups of the deleted room are left over", count)
+	}
+	counts, err = janitor.DB.GetStateGroupRowCounts(keepStateGroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts != (StateGroupRowCounts{StateGroupsState: 50, StateGroupEdges: 4, EventToStateGroups: 5}) {
+		t.Errorf("rows of a room that was not deleted are gone: %+v", counts)
+	}
+
+	current, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+	if err != nil || len(current.Rooms) != 0 {
+		t.Errorf("the finished job is still the current one: %v", err)
+	}
+	auditLog, err := ReadJsonLines[AuditEntry]("data/auditLog.jsonl")
+	if err != nil || len(auditLog) == 0 || auditLog[0].Action != AuditActionDeleteSubmitted || !strings.Contains(auditLog[0].Details, "reason: spam") {
+		t.Errorf("the submitted job is not in the audit log: %+v %v", auditLog, err)
+	}
+}
+
+func TestDoRoomDeletesWaitsForSynapseToComeBack(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.addRoom(t, "!a:example.com", "A", 3, 3, "@alice:example.com")
+
+	// more failures than the client retries, so doRoomDeletes sees an error and has to keep waiting on its own
+	restarting := []fakeSynapseFailure{}
+	for i := 0; i <= matrixAdmin.MaxRetries*2; i++ {
+		restarting = append(restarting, fakeSynapseFailure{StatusCode: http.StatusBadGateway})
+	}
+	janitor.Synapse.Fail("GET /_synapse/admin/v2/rooms/!a:example.com/delete_status", restarting...)
+
+	job, _, err := queueRoomDeletes(janitor.Config, []MatrixRoom{{Id: "!a:example.com"}}, "@alice:example.com", DeleteJobReason{Reason: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doRoomDeletes(janitor.DB, janitor.Config)
+
+	job = waitForDeleteJob(t, job.Id, DeleteJobStatusComplete, DeleteJobStatusFailed)
+	if job.Status != DeleteJobStatusComplete {
+		t.Fatalf("the delete job %s: %s %+v", job.Status, job.Error, job.Rooms)
+	}
+	if count := countRows(t, janitor.DB, "SELECT count(*) FROM state_groups_state WHERE room_id = '!a:example.com'"); count != 0 {
+		t.Errorf("%d state_groups_state rows are left over", count)
+	}
+}
+
+func TestDoRoomDeletesStopsWhenSynapseCantDeleteARoom(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.addRoom(t, "!a:example.com", "A", 3, 3, "@alice:example.com")
+	janitor.addRoom(t, "!b:example.com", "B", 3, 3, "@alice:example.com")
+	janitor.Synapse.Fail(
+		"DELETE /_synapse/admin/v2/rooms/!b:example.com",
+		fakeSynapseFailure{StatusCode: http.StatusBadRequest, ErrCode: "M_BAD_STATE"},
+	)
+
+	job, _, err := queueRoomDeletes(janitor.Config, []MatrixRoom{
+		{Id: "!a:example.com"}, {Id: "!b:example.com"},
+	}, "@alice:example.com", DeleteJobReason{Reason: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doRoomDeletes(janitor.DB, janitor.Config)
+
+	job = waitForDeleteJob(t, job.Id, DeleteJobStatusComplete, DeleteJobStatusFailed)
+	if job.Status != DeleteJobStatusFailed || job.Phase != DeletePhaseShutdown {
+		t.Fatalf("expected the job to fail in phase %s, it is %s in phase %s", DeletePhaseShutdown, job.Status, job.Phase)
+	}
+	if !job.Rooms[0].DeleteRequested || job.Rooms[1].DeleteRequested || !strings.Contains(job.Rooms[1].Error, "M_BAD_STATE") {
+		t.Errorf("unexpected rooms %+v", job.Rooms)
+	}
+	if count := countRows(t, janitor.DB, "SELECT count(*) FROM state_groups"); count != 6 {
+		t.Errorf("state groups were deleted before synapse was done: %d are left", count)
+	}
+
+	// retrying the room from the panel finishes the job
+	panel := newTestPanel(t, janitor)
+	janitor.Synapse.AddUser("alice", "password")
+	panel.logIn(t, "alice", "password")
+	response := panel.postForm(t, "/deleteJob", url.Values{"action": []string{"retryRoom"}, "roomId": []string{"!b:example.com"}})
+	if response.StatusCode != http.StatusFound {
+		t.Fatalf("retryRoom returned HTTP %d", response.StatusCode)
+	}
+
+	job = waitForDeleteJob(t, job.Id, DeleteJobStatusComplete)
+	if count := countRows(t, janitor.DB, "SELECT count(*) FROM state_groups"); count != 0 {
+		t.Errorf("%d state groups are left over after the retry", count)
+	}
+}
+
+func TestDeleteJobsWaitInTheQueue(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.addRoom(t, "!a:example.com", "A", 3, 3, "@alice:example.com")
+	janitor.addRoom(t, "!b:example.com", "B", 3, 3, "@alice:example.com")
+
+	first, startNow, err := queueRoomDeletes(janitor.Config, []MatrixRoom{{Id: "!a:example.com"}}, "@alice:example.com", DeleteJobReason{Reason: "first"})
+	if err != nil || !startNow {
+		t.Fatalf("queueRoomDeletes: %t %v", startNow, err)
+	}
+	second, startNow, err := queueRoomDeletes(janitor.Config, []MatrixRoom{{Id: "!b:example.com"}}, "@alice:example.com", DeleteJobReason{Reason: "second"})
+	if err != nil || startNow {
+		t.Fatalf("the second job should wait in the queue: %t %v", startNow, err)
+	}
+	queued, found, err := findDeleteJob(second.Id)
+	if err != nil || !found || queued.Status != DeleteJobStatusQueued {
+		t.Errorf("the second job is not queued: %+v %v", queued, err)
+	}
+
+	// the second job is started by the first one when it is done
+	doRoomDeletes(janitor.DB, janitor.Config)
+	waitForDeleteJob(t, first.Id, DeleteJobStatusComplete)
+	waitForDeleteJob(t, second.Id, DeleteJobStatusComplete)
+
+	history, err := ReadJsonLines[DeleteProgress]("data/deleteJobHistory.jsonl")
+	if err != nil || len(history) != 2 || history[0].Id != first.Id || history[1].Id != second.Id {
+		t.Errorf("unexpected job history %+v %v", history, err)
+	}
+}
+
+func TestDoRoomDeletesRejoinsKickedUsers(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.addRoom(t, "!a:example.com", "A", 3, 3, "@bob:remote.org", "@alice:example.com", "@carol:example.com")
+
+	job, _, err := queueRoomDeletes(janitor.Config, []MatrixRoom{{Id: "!a:example.com", Rejoin: true}}, "@alice:example.com", DeleteJobReason{Reason: "too big"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doRoomDeletes(janitor.DB, janitor.Config)
+
+	job = waitForDeleteJob(t, job.Id, DeleteJobStatusComplete, DeleteJobStatusFailed)
+	if job.Status != DeleteJobStatusComplete {
+		t.Fatalf("the delete job %s: %s", job.Status, job.Error)
+	}
+	joins := janitor.Synapse.Room("!a:example.com").Joins
+	if len(joins) != 2 {
+		t.Fatalf("expected alice and carol to re-join, got %+v", joins)
+	}
+	for _, join := range joins {
+		if len(join.Servers) == 0 || join.Servers[0] != "remote.org" {
+			t.Errorf("%s re-joined through %v instead of remote.org", join.UserId, join.Servers)
+		}
+		if job.Rooms[0].RejoinResults[join.UserId] != "joined" {
+			t.Errorf("the result for %s is %s", join.UserId, job.Rooms[0].RejoinResults[join.UserId])
+		}
+	}
+}
+
+func TestOrphanPurgeLeavesRoomsThatExistAgain(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.addRoom(t, "!gone:example.com", "Gone", 3, 3, "@alice:example.com")
+	janitor.addRoom(t, "!back:example.com", "Back", 3, 3, "@alice:example.com")
+	janitor.addRoom(t, "!rejoined:example.com", "Rejoined", 3, 3, "@alice:example.com")
+	for _, roomId := range []string{"!gone:example.com", "!back:example.com", "!rejoined:example.com"} {
+		purgeRoomLikeSynapse(t, janitor.DB, roomId)
+	}
+	_, err := scanOrphanedStateGroups(janitor.DB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone joins the room over federation after the scan
+	comeBack := func(roomId string) {
+		_, err := janitor.DB.DB.Exec("INSERT INTO rooms (room_id, is_public, creator, room_version) VALUES ($1, false, '@bob:remote.org', '10')", roomId)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	comeBack("!back:example.com")
+	_, _, err = queueOrphanPurge(janitor.DB, janitor.Config, []string{"!gone:example.com", "!back:example.com"}, "@alice:example.com")
+	if err == nil || !strings.Contains(err.Error(), "exists again") {
+		t.Errorf("expected queueOrphanPurge to refuse !back, got %v", err)
+	}
+
+	job, _, err := queueOrphanPurge(janitor.DB, janitor.Config, []string{"!gone:example.com", "!rejoined:example.com"}, "@alice:example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comeBack("!rejoined:example.com")
+	doRoomDeletes(janitor.DB, janitor.Config)
+
+	job = waitForDeleteJob(t, job.Id, DeleteJobStatusComplete, DeleteJobStatusFailed)
+	if job.Status != DeleteJobStatusComplete || len(job.Rooms) != 1 || len(job.SkippedRoomIds) != 1 || job.SkippedRoomIds[0] != "!rejoined:example.com" {
+		t.Fatalf("unexpected job %s %s rooms %+v skipped %v", job.Status, job.Error, job.Rooms, job.SkippedRoomIds)
+	}
+	if count := countRows(t, janitor.DB, "SELECT count(*) FROM state_groups_state WHERE room_id = '!rejoined:example.com'"); count != 9 {
+		t.Errorf("the state of the room that exists again was deleted, %d rows are left", count)
+	}
+	if count := countRows(t, janitor.DB, "SELECT count(*) FROM state_groups WHERE room_id = '!gone:example.com'"); count != 0 {
+		t.Errorf("%d state groups of the orphaned room are left over", count)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// the message that synapse posts to a room before everyone is kicked from it, when DeleteMessageTemplates is not configured
+const defaultDeleteMessage = "This room is being cleaned, stand by..."
+
+type DeleteMessageTemplate struct {
+	Name string
+	// Message is a go text/template, see DeleteMessageData for what it can use
+	Message string
+}
+
+type DeleteMessageData struct {
+	Reason     string
+	RoomId     string
+	RoomName   string
+	ServerName string
+}
+
+// DeleteJobReason is why a delete job was submitted, and what the members of its rooms are told
+type DeleteJobReason struct {
+	Reason string
+	// ShutdownMessage is a go text/template that is rendered for each room. Empty means the first of the DeleteMessageTemplates
+	ShutdownMessage string
+	// when NewRoomUserId is set, synapse creates a room named NewRoomName and moves the local members of the deleted room into it,
+	// where they can read the shutdown message
+	NewRoomUserId string
+	NewRoomName   string
+}
+
+// RoomShutdown is what MatrixAdmin.DeleteRoom passes on to synapse for one room
+type RoomShutdown struct {
+	Message       string
+	NewRoomUserId string
+	RoomName      string
+}
+
+func getDeleteMessageTemplates(config *Config) []DeleteMessageTemplate {
+	if len(config.DeleteMessageTemplates) == 0 {
+		return []DeleteMessageTemplate{{Name: "default", Message: defaultDeleteMessage}}
+	}
+	return config.DeleteMessageTemplates
+}
+
+// findDeleteMessageTemplate returns the message of one of the DeleteMessageTemplates by name
+func findDeleteMessageTemplate(config *Config, name string) (string, error) {
+	for _, messageTemplate := range getDeleteMessageTemplates(config) {
+		if messageTemplate.Name == name {
+			return messageTemplate.Message, nil
+		}
+	}
+	return "", fmt.Errorf("there is no message template named '%s'", name)
+}
+
+func renderDeleteMessage(messageTemplate string, data DeleteMessageData) (string, error) {
+	parsed, err := template.New("message").Option("missingkey=error").Parse(messageTemplate)
+	if err != nil {
+		return "", errors.Wrap(err, "can't parse the shutdown message template")
+	}
+	var buffer bytes.Buffer
+	err = parsed.Execute(&buffer, data)
+	if err != nil {
+		return "", errors.Wrap(err, "can't render the shutdown message template")
+	}
+	return buffer.String(), nil
+}
+
+// validateDeleteJobReason fills in the defaults from config.json and checks everything before the job is saved,
+// so a broken template doesn't fail the job halfway through
+func validateDeleteJobReason(config *Config, reason DeleteJobReason) (DeleteJobReason, error) {
+	reason.Reason = strings.TrimSpace(reason.Reason)
+	reason.NewRoomUserId = strings.TrimSpace(reason.NewRoomUserId)
+	reason.NewRoomName = strings.TrimSpace(reason.NewRoomName)
+	if strings.TrimSpace(reason.ShutdownMessage) == "" {
+		reason.ShutdownMessage = getDeleteMessageTemplates(config)[0].Message
+	}
+
+	_, err := renderDeleteMessage(reason.ShutdownMessage, DeleteMessageData{
+		Reason: reason.Reason, RoomId: "!example:example.com", RoomName: "example", ServerName: config.MatrixServerPublicDomain,
+	})
+	if err != nil {
+		return reason, err
+	}
+	if reason.NewRoomUserId != "" && !isLocalUserId(config, reason.NewRoomUserId) {
+		return reason, fmt.Errorf("the new room has to be created by a local user like @janitor:%s", config.MatrixServerPublicDomain)
+	}
+	return reason, nil
+}
+
+func isLocalUserId(config *Config, userId string) bool {
+	return strings.HasPrefix(userId, "@") && strings.HasSuffix(userId, fmt.Sprintf(":%s", config.MatrixServerPublicDomain))
+}
+
+// getRoomShutdown renders what synapse should tell the members of one of the rooms of a delete job
+func getRoomShutdown(config *Config, reason DeleteJobReason, room MatrixRoom) (RoomShutdown, error) {
+	shutdownMessage := reason.ShutdownMessage
+	if shutdownMessage == "" {
+		shutdownMessage = getDeleteMessageTemplates(config)[0].Message
+	}
+	roomName := strings.TrimPrefix(room.IdWithName, fmt.Sprintf("%s: ", room.Id))
+	if roomName == room.IdWithName {
+		roomName = room.Name
+	}
+	message, err := renderDeleteMessage(shutdownMessage, DeleteMessageData{
+		Reason:     reason.Reason,
+		RoomId:     room.Id,
+		RoomName:   roomName,
+		ServerName: config.MatrixServerPublicDomain,
+	})
+	if err != nil {
+		return RoomShutdown{}, err
+	}
+	return RoomShutdown{Message: message, NewRoomUserId: reason.NewRoomUserId, RoomName: reason.NewRoomName}, nil
+}
+
+// parseDeleteJobReasonForm reads the reason and shutdown message fields of the confirm_delete.html form
+func parseDeleteJobReasonForm(config *Config, request *http.Request) (DeleteJobReason, error) {
+	reason := DeleteJobReason{
+		Reason:        request.PostFormValue("reason"),
+		NewRoomUserId: request.PostFormValue("newRoomUserId"),
+		NewRoomName:   request.PostFormValue("newRoomName"),
+	}
+	var err error
+	messageTemplate := request.PostFormValue("messageTemplate")
+	if messageTemplate == "custom" {
+		reason.ShutdownMessage = request.PostFormValue("customMessage")
+		if strings.TrimSpace(reason.ShutdownMessage) == "" {
+			return reason, errors.New("the custom message is empty")
+		}
+	} else {
+		reason.ShutdownMessage, err = findDeleteMessageTemplate(config, messageTemplate)
+		if err != nil {
+			return reason, err
+		}
+	}
+
+	reason, err = validateDeleteJobReason(config, reason)
+	if err != nil {
+		return reason, err
+	}
+	if reason.Reason == "" {
+		return reason, errors.New("a reason is required, it is saved in the audit log")
+	}
+	return reason, nil
+}
+
+// defaultDeleteJobReason is what the confirm_delete.html form starts out with
+func defaultDeleteJobReason(config *Config) DeleteJobReason {
+	return DeleteJobReason{NewRoomUserId: config.DeleteNewRoomUserId, NewRoomName: config.DeleteNewRoomName}
+}
+
+// buildDeleteConfirmationPage shows the dry run report along with the form for the reason and the shutdown message
+func (app *FrontendApp) buildDeleteConfirmationPage(
+	responseWriter http.ResponseWriter, request *http.Request, session Session, config *Config,
+	report DeletionReport, reason DeleteJobReason, messageTemplate string,
+) {
+	if messageTemplate == "" {
+		messageTemplate = getDeleteMessageTemplates(config)[0].Name
+	}
+
+	confirmTemplateData := struct {
+		DeletionReport
+		Reason           DeleteJobReason
+		MessageTemplate  string
+		MessageTemplates []DeleteMessageTemplate
+		ServerName       string
+	}{report, reason, messageTemplate, getDeleteMessageTemplates(config), config.MatrixServerPublicDomain}
+
+	app.buildPageFromTemplate(responseWriter, request, session, "confirm_delete.html", confirmTemplateData)
+}
+
+func validateDeleteMessageConfig(config *Config) []string {
+	errors := []string{}
+	for _, messageTemplate := range config.DeleteMessageTemplates {
+		if messageTemplate.Name == "" || messageTemplate.Name == "custom" {
+			errors = append(errors, "Can't start because every one of the DeleteMessageTemplates needs a Name, and it can't be 'custom'")
+		}
+		_, err := renderDeleteMessage(messageTemplate.Message, DeleteMessageData{})
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("Can't start because DeleteMessageTemplates '%s' is invalid: %s", messageTemplate.Name, err))
+		}
+	}
+	if config.DeleteNewRoomUserId != "" && !isLocalUserId(config, config.DeleteNewRoomUserId) {
+		errors = append(errors, "Can't start because DeleteNewRoomUserId has to be a local user")
+	}
+	return errors
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+type RoomDeletionReport struct {
+	Room                   MatrixRoom
+	StateGroups            int64
+	FirstStateGroupId      int64
+	LastStateGroupId       int64
+	StateGroupsStateRows   int64
+	StateGroupEdgesRows    int64
+	EventToStateGroupsRows int64
+	EstimatedBytes         int64
+	LocalMembers           []string
+}
+
+type DeletionReport struct {
+	Rooms                  []RoomDeletionReport
+	StateGroups            int64
+	StateGroupsStateRows   int64
+	StateGroupEdgesRows    int64
+	EventToStateGroupsRows int64
+	EstimatedBytes         int64
+	LocalMembers           int
+}
+
+// getStateGroupTablesBytesPerRow returns the average size of a row in each of the tables that doRoomDeletes cleans up
+func getStateGroupTablesBytesPerRow(db *DBModel) (map[string]float64, error) {
+	tables, err := db.GetDBTableSizes()
+	if err != nil {
+		return nil, errors.Wrap(err, "can't GetDBTableSizes")
+	}
+	bytesPerRow := map[string]float64{}
+	for _, table := range tables {
+		if table.Schema != "public" {
+			continue
+		}
+		switch table.Name {
+		case "state_groups", "state_groups_state", "state_group_edges", "event_to_state_groups":
+			estimatedRows, err := db.GetEstimatedRowCount(table.Name)
+			if err != nil {
+				return nil, err
+			}
+			if estimatedRows > 0 {
+				bytesPerRow[table.Name] = float64(table.Bytes) / float64(estimatedRows)
+			}
+		}
+	}
+	return bytesPerRow, nil
+}
+
+// buildDeletionReport works out what doRoomDeletes would remove for the given rooms without changing anything.
+// The byte estimate assumes that every row in a table takes up the average amount of space for that table.
+func buildDeletionReport(db *DBModel, rooms []MatrixRoom) (DeletionReport, error) {
+	report := DeletionReport{
+		Rooms: []RoomDeletionReport{},
+	}
+
+	bytesPerRow, err := getStateGroupTablesBytesPerRow(db)
+	if err != nil {
+		return report, errors.Wrap(err, "can't build deletion report")
+	}
+
+	for _, room := range rooms {
+		roomReport := RoomDeletionReport{
+			Room: room,
+		}
+
+		stateGroupIds, err := db.GetStateGroupsForRoom(room.Id)
+		if err != nil {
+			return report, errors.Wrapf(err, "can't build deletion report for %s", room.Id)
+		}
+		roomReport.StateGroups = int64(len(stateGroupIds))
+		for i, stateGroupId := range stateGroupIds {
+			if i == 0 || stateGroupId < roomReport.FirstStateGroupId {
+				roomReport.FirstStateGroupId = stateGroupId
+			}
+			if stateGroupId > roomReport.LastStateGroupId {
+				roomReport.LastStateGroupId = stateGroupId
+			}
+		}
+
+		if len(stateGroupIds) > 0 {
+			counts, err := db.GetStateGroupRowCounts(stateGroupIds)
+			if err != nil {
+				return report, errors.Wrapf(err, "can't build deletion report for %s", room.Id)
+			}
+			roomReport.StateGroupsStateRows = counts.StateGroupsState
+			roomReport.StateGroupEdgesRows = counts.StateGroupEdges
+			roomReport.EventToStateGroupsRows = counts.EventToStateGroups
+		}
+
+		roomReport.EstimatedBytes = int64(
+			float64(roomReport.StateGroups)*bytesPerRow["state_groups"] +
+				float64(roomReport.StateGroupsStateRows)*bytesPerRow["state_groups_state"] +
+				float64(roomReport.StateGroupEdgesRows)*bytesPerRow["state_group_edges"] +
+				float64(roomReport.EventToStateGroupsRows)*bytesPerRow["event_to_state_groups"],
+		)
+
+		localMembers, err := matrixAdmin.GetLocalRoomMembers(room.Id)
+		if err != nil {
+			// the room may already be gone from synapse, that shouldn't stop us from showing the rest of the report
+			log.Printf("buildDeletionReport(): can't get local members of %s: %s\n", room.Id, err)
+			localMembers = []string{}
+		}
+		roomReport.LocalMembers = localMembers
+
+		report.StateGroups += roomReport.StateGroups
+		report.StateGroupsStateRows += roomReport.StateGroupsStateRows
+		report.StateGroupEdgesRows += roomReport.StateGroupEdgesRows
+		report.EventToStateGroupsRows += roomReport.EventToStateGroupsRows
+		report.EstimatedBytes += roomReport.EstimatedBytes
+		report.LocalMembers += len(roomReport.LocalMembers)
+		report.Rooms = append(report.Rooms, roomReport)
+	}
+
+	return report, nil
+}
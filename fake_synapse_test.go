@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSynapse is an in-process stand-in for the parts of the synapse client and admin APIs that MatrixAdmin uses.
+// Rooms are deleted in the background like the v2 delete API does: every delete request starts its own delete task,
+// and every call to delete_status moves the tasks it returns one step further through their statuses.
+// Like synapse, the delete_status of a room returns all of the tasks that were ever started for it, oldest first.
+type fakeSynapse struct {
+	Server     *httptest.Server
+	AdminToken string
+	ServerName string
+
+	mutex sync.Mutex
+	rooms map[string]*fakeRoom
+	// passwords by localpart
+	passwords map[string]string
+	// user ids by the access tokens handed out by login, logout removes them again
+	accessTokens map[string]string
+	requests     []fakeSynapseRequest
+	failures     map[string][]fakeSynapseFailure
+	nextId       int
+	// onPurge is called once for each room when its deletion is reported as complete, the fixtures use it to remove
+	// the rows that synapse would have removed itself. It is called without holding the mutex.
+	onPurge func(roomId string)
+}
+
+type fakeRoom struct {
+	Details RoomDetails
+	Members []string
+	// DeleteStatuses is what delete_status reports on each call for a delete task, the last one repeats.
+	// When it ends in failed, DeleteError is reported as the error. Each task takes them from the room when it is started.
+	DeleteStatuses []string
+	DeleteError    string
+
+	// DeleteRequests and deleteTasks have one entry for every delete request, in the same order
+	DeleteRequests []DeleteRoomRequest
+	Joins          []fakeSynapseJoin
+	deleteTasks    []*fakeDeleteTask
+	purged         bool
+}
+
+type fakeDeleteTask struct {
+	DeleteId    string
+	Statuses    []string
+	Error       string
+	statusCalls int
+	kickedUsers []string
+}
+
+type fakeSynapseJoin struct {
+	UserId  string
+	Servers []string
+}
+
+type fakeSynapseRequest struct {
+	Method string
+	// EscapedPath is the path exactly as it was sent, Path is unescaped
+	EscapedPath   string
+	Path          string
+	RawQuery      string
+	Authorization string
+	Body          []byte
+}
+
+type fakeSynapseFailure struct {
+	StatusCode   int
+	ErrCode      string
+	RetryAfterMs int64
+	// AfterHandling fakes a proxy that times out after synapse got the request:
+	// the request is handled as usual, but the client gets the failure instead of the response
+	AfterHandling bool
+}
+
+func newFakeSynapse(t *testing.T) *fakeSynapse {
+	fake := &fakeSynapse{
+		AdminToken:   "syt_admin_token",
+		ServerName:   "example.com",
+		rooms:        map[string]*fakeRoom{},
+		passwords:    map[string]string{},
+		accessTokens: map[string]string{},
+		failures:     map[string][]fakeSynapseFailure{},
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.handle))
+	t.Cleanup(fake.Server.Close)
+	return fake
+}
+
+// newMatrixAdmin returns a client for the fake that retries without waiting around
+func (fake *fakeSynapse) newMatrixAdmin(adminMatrixRoomId string) *MatrixAdmin {
+	return &MatrixAdmin{
+		Client:                   http.Client{},
+		AdminMatrixRoomId:        adminMatrixRoomId,
+		MatrixServerPublicDomain: fake.ServerName,
+		URL:                      fake.Server.URL,
+		Token:                    fake.AdminToken,
+		MaxRetries:               3,
+		RetryBaseDelay:           time.Millisecond,
+		RetryMaxDelay:            10 * time.Millisecond,
+	}
+}
+
+func (fake *fakeSynapse) AddRoom(roomId, name, canonicalAlias string, members ...string) *fakeRoom {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+
+	localMembers := 0
+	for _, member := range members {
+		if strings.HasSuffix(member, fmt.Sprintf(":%s", fake.ServerName)) {
+			localMembers++
+		}
+	}
+	room := &fakeRoom{
+		Details: RoomDetails{
+			RoomId:             roomId,
+			Name:               name,
+			CanonicalAlias:     canonicalAlias,
+			JoinedMembers:      len(members),
+			JoinedLocalMembers: localMembers,
+			Version:            "10",
+			Creator:            members[0],
+		},
+		Members: members,
+		DeleteStatuses: []string{
+			RoomDeletionStatusShuttingDown, RoomDeletionStatusPurging, RoomDeletionStatusComplete,
+		},
+	}
+	fake.rooms[roomId] = room
+	return room
+}
+
+// SetDeleteStatuses changes the statuses of the delete tasks that are started for a room from now on
+func (fake *fakeSynapse) SetDeleteStatuses(roomId string, deleteError string, statuses ...string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.rooms[roomId].DeleteStatuses = statuses
+	fake.rooms[roomId].DeleteError = deleteError
+}
+
+func (fake *fakeSynapse) AddUser(localpart, password string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.passwords[localpart] = password
+}
+
+// Fail makes the next requests to a path fail, one failure per request, before they are handled normally again.
+// The path is unescaped, for example "GET /_synapse/admin/v1/rooms/!abc:example.com"
+func (fake *fakeSynapse) Fail(methodAndPath string, failures ...fakeSynapseFailure) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	fake.failures[methodAndPath] = append(fake.failures[methodAndPath], failures...)
+}
+
+func (fake *fakeSynapse) Room(roomId string) fakeRoom {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return *fake.rooms[roomId]
+}
+
+func (fake *fakeSynapse) Requests() []fakeSynapseRequest {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]fakeSynapseRequest{}, fake.requests...)
+}
+
+// RequestCount counts the requests that were made to a path, including the ones that failed
+func (fake *fakeSynapse) RequestCount(method, path string) int {
+	count := 0
+	for _, request := range fake.Requests() {
+		if request.Method == method && request.Path == path {
+			count++
+		}
+	}
+	return count
+}
+
+func (fake *fakeSynapse) handle(responseWriter http.ResponseWriter, request *http.Request) {
+	body, _ := io.ReadAll(request.Body)
+	segments := strings.Split(strings.TrimPrefix(request.URL.EscapedPath(), "/"), "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			fake.writeError(responseWriter, http.StatusBadRequest, "M_UNRECOGNIZED", fmt.Sprintf("bad path segment %s", segment))
+			return
+		}
+		segments[i] = unescaped
+	}
+	path := fmt.Sprintf("/%s", strings.Join(segments, "/"))
+
+	fake.mutex.Lock()
+	fake.requests = append(fake.requests, fakeSynapseRequest{
+		Method:        request.Method,
+		EscapedPath:   request.URL.EscapedPath(),
+		Path:          path,
+		RawQuery:      request.URL.RawQuery,
+		Authorization: request.Header.Get("Authorization"),
+		Body:          body,
+	})
+	methodAndPath := fmt.Sprintf("%s %s", request.Method, path)
+	if failures := fake.failures[methodAndPath]; len(failures) > 0 {
+		fake.failures[methodAndPath] = failures[1:]
+		fake.mutex.Unlock()
+		failure := failures[0]
+		if failure.AfterHandling {
+			fake.route(httptest.NewRecorder(), request, path, segments, body)
+		}
+		errCode := failure.ErrCode
+		if errCode == "" {
+			errCode = "M_UNKNOWN"
+		}
+		fake.writeJson(responseWriter, failure.StatusCode, map[string]interface{}{
+			"errcode": errCode, "error": "injected failure", "retry_after_ms": failure.RetryAfterMs,
+		})
+		return
+	}
+	fake.mutex.Unlock()
+
+	fake.route(responseWriter, request, path, segments, body)
+}
+
+func (fake *fakeSynapse) route(responseWriter http.ResponseWriter, request *http.Request, path string, segments []string, body []byte) {
+	if request.URL.Query().Has("access_token") {
+		fake.writeError(responseWriter, http.StatusBadRequest, "M_UNRECOGNIZED", "the access token belongs in the Authorization header")
+		return
+	}
+
+	switch {
+	case request.Method == "POST" && path == "/_matrix/client/v3/login":
+		fake.login(responseWriter, body)
+	case request.Method == "POST" && path == "/_matrix/client/v3/logout":
+		fake.logout(responseWriter, request)
+	case !fake.isAdmin(request):
+		fake.writeError(responseWriter, http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "Invalid access token passed.")
+	case request.Method == "GET" && len(segments) == 5 && strings.HasPrefix(path, "/_synapse/admin/v1/rooms/"):
+		fake.roomDetails(responseWriter, segments[4])
+	case request.Method == "GET" && len(segments) == 6 && strings.HasPrefix(path, "/_synapse/admin/v1/rooms/") && segments[5] == "members":
+		fake.roomMembers(responseWriter, segments[4])
+	case request.Method == "DELETE" && len(segments) == 5 && strings.HasPrefix(path, "/_synapse/admin/v2/rooms/"):
+		fake.deleteRoom(responseWriter, segments[4], body)
+	case request.Method == "GET" && len(segments) == 6 && strings.HasPrefix(path, "/_synapse/admin/v2/rooms/delete_status/"):
+		fake.deleteStatusById(responseWriter, segments[5])
+	case request.Method == "GET" && len(segments) == 6 && strings.HasPrefix(path, "/_synapse/admin/v2/rooms/") && segments[5] == "delete_status":
+		fake.deleteStatus(responseWriter, segments[4])
+	case request.Method == "POST" && len(segments) == 5 && strings.HasPrefix(path, "/_synapse/admin/v1/join/"):
+		fake.join(responseWriter, segments[4], request.URL.Query()["server_name"], body)
+	default:
+		fake.writeError(responseWriter, http.StatusNotFound, "M_UNRECOGNIZED", "Unrecognized request")
+	}
+}
+
+func (fake *fakeSynapse) isAdmin(request *http.Request) bool {
+	return request.Header.Get("Authorization") == fmt.Sprintf("Bearer %s", fake.AdminToken)
+}
+
+func (fake *fakeSynapse) login(responseWriter http.ResponseWriter, body []byte) {
+	var loginRequest LoginRequestBody
+	err := json.Unmarshal(body, &loginRequest)
+	if err != nil || loginRequest.Type != "m.login.password" {
+		fake.writeError(responseWriter, http.StatusBadRequest, "M_BAD_JSON", "bad login request")
+		return
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	password, hasUser := fake.passwords[loginRequest.Identifier.User]
+	if !hasUser || password != loginRequest.Password {
+		fake.writeError(responseWriter, http.StatusForbidden, "M_FORBIDDEN", "Invalid username or password")
+		return
+	}
+	fake.nextId++
+	accessToken := fmt.Sprintf("syt_user_token_%d", fake.nextId)
+	fake.accessTokens[accessToken] = fmt.Sprintf("@%s:%s", loginRequest.Identifier.User, fake.ServerName)
+	fake.writeJson(responseWriter, http.StatusOK, LoginResponseBody{AccessToken: accessToken})
+}
+
+func (fake *fakeSynapse) logout(responseWriter http.ResponseWriter, request *http.Request) {
+	accessToken := strings.TrimPrefix(request.Header.Get("Authorization"), "Bearer ")
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	if _, has := fake.accessTokens[accessToken]; !has {
+		fake.writeError(responseWriter, http.StatusUnauthorized, "M_UNKNOWN_TOKEN", "Invalid access token passed.")
+		return
+	}
+	delete(fake.accessTokens, accessToken)
+	fake.writeJson(responseWriter, http.StatusOK, map[string]interface{}{})
+}
+
+func (fake *fakeSynapse) roomDetails(responseWriter http.ResponseWriter, roomId string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	room, has := fake.rooms[roomId]
+	if !has || room.purged {
+		fake.writeError(responseWriter, http.StatusNotFound, "M_NOT_FOUND", "Room not found")
+		return
+	}
+	fake.writeJson(responseWriter, http.StatusOK, room.Details)
+}
+
+func (fake *fakeSynapse) roomMembers(responseWriter http.ResponseWriter, roomId string) {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	room, has := fake.rooms[roomId]
+	if !has || room.purged {
+		fake.writeError(responseWriter, http.StatusNotFound, "M_NOT_FOUND", "Room not found")
+		return
+	}
+	fake.writeJson(responseWriter, http.StatusOK, map[string]interface{}{"members": room.Members, "total": len(room.Members)})
+}
+
+func (fake *fakeSynapse) deleteRoom(responseWriter http.ResponseWriter, roomId string, body []byte) {
+	var deleteRequest DeleteRoomRequest
+	err := json.Unmarshal(body, &deleteRequest)
+	if err != nil {
+		fake.writeError(responseWriter, http.StatusBadRequest, "M_BAD_JSON", "bad delete request")
+		return
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	room, has := fake.rooms[roomId]
+	if !has {
+		fake.writeError(responseWriter, http.StatusBadRequest, "M_UNKNOWN", fmt.Sprintf("Room %s is not known", roomId))
+		return
+	}
+	fake.nextId++
+	task := &fakeDeleteTask{
+		DeleteId:    fmt.Sprintf("delete%d", fake.nextId),
+		Statuses:    append([]string{}, room.DeleteStatuses...),
+		Error:       room.DeleteError,
+		kickedUsers: []string{},
+	}
+	for _, member := range room.Members {
+		if strings.HasSuffix(member, fmt.Sprintf(":%s", fake.ServerName)) {
+			task.kickedUsers = append(task.kickedUsers, member)
+		}
+	}
+	room.DeleteRequests = append(room.DeleteRequests, deleteRequest)
+	room.deleteTasks = append(room.deleteTasks, task)
+	fake.writeJson(responseWriter, http.StatusOK, DeleteRoomResponse{DeleteId: task.DeleteId})
+}
+
+// advanceDeleteTask moves the task one step further and returns its status, and whether the room was purged just now.
+// The caller holds the mutex.
+func (fake *fakeSynapse) advanceDeleteTask(room *fakeRoom, task *fakeDeleteTask) (RoomDeletionStatus, bool) {
+	step := task.statusCalls
+	if step >= len(task.Statuses) {
+		step = len(task.Statuses) - 1
+	}
+	task.statusCalls++
+	status := RoomDeletionStatus{
+		DeleteId: task.DeleteId,
+		Status:   task.Statuses[step],
+		ShutdownRoom: ShutdownRoom{
+			KickedUsers:       task.kickedUsers,
+			FailedToKickUsers: []string{},
+			LocalAliases:      []string{},
+		},
+	}
+	if status.Status == RoomDeletionStatusFailed {
+		status.Error = task.Error
+	}
+	purgedNow := status.Status == RoomDeletionStatusComplete && !room.purged
+	if purgedNow {
+		room.purged = true
+	}
+	return status, purgedNow
+}
+
+func (fake *fakeSynapse) deleteStatus(responseWriter http.ResponseWriter, roomId string) {
+	fake.mutex.Lock()
+	room, has := fake.rooms[roomId]
+	if !has || len(room.deleteTasks) == 0 {
+		fake.mutex.Unlock()
+		fake.writeError(responseWriter, http.StatusNotFound, "M_NOT_FOUND", "No delete task for room_id found")
+		return
+	}
+
+	results := []RoomDeletionStatus{}
+	purged := false
+	for _, task := range room.deleteTasks {
+		status, purgedNow := fake.advanceDeleteTask(room, task)
+		results = append(results, status)
+		purged = purged || purgedNow
+	}
+	onPurge := fake.onPurge
+	fake.mutex.Unlock()
+
+	if purged && onPurge != nil {
+		onPurge(roomId)
+	}
+	fake.writeJson(responseWriter, http.StatusOK, RoomDeletionStatusResponse{Results: results})
+}
+
+func (fake *fakeSynapse) deleteStatusById(responseWriter http.ResponseWriter, deleteId string) {
+	fake.mutex.Lock()
+	for roomId, room := range fake.rooms {
+		for _, task := range room.deleteTasks {
+			if task.DeleteId != deleteId {
+				continue
+			}
+			status, purgedNow := fake.advanceDeleteTask(room, task)
+			onPurge := fake.onPurge
+			fake.mutex.Unlock()
+
+			if purgedNow && onPurge != nil {
+				onPurge(roomId)
+			}
+			fake.writeJson(responseWriter, http.StatusOK, status)
+			return
+		}
+	}
+	fake.mutex.Unlock()
+	fake.writeError(responseWriter, http.StatusNotFound, "M_NOT_FOUND", "delete id not found")
+}
+
+func (fake *fakeSynapse) join(responseWriter http.ResponseWriter, roomId string, servers []string, body []byte) {
+	var joinRequest JoinRoomRequest
+	err := json.Unmarshal(body, &joinRequest)
+	if err != nil {
+		fake.writeError(responseWriter, http.StatusBadRequest, "M_BAD_JSON", "bad join request")
+		return
+	}
+
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	room, has := fake.rooms[roomId]
+	if !has {
+		fake.writeError(responseWriter, http.StatusNotFound, "M_NOT_FOUND", "Room not found")
+		return
+	}
+	if room.purged && len(servers) == 0 {
+		fake.writeError(responseWriter, http.StatusNotFound, "M_UNKNOWN", "No known servers")
+		return
+	}
+	room.Joins = append(room.Joins, fakeSynapseJoin{UserId: joinRequest.UserId, Servers: servers})
+	fake.writeJson(responseWriter, http.StatusOK, map[string]interface{}{"room_id": roomId})
+}
+
+func (fake *fakeSynapse) writeError(responseWriter http.ResponseWriter, status int, errCode, message string) {
+	fake.writeJson(responseWriter, status, map[string]interface{}{"errcode": errCode, "error": message})
+}
+
+func (fake *fakeSynapse) writeJson(responseWriter http.ResponseWriter, status int, object interface{}) {
+	responseBytes, _ := json.Marshal(object)
+	responseWriter.Header().Set("Content-Type", "application/json")
+	responseWriter.WriteHeader(status)
+	responseWriter.Write(responseBytes)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStorage keeps every key in its own file, relative to the working directory.
+type FileStorage struct {
+	mutex sync.Mutex
+}
+
+func NewFileStorage() *FileStorage {
+	return &FileStorage{}
+}
+
+func (fileStorage *FileStorage) Get(key string) ([]byte, error) {
+	fileStorage.mutex.Lock()
+	defer fileStorage.mutex.Unlock()
+
+	fileBytes, err := os.ReadFile(key)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+	return fileBytes, err
+}
+
+// Put writes to a temporary file first and then renames it over the original,
+// so the original is never left half-written if the process dies halfway through.
+func (fileStorage *FileStorage) Put(key string, value []byte) error {
+	fileStorage.mutex.Lock()
+	defer fileStorage.mutex.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(key), 0755)
+	if err != nil {
+		return err
+	}
+
+	temporaryPath := fmt.Sprintf("%s.tmp", key)
+	file, err := os.OpenFile(temporaryPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(value)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(temporaryPath)
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporaryPath, key)
+}
+
+func (fileStorage *FileStorage) Append(key string, value []byte) error {
+	fileStorage.mutex.Lock()
+	defer fileStorage.mutex.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(key), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(key, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(value)
+	return err
+}
+
+func (fileStorage *FileStorage) Delete(key string) error {
+	fileStorage.mutex.Lock()
+	defer fileStorage.mutex.Unlock()
+
+	err := os.Remove(key)
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (fileStorage *FileStorage) Close() error {
+	return nil
+}
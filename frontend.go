@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -48,14 +49,59 @@ type MatrixRoom struct {
 	IdWithName string
 	Rows       int
 	Percent    int
-
-	Ban    bool
-	Status string
+	Estimated  bool
+	Protected  bool
+	Denylisted bool
+
+	Ban             bool
+	Status          string
+	DeleteRequested bool
+	// DeleteId is the synapse delete task of the latest attempt to delete the room
+	DeleteId string
+
+	Rejoin        bool
+	RejoinServers []string
+	KickedUsers   []string
+	RejoinResults map[string]string
+
+	// Error is set when synapse couldn't delete the room, the room can be retried or dropped from the job
+	Error string
 }
 
 type DeleteProgress struct {
+	Id                       string
 	Rooms                    []MatrixRoom
+	Phase                    string
+	StateGroupsToDelete      int
+	StateGroupsStateIndex    int
 	StateGroupsStateProgress int
+	StateGroupsStateStatus   DeleteStateGroupsStateStatus
+
+	// a paused job is not resumed when the janitor starts, someone has to press resume
+	Paused   bool
+	PausedBy string
+	// Error is why the job stopped the last time it ran
+	Error              string
+	CancelledUnixMilli int64
+	CancelledBy        string
+
+	// why the job was submitted and what the members of the rooms are told, see delete_message.go
+	DeleteJobReason
+
+	// job history, see delete_job_queue.go
+	Status                string
+	SubmittedBy           string
+	SubmittedUnixMilli    int64
+	StartedUnixMilli      int64
+	FinishedUnixMilli     int64
+	PhaseStartedUnixMilli int64
+	PhaseDurationsMilli   map[string]int64
+	StateGroupRowsDeleted int64
+	// BytesPerRow is measured before anything is deleted, so the space reclaimed can be estimated afterwards
+	BytesPerRow             map[string]float64
+	EstimatedBytesReclaimed int64
+	// SkippedRoomIds were taken out of the job because they were back in the rooms table when it got to their state groups
+	SkippedRoomIds []string
 }
 
 func initFrontend(config *Config, db *DBModel) FrontendApp {
@@ -93,8 +139,19 @@ func initFrontend(config *Config, db *DBModel) FrontendApp {
 			if err != nil {
 				(*session.Flash)["error"] = "an error occurred reading deleteRooms json"
 			}
-			if deleteProgress.Rooms != nil && len(deleteProgress.Rooms) > 0 {
-				app.buildPageFromTemplate(responseWriter, request, session, "deleting.html", deleteProgress)
+			// while a job is deleting, new delete jobs can still be submitted from the /rooms page and wait in the queue
+			if request.Method != "POST" && deleteProgress.Rooms != nil && len(deleteProgress.Rooms) > 0 {
+				queue, err := ReadJsonFile[[]DeleteProgress]("data/deleteJobQueue.json")
+				if err != nil {
+					(*session.Flash)["error"] = "an error occurred reading deleteJobQueue json"
+				}
+				deletingTemplateData := struct {
+					DeleteProgress
+					Running               bool
+					WaitingForMaintenance bool
+					Queue                 []DeleteProgress
+				}{deleteProgress, isDoingDeletes(), isDoingMaintenance(), queue}
+				app.buildPageFromTemplate(responseWriter, request, session, "deleting.html", deletingTemplateData)
 				return
 			}
 
@@ -104,54 +161,125 @@ func initFrontend(config *Config, db *DBModel) FrontendApp {
 				measureMediaSize := request.PostFormValue("measureMediaSize") == "on"
 				stateGroupsStateScan := request.PostFormValue("stateGroupsStateScan") == "on"
 				if refresh == "true" {
+					appendAuditLog(
+						session.UserID, AuditActionRescan, "",
+						fmt.Sprintf("measureMediaSize: %t, stateGroupsStateScan: %t", measureMediaSize, stateGroupsStateScan),
+					)
 					go runScheduledTask(db, config, measureMediaSize, stateGroupsStateScan)
 
 					http.Redirect(responseWriter, request, "/", http.StatusFound)
 					return
 				}
 
+				// the form has an id_N field for every room it lists, but N is not necessarily contiguous
+				formIndexes := []int{}
+				for key := range request.PostForm {
+					index, err := strconv.Atoi(strings.TrimPrefix(key, "id_"))
+					if strings.HasPrefix(key, "id_") && err == nil {
+						formIndexes = append(formIndexes, index)
+					}
+				}
+				sort.Ints(formIndexes)
+
 				toDelete := []MatrixRoom{}
-				for i := 0; i < 20; i++ {
+				for _, i := range formIndexes {
 					roomId := request.PostFormValue(fmt.Sprintf("id_%d", i))
 					delete := request.PostFormValue(fmt.Sprintf("delete_%d", i))
 					ban := request.PostFormValue(fmt.Sprintf("ban_%d", i))
+					rejoin := request.PostFormValue(fmt.Sprintf("rejoin_%d", i))
 
 					if roomId != "" && (delete != "" || ban != "") {
 						toDelete = append(toDelete, MatrixRoom{
 							Id:         roomId,
 							Ban:        ban != "",
+							Rejoin:     rejoin != "" && ban == "",
 							IdWithName: fmt.Sprintf("%s: %s", roomId, app.getMatrixRoomNameWithCache(roomId)),
 							Status:     "...",
 						})
 					}
 				}
-				err := WriteJsonFile("data/deleteRooms.json", DeleteProgress{
-					Rooms: toDelete,
-				})
+				toDelete, refused, err := removeProtectedRooms(app.DB, config, toDelete)
 				if err != nil {
-					(*session.Flash)["error"] = "an error occurred saving deleteRooms json"
+					app.unhandledError(responseWriter, request, err)
+					return
+				}
+				if len(toDelete) == 0 {
+					app.setFlash(responseWriter, session, "error", strings.Join(refused, "\n"))
+					http.Redirect(responseWriter, request, "/", http.StatusFound)
+					return
+				}
+				if len(refused) > 0 {
+					(*session.Flash)["error"] = strings.Join(refused, "\n")
+				}
+
+				// nothing destructive happens until the admin has seen the dry run report and confirmed it with a reason
+				reason := defaultDeleteJobReason(config)
+				if request.PostFormValue("confirm") == "true" {
+					reason, err = parseDeleteJobReasonForm(config, request)
+					if err != nil {
+						(*session.Flash)["error"] = err.Error()
+					}
+				}
+				if request.PostFormValue("confirm") != "true" || err != nil {
+					report, err := buildDeletionReport(db, toDelete)
+					if err != nil {
+						app.unhandledError(responseWriter, request, err)
+						return
+					}
+					app.buildDeleteConfirmationPage(
+						responseWriter, request, session, config, report, reason, request.PostFormValue("messageTemplate"),
+					)
+					return
 				}
 
-				go doRoomDeletes(app.DB)
+				job, err := startRoomDeletes(app.DB, config, toDelete, session.UserID, reason)
+				if err != nil {
+					log.Printf("can't start room deletes: %s\n", err)
+					app.setFlash(responseWriter, session, "error", "an error occurred saving the delete job")
+				} else {
+					if len(deleteProgress.Rooms) > 0 {
+						app.setFlash(responseWriter, session, "info", fmt.Sprintf("delete job %s is queued behind delete job %s", job.Id, deleteProgress.Id))
+					}
+					// the rooms picked on the /rooms page are being deleted now
+					err = saveRoomSelection(session.UserID, nil)
+					if err != nil {
+						log.Printf("can't clear the room selection of %s: %s\n", session.UserID, err)
+					}
+				}
 
 				http.Redirect(responseWriter, request, "/", http.StatusFound)
 				return
 			}
 
-			diskUsage, err := os.ReadFile("data/diskUsage.json")
+			diskUsage, err := storage.Get("data/diskUsage.json")
 			if err != nil {
 				(*session.Flash)["error"] = "an error occurred reading diskUsage json"
 			}
-			dbTableSizes, err := os.ReadFile("data/dbTableSizes.json")
+			dbTableSizes, err := storage.Get("data/dbTableSizes.json")
 			if err != nil {
 				(*session.Flash)["error"] = "an error occurred reading dbTableSizes json"
 			}
+			largestTables, err := ReadJsonFile[[]DBTableSize]("data/dbTableSizes.json")
+			if err != nil {
+				(*session.Flash)["error"] = "an error occurred reading dbTableSizes json"
+			}
+			sort.Slice(largestTables, func(i, j int) bool {
+				return largestTables[i].TotalBytes > largestTables[j].TotalBytes
+			})
+			if len(largestTables) > 10 {
+				largestTables = largestTables[:10]
+			}
 
 			rowCountByRoomObject, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
 			if err != nil {
 				(*session.Flash)["error"] = "an error occurred reading rowCountByRoom json object"
 			}
 
+			scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+			if err != nil {
+				(*session.Flash)["error"] = "an error occurred reading stateGroupsStateScan json"
+			}
+
 			roomsSlice := []MatrixRoom{}
 			totalRowCount := 0
 			for roomId, rows := range rowCountByRoomObject {
@@ -167,17 +295,38 @@ func initFrontend(config *Config, db *DBModel) FrontendApp {
 				return roomsSlice[i].Rows > roomsSlice[j].Rows
 			})
 
-			biggestRooms := roomsSlice[0:10]
+			protection, err := getRoomProtection(app.DB, config)
+			if err != nil {
+				(*session.Flash)["error"] = "an error occurred reading roomProtection json"
+			}
+
+			biggestRooms := roomsSlice
+			if len(biggestRooms) > 10 {
+				biggestRooms = roomsSlice[0:10]
+			}
+			roomIdsToCheck := append([]string{}, protection.DenylistRoomIds...)
+			for _, room := range biggestRooms {
+				roomIdsToCheck = append(roomIdsToCheck, room.Id)
+			}
+			err = protection.loadAliases(roomIdsToCheck, false)
+			if err != nil {
+				log.Printf("can't load the aliases of the biggest rooms: %s\n", err)
+			}
+
 			bigRoomsRowCount := 0
 			for i, room := range biggestRooms {
 				// TODO cache this ??
 				name := app.getMatrixRoomNameWithCache(room.Id)
+				protected, _ := protection.isRoomProtected(room.Id)
 				biggestRooms[i] = MatrixRoom{
 					Id:         room.Id,
 					Name:       name,
 					IdWithName: fmt.Sprintf("%s: %s", room.Id, name),
 					Rows:       room.Rows,
 					Percent:    int((float64(room.Rows) / float64(totalRowCount)) * float64(100)),
+					Estimated:  scanState.EstimatedRoomIds[room.Id],
+					Protected:  protected,
+					Denylisted: !protected && protection.isRoomDenylisted(room.Id),
 				}
 				bigRoomsRowCount += room.Rows
 			}
@@ -190,13 +339,56 @@ func initFrontend(config *Config, db *DBModel) FrontendApp {
 			bigRoomsBytes, _ := json.Marshal(biggestRooms)
 			//log.Println(string(bigRoomsBytes))
 
+			// denylisted rooms are always offered for deletion, even when they are not among the biggest
+			for _, roomId := range protection.DenylistRoomIds {
+				alreadyListed := false
+				for _, room := range biggestRooms {
+					alreadyListed = alreadyListed || room.Id == roomId
+				}
+				if protected, _ := protection.isRoomProtected(roomId); alreadyListed || protected {
+					continue
+				}
+				name := app.getMatrixRoomNameWithCache(roomId)
+				biggestRooms = append(biggestRooms, MatrixRoom{
+					Id:         roomId,
+					Name:       name,
+					IdWithName: fmt.Sprintf("%s: %s", roomId, name),
+					Rows:       rowCountByRoomObject[roomId],
+					Percent:    int((float64(rowCountByRoomObject[roomId]) / float64(totalRowCount)) * float64(100)),
+					Estimated:  scanState.EstimatedRoomIds[roomId],
+					Denylisted: true,
+				})
+			}
+
+			lastFullScan := ""
+			if scanState.LastFullScanUnixMilli != 0 {
+				lastFullScan = time.UnixMilli(scanState.LastFullScanUnixMilli).UTC().Format("2006-01-02 15:04 MST")
+			}
+
+			lastDeleteJob, err := ReadJsonFile[DeleteProgress]("data/lastDeleteJob.json")
+			if err != nil {
+				(*session.Flash)["error"] = "an error occurred reading lastDeleteJob json"
+			}
+			rejoinedRooms := []MatrixRoom{}
+			for _, room := range lastDeleteJob.Rooms {
+				if len(room.RejoinResults) > 0 {
+					rejoinedRooms = append(rejoinedRooms, room)
+				}
+			}
+
 			panelTemplateData := struct {
 				DiskUsage     template.JS
 				DBTableSizes  template.JS
 				BigRooms      template.JS
 				BigRoomsSlice []MatrixRoom
 				Updating      bool
-			}{template.JS(diskUsage), template.JS(dbTableSizes), template.JS(bigRoomsBytes), biggestRooms, isRunningScheduledTask}
+				LastFullScan  string
+				RejoinedRooms []MatrixRoom
+				LargestTables []DBTableSize
+			}{
+				template.JS(diskUsage), template.JS(dbTableSizes), template.JS(bigRoomsBytes), biggestRooms,
+				isRunningScheduledTask, lastFullScan, rejoinedRooms, largestTables,
+			}
 
 			app.buildPageFromTemplate(responseWriter, request, session, "panel.html", panelTemplateData)
 		} else {
@@ -205,11 +397,19 @@ func initFrontend(config *Config, db *DBModel) FrontendApp {
 				password := request.PostFormValue("password")
 
 				success, err := matrixAdmin.Login(username, password)
-				if err != nil {
+				if matrixAdminError, ok := asMatrixAdminError(err); ok && matrixAdminError.RateLimited() {
+					appendAuditLog(username, AuditActionLoginFailed, "", fmt.Sprintf("from %s: rate limited by synapse", request.RemoteAddr))
+					tryAgain := "later"
+					if matrixAdminError.RetryAfter > 0 {
+						tryAgain = fmt.Sprintf("in %s", matrixAdminError.RetryAfter.Round(time.Second)+time.Second)
+					}
+					(*session.Flash)["error"] += fmt.Sprintf("synapse is rate limiting logins, try again %s", tryAgain)
+				} else if err != nil {
 					(*session.Flash)["error"] += "an error was thrown by the login process 😧"
 					log.Println(errors.Wrap(err, "an error was thrown by the login process"))
 				} else {
 					if success {
+						appendAuditLog(username, AuditActionLogin, "", fmt.Sprintf("from %s", request.RemoteAddr))
 						session.UserID = username
 						session.ExpiresUnixMilli = time.Now().Add(time.Hour * 24).UnixMilli()
 						err = app.setSession(responseWriter, &session)
@@ -220,6 +420,7 @@ func initFrontend(config *Config, db *DBModel) FrontendApp {
 						return
 
 					} else {
+						appendAuditLog(username, AuditActionLoginFailed, "", fmt.Sprintf("from %s", request.RemoteAddr))
 						(*session.Flash)["error"] += "username or password was incorrect"
 					}
 				}
@@ -235,12 +436,27 @@ func initFrontend(config *Config, db *DBModel) FrontendApp {
 
 	app.handleWithSession("/logout", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
 		if session.UserID != "" && session.SessionId != "" {
-			os.Remove(fmt.Sprintf("data/sessions/%s.json", session.SessionId))
+			appendAuditLog(session.UserID, AuditActionLogout, "", "")
+			RemoveJsonFile(fmt.Sprintf("data/sessions/%s.json", session.SessionId))
 		}
 		app.deleteCookie(responseWriter, "sessionId")
 		http.Redirect(responseWriter, request, "/", http.StatusFound)
 	})
 
+	registerMetricsRoutes(&app, config)
+	registerHistoryRoutes(&app)
+	registerCleanupPolicyRoutes(&app, config)
+	registerRoomProtectionRoutes(&app, config)
+	registerMediaRoutes(&app, config)
+	registerApiRoutes(&app, config)
+	registerOrphanRoutes(&app, config)
+	registerMaintenanceRoutes(&app, config)
+	registerRoomInspectionRoutes(&app, config)
+	registerRoomListRoutes(&app, config)
+	registerDeleteJobRoutes(&app, config)
+	registerDeleteJobHistoryRoutes(&app, config)
+	registerAuditLogRoutes(&app)
+
 	// registerHowtoRoutes(&app)
 
 	// registerLoginRoutes(&app, emailService)
@@ -436,7 +652,10 @@ func (app *FrontendApp) reloadTemplates() {
 		if err != nil {
 			panic(err)
 		}
-		newTemplate, err := template.New(filename).Parse(string(newTemplateString))
+		newTemplate, err := template.New(filename).Funcs(template.FuncMap{
+			"formatBytes":     formatBytes,
+			"formatUnixMilli": formatUnixMilli,
+		}).Parse(string(newTemplateString))
 		if err != nil {
 			panic(err)
 		}
@@ -471,3 +690,24 @@ func (app *FrontendApp) getMatrixRoomNameWithCache(id string) string {
 	}
 	return name
 }
+
+func formatBytes(bytez int64) string {
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(bytez)
+	unit := 0
+	for value >= 1000 && unit < len(units)-1 {
+		value = value / 1000
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", bytez, units[unit])
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func formatUnixMilli(unixMilli int64) string {
+	if unixMilli == 0 {
+		return "never"
+	}
+	return time.UnixMilli(unixMilli).UTC().Format("2006-01-02 15:04 MST")
+}
@@ -2,11 +2,15 @@ module git.cyberia.club/cyberia/matrix-synapse-diskspace-janitor
 
 go 1.19
 
+require (
+	github.com/lib/pq v1.10.7
+	github.com/shengdoushi/base58 v1.0.0
+	go.etcd.io/bbolt v1.3.7
+	golang.org/x/sys v0.4.0
+)
+
 require (
 	git.sequentialread.com/forest/config-lite v0.0.0-20220225195944-164dc71bce04 // indirect
 	git.sequentialread.com/forest/pkg-errors v0.9.2 // indirect
-	github.com/lib/pq v1.10.7 // indirect
-	github.com/shengdoushi/base58 v1.0.0 // indirect
 	github.com/texttheater/golang-levenshtein/levenshtein v0.0.0-20200805054039-cae8b0eaed6c // indirect
-	golang.org/x/sys v0.4.0 // indirect
 )
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type HistorySnapshot struct {
+	UnixMilli  int64
+	DiskUsage  DiskUsage
+	TableBytes map[string]int64
+	RoomRows   map[string]int
+}
+
+type RoomGrowth struct {
+	Id         string
+	IdWithName string
+	Rows       int
+	RowsAdded  int
+	RowsPerDay int
+}
+
+type HistoryChartSeries struct {
+	Label string
+	Data  []int64
+}
+
+type HistoryCharts struct {
+	Labels    []string
+	DiskUsage []HistoryChartSeries
+	Tables    []HistoryChartSeries
+	Rooms     []HistoryChartSeries
+}
+
+// rooms with fewer state_groups_state rows than this are not saved in the history, same as the panel
+const historyMinimumRoomRows = 10000
+
+const historyGrowthWindow = time.Hour * 24 * 7
+
+// saveHistorySnapshot appends the data that the scheduled task just gathered to data/history.jsonl
+// and then applies the retention policy from the config.
+func saveHistorySnapshot(config *Config, diskUsage DiskUsage, tables []DBTableSize) error {
+	rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		return err
+	}
+
+	snapshot := HistorySnapshot{
+		UnixMilli:  time.Now().UnixMilli(),
+		DiskUsage:  diskUsage,
+		TableBytes: map[string]int64{},
+		RoomRows:   map[string]int{},
+	}
+	for _, table := range tables {
+		snapshot.TableBytes[table.Name] = table.Bytes
+	}
+	for roomId, rows := range rowCountByRoom {
+		if rows > historyMinimumRoomRows {
+			snapshot.RoomRows[roomId] = rows
+		}
+	}
+
+	err = AppendJsonLine("data/history.jsonl", snapshot)
+	if err != nil {
+		return err
+	}
+
+	return compactHistory(config)
+}
+
+// compactHistory keeps every snapshot from the last HistoryFullResolutionDays days,
+// one snapshot per week before that, and nothing older than HistoryRetentionDays days.
+func compactHistory(config *Config) error {
+	retentionDays := config.HistoryRetentionDays
+	if retentionDays <= 0 {
+		retentionDays = 365
+	}
+	fullResolutionDays := config.HistoryFullResolutionDays
+	if fullResolutionDays <= 0 {
+		fullResolutionDays = 30
+	}
+
+	snapshots, err := ReadJsonLines[HistorySnapshot]("data/history.jsonl")
+	if err != nil {
+		return err
+	}
+
+	retentionCutoff := time.Now().Add(-time.Hour * 24 * time.Duration(retentionDays)).UnixMilli()
+	fullResolutionCutoff := time.Now().Add(-time.Hour * 24 * time.Duration(fullResolutionDays)).UnixMilli()
+
+	// snapshots are appended in order, so the last one we see for a given week is the newest one in that week
+	lastSnapshotIndexByWeek := map[int]int{}
+	for i, snapshot := range snapshots {
+		if snapshot.UnixMilli >= retentionCutoff && snapshot.UnixMilli < fullResolutionCutoff {
+			year, week := time.UnixMilli(snapshot.UnixMilli).UTC().ISOWeek()
+			lastSnapshotIndexByWeek[year*100+week] = i
+		}
+	}
+
+	compacted := []HistorySnapshot{}
+	for i, snapshot := range snapshots {
+		if snapshot.UnixMilli < retentionCutoff {
+			continue
+		}
+		if snapshot.UnixMilli < fullResolutionCutoff {
+			year, week := time.UnixMilli(snapshot.UnixMilli).UTC().ISOWeek()
+			if lastSnapshotIndexByWeek[year*100+week] != i {
+				continue
+			}
+		}
+		compacted = append(compacted, snapshot)
+	}
+
+	if len(compacted) == len(snapshots) {
+		return nil
+	}
+
+	log.Printf("compactHistory(): %d snapshots -> %d snapshots\n", len(snapshots), len(compacted))
+	return WriteJsonLines("data/history.jsonl", compacted)
+}
+
+// getFastestGrowingRooms compares the latest snapshot with the oldest snapshot inside of the growth window.
+func getFastestGrowingRooms(snapshots []HistorySnapshot, limit int) []RoomGrowth {
+	if len(snapshots) < 2 {
+		return []RoomGrowth{}
+	}
+
+	latest := snapshots[len(snapshots)-1]
+	baseline := latest
+	for _, snapshot := range snapshots {
+		if snapshot.UnixMilli >= latest.UnixMilli-historyGrowthWindow.Milliseconds() {
+			baseline = snapshot
+			break
+		}
+	}
+	if baseline.UnixMilli == latest.UnixMilli {
+		baseline = snapshots[len(snapshots)-2]
+	}
+
+	days := float64(latest.UnixMilli-baseline.UnixMilli) / float64(time.Hour.Milliseconds()*24)
+	if days <= 0 {
+		return []RoomGrowth{}
+	}
+
+	growth := []RoomGrowth{}
+	for roomId, rows := range latest.RoomRows {
+		rowsAdded := rows - baseline.RoomRows[roomId]
+		if rowsAdded > 0 {
+			growth = append(growth, RoomGrowth{
+				Id:         roomId,
+				Rows:       rows,
+				RowsAdded:  rowsAdded,
+				RowsPerDay: int(float64(rowsAdded) / days),
+			})
+		}
+	}
+	sort.Slice(growth, func(i, j int) bool {
+		return growth[i].RowsPerDay > growth[j].RowsPerDay
+	})
+	if len(growth) > limit {
+		growth = growth[:limit]
+	}
+	return growth
+}
+
+func getHistoryCharts(snapshots []HistorySnapshot, growingRooms []RoomGrowth) HistoryCharts {
+	charts := HistoryCharts{
+		Labels:    []string{},
+		DiskUsage: []HistoryChartSeries{},
+		Tables:    []HistoryChartSeries{},
+		Rooms:     []HistoryChartSeries{},
+	}
+	if len(snapshots) == 0 {
+		return charts
+	}
+
+	postgres := HistoryChartSeries{Label: "Postgres DB", Data: []int64{}}
+	media := HistoryChartSeries{Label: "Matrix Media", Data: []int64{}}
+	other := HistoryChartSeries{Label: "Other", Data: []int64{}}
+	free := HistoryChartSeries{Label: "Free Space", Data: []int64{}}
+	for _, snapshot := range snapshots {
+		charts.Labels = append(charts.Labels, time.UnixMilli(snapshot.UnixMilli).UTC().Format("2006-01-02 15:04"))
+		diskUsage := snapshot.DiskUsage
+		postgres.Data = append(postgres.Data, diskUsage.PostgresBytes)
+		media.Data = append(media.Data, diskUsage.MediaBytes)
+		other.Data = append(other.Data, diskUsage.OtherBytes)
+		free.Data = append(free.Data, diskUsage.DiskSizeBytes-(diskUsage.PostgresBytes+diskUsage.MediaBytes+diskUsage.OtherBytes))
+	}
+	charts.DiskUsage = []HistoryChartSeries{postgres, media, other, free}
+
+	// only chart the biggest tables as of the latest snapshot, same as the panel
+	latest := snapshots[len(snapshots)-1]
+	tableNames := []string{}
+	for name := range latest.TableBytes {
+		tableNames = append(tableNames, name)
+	}
+	sort.Slice(tableNames, func(i, j int) bool {
+		return latest.TableBytes[tableNames[i]] > latest.TableBytes[tableNames[j]]
+	})
+	if len(tableNames) > 6 {
+		tableNames = tableNames[:6]
+	}
+	for _, name := range tableNames {
+		series := HistoryChartSeries{Label: name, Data: []int64{}}
+		for _, snapshot := range snapshots {
+			series.Data = append(series.Data, snapshot.TableBytes[name])
+		}
+		charts.Tables = append(charts.Tables, series)
+	}
+
+	for _, room := range growingRooms {
+		series := HistoryChartSeries{Label: room.IdWithName, Data: []int64{}}
+		for _, snapshot := range snapshots {
+			series.Data = append(series.Data, int64(snapshot.RoomRows[room.Id]))
+		}
+		charts.Rooms = append(charts.Rooms, series)
+	}
+
+	return charts
+}
+
+func registerHistoryRoutes(app *FrontendApp) {
+	app.handleWithSession("/history", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		snapshots, err := ReadJsonLines[HistorySnapshot]("data/history.jsonl")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading history jsonl"
+		}
+
+		growingRooms := getFastestGrowingRooms(snapshots, 10)
+		for i, room := range growingRooms {
+			growingRooms[i].IdWithName = fmt.Sprintf("%s: %s", room.Id, app.getMatrixRoomNameWithCache(room.Id))
+		}
+
+		chartsBytes, _ := json.Marshal(getHistoryCharts(snapshots, growingRooms))
+
+		historyTemplateData := struct {
+			Charts       template.JS
+			GrowingRooms []RoomGrowth
+			Snapshots    int
+		}{template.JS(chartsBytes), growingRooms, len(snapshots)}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "history.html", historyTemplateData)
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompactHistory(t *testing.T) {
+	now := time.Now().UTC()
+	day := time.Hour * 24
+	// the monday of an ISO week that is well outside of the 30 days of full resolution
+	oldWeek := now.Add(-day * 60).Truncate(day)
+	for oldWeek.Weekday() != time.Monday {
+		oldWeek = oldWeek.Add(-day)
+	}
+
+	testCases := []struct {
+		name      string
+		config    Config
+		snapshots []time.Time
+		kept      []time.Time
+	}{
+		{
+			name:      "recent snapshots are all kept",
+			snapshots: []time.Time{now.Add(-day * 3), now.Add(-day * 2), now.Add(-day)},
+			kept:      []time.Time{now.Add(-day * 3), now.Add(-day * 2), now.Add(-day)},
+		},
+		{
+			name: "older snapshots are kept once per week, the newest one in the week",
+			snapshots: []time.Time{
+				oldWeek.Add(time.Hour), oldWeek.Add(day * 2), oldWeek.Add(day * 6),
+				oldWeek.Add(day * 7), oldWeek.Add(day * 8), now.Add(-day),
+			},
+			kept: []time.Time{oldWeek.Add(day * 6), oldWeek.Add(day * 8), now.Add(-day)},
+		},
+		{
+			name:      "snapshots past the retention are removed",
+			config:    Config{HistoryRetentionDays: 10, HistoryFullResolutionDays: 5},
+			snapshots: []time.Time{now.Add(-day * 20), now.Add(-day * 11), now.Add(-day * 2)},
+			kept:      []time.Time{now.Add(-day * 2)},
+		},
+		{
+			name:      "HistoryFullResolutionDays is configurable",
+			config:    Config{HistoryFullResolutionDays: 90},
+			snapshots: []time.Time{oldWeek.Add(time.Hour), oldWeek.Add(day * 2), now.Add(-day)},
+			kept:      []time.Time{oldWeek.Add(time.Hour), oldWeek.Add(day * 2), now.Add(-day)},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			newTestJanitor(t, nil)
+
+			snapshots := []HistorySnapshot{}
+			for _, snapshotTime := range testCase.snapshots {
+				snapshots = append(snapshots, HistorySnapshot{UnixMilli: snapshotTime.UnixMilli()})
+			}
+			err := WriteJsonLines("data/history.jsonl", snapshots)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = compactHistory(&testCase.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			compacted, err := ReadJsonLines[HistorySnapshot]("data/history.jsonl")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(compacted) != len(testCase.kept) {
+				t.Fatalf("expected %d snapshots to be kept, got %d", len(testCase.kept), len(compacted))
+			}
+			for i, snapshot := range compacted {
+				if snapshot.UnixMilli != testCase.kept[i].UnixMilli() {
+					t.Errorf("snapshot %d is from %s, expected the one from %s", i, time.UnixMilli(snapshot.UnixMilli).UTC(), testCase.kept[i])
+				}
+			}
+		})
+	}
+}
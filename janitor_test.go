@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAdminRoomId = "!admin:example.com"
+const testApiToken = "test-api-token"
+
+// TestMain runs the tests in a temporary working directory, because everything the janitor keeps lives in ./data.
+// The frontend folder is linked in so the panel can find its templates.
+func TestMain(m *testing.M) {
+	repositoryDirectory, err := os.Getwd()
+	if err != nil {
+		panic(err)
+	}
+	workingDirectory, err := os.MkdirTemp("", "janitor-test")
+	if err != nil {
+		panic(err)
+	}
+	err = os.Symlink(filepath.Join(repositoryDirectory, "frontend"), filepath.Join(workingDirectory, "frontend"))
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chdir(workingDirectory)
+	if err != nil {
+		panic(err)
+	}
+	storage = NewFileStorage()
+	deleteStatusPollInterval = 10 * time.Millisecond
+
+	exitCode := m.Run()
+
+	os.Chdir(repositoryDirectory)
+	os.RemoveAll(workingDirectory)
+	os.Exit(exitCode)
+}
+
+// testJanitor is a janitor with an empty data folder that talks to a fake synapse.
+// DB is nil unless newTestJanitor was given a database.
+type testJanitor struct {
+	Config  *Config
+	Synapse *fakeSynapse
+	DB      *DBModel
+}
+
+func newTestJanitor(t *testing.T, db *DBModel) *testJanitor {
+	err := os.RemoveAll("data")
+	if err != nil {
+		t.Fatalf("can't clear the data folder: %s", err)
+	}
+	os.MkdirAll("data/sessions", 0755)
+
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom(testAdminRoomId, "janitor admins", "#admins:example.com", "@janitor:example.com", "@alice:example.com")
+	if db != nil {
+		synapse.onPurge = func(roomId string) {
+			purgeRoomLikeSynapse(t, db, roomId)
+		}
+	}
+
+	config := &Config{
+		FrontendDomain:           "localhost",
+		MatrixURL:                synapse.Server.URL,
+		MatrixServerPublicDomain: synapse.ServerName,
+		AdminMatrixRoomId:        testAdminRoomId,
+		MatrixAdminToken:         synapse.AdminToken,
+		DatabaseType:             "postgres",
+		MediaFolder:              t.TempDir(),
+		PostgresFolder:           t.TempDir(),
+		ApiTokens:                []ApiToken{{Name: "tests", Token: testApiToken}},
+	}
+
+	matrixAdmin = synapse.newMatrixAdmin(testAdminRoomId)
+	janitorBot = nil
+	runningJobs.deletes = false
+	runningJobs.maintenance = false
+	auditLogKey = nil
+	runningFromCommandLine = false
+	isRunningScheduledTask = false
+	roomAliasCache.rooms = map[string]cachedRoomAliases{}
+	t.Cleanup(func() {
+		matrixAdmin = nil
+	})
+
+	return &testJanitor{Config: config, Synapse: synapse, DB: db}
+}
+
+// addRoom adds a room to the fake synapse, and to the database with the given number of state groups if there is one
+func (janitor *testJanitor) addRoom(t *testing.T, roomId, name string, stateGroups, rowsPerStateGroup int, members ...string) []int64 {
+	room := janitor.Synapse.AddRoom(roomId, name, "", members...)
+	if janitor.DB == nil {
+		return nil
+	}
+	return seedRoom(t, janitor.DB, room, stateGroups, rowsPerStateGroup)
+}
+
+// waitForDeleteJob waits until the delete job has one of the statuses, for jobs that doRoomDeletes runs in the background
+func waitForDeleteJob(t *testing.T, id string, statuses ...string) DeleteProgress {
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		job, found, err := findDeleteJob(id)
+		if err != nil {
+			t.Fatalf("findDeleteJob(%s): %s", id, err)
+		}
+		if found && !isDoingDeletes() {
+			for _, status := range statuses {
+				if job.Status == status {
+					return job
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("delete job %s is %s, not %s after 30 seconds", id, job.Status, strings.Join(statuses, " or "))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testPanel serves the panel and the API of a testJanitor
+type testPanel struct {
+	Server *httptest.Server
+	Client *http.Client
+	// Cookie is the session cookie after logIn
+	Cookie string
+}
+
+func newTestPanel(t *testing.T, janitor *testJanitor) *testPanel {
+	app := initFrontend(janitor.Config, janitor.DB)
+	server := httptest.NewServer(app.Router)
+	t.Cleanup(server.Close)
+	return &testPanel{
+		Server: server,
+		Client: &http.Client{
+			CheckRedirect: func(request *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// logIn logs into the panel through the login form. The session cookie is kept by hand instead of in a cookie jar,
+// because the panel marks it as secure and the test server is plain http.
+func (panel *testPanel) logIn(t *testing.T, username, password string) *http.Response {
+	response := panel.postForm(t, "/", url.Values{"username": []string{username}, "password": []string{password}})
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == "sessionId" {
+			panel.Cookie = fmt.Sprintf("sessionId=%s", cookie.Value)
+		}
+	}
+	return response
+}
+
+func (panel *testPanel) get(t *testing.T, path string) (*http.Response, string) {
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s", panel.Server.URL, path), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return panel.do(t, request)
+}
+
+func (panel *testPanel) postForm(t *testing.T, path string, form url.Values) *http.Response {
+	request, err := http.NewRequest("POST", fmt.Sprintf("%s%s", panel.Server.URL, path), strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, _ := panel.do(t, request)
+	return response
+}
+
+// api sends a request to the /api/v1/ routes with the test api token. body is sent as it is when it is not empty.
+func (panel *testPanel) api(t *testing.T, method, path, body string) (*http.Response, string) {
+	request, err := http.NewRequest(method, fmt.Sprintf("%s%s", panel.Server.URL, path), strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", testApiToken))
+	request.Header.Set("Content-Type", "application/json")
+	return panel.do(t, request)
+}
+
+func (panel *testPanel) do(t *testing.T, request *http.Request) (*http.Response, string) {
+	if panel.Cookie != "" && request.Header.Get("Authorization") == "" {
+		request.Header.Set("Cookie", panel.Cookie)
+	}
+	response, err := panel.Client.Do(request)
+	if err != nil {
+		t.Fatalf("%s %s: %s", request.Method, request.URL.Path, err)
+	}
+	defer response.Body.Close()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("%s %s: read error: %s", request.Method, request.URL.Path, err)
+	}
+	return response, string(responseBody)
+}
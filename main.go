@@ -24,12 +24,76 @@ type Config struct {
 	DatabaseConnectionString string
 	MediaFolder              string
 	PostgresFolder           string
+
+	DeleteWorkers                 int
+	DeleteMaxBatchSize            int
+	DeleteBatchTargetMilliseconds int
+
+	AuditLogKey string
+
+	MetricsToken                string
+	MetricsAllowUnauthenticated bool
+	MetricsTopRooms             int
+
+	ApiTokens []ApiToken
+
+	BotEnabled bool
+
+	HistoryRetentionDays      int
+	HistoryFullResolutionDays int
+
+	CleanupPolicies []CleanupPolicy
+
+	ProtectedRoomIds           []string
+	ProtectedRoomAliasPatterns []string
+	DenylistRoomIds            []string
+
+	StorageType string
+	StoragePath string
+
+	MediaRemoteCacheMaxAgeDays int
+	MediaLocalMaxAgeDays       int
+	MediaLocalMinSizeBytes     int64
+	MediaMaxFilesPerRun        int
+	MediaMaxBytesPerRun        int64
+
+	MaintenanceMode            string
+	MaintenanceWindowStartHour int
+	MaintenanceWindowEndHour   int
+	MaintenanceHeadroomPercent int
+	PgRepackCommand            string
+	PgRepackArgs               []string
+
+	DeleteMessageTemplates []DeleteMessageTemplate
+	DeleteNewRoomUserId    string
+	DeleteNewRoomName      string
 }
 
 type JanitorState struct {
-	LastScheduledTaskRunUnixMilli int64
+	LastScheduledTaskRunUnixMilli            int64
+	LastScheduledTaskDurationMilli           int64
+	LastStateGroupsStateScanSuccessUnixMilli int64
+	LastStateGroupsStateScanDurationMilli    int64
+}
+
+type StateGroupsStateScanState struct {
+	MaxStateGroup                int64
+	LastFullScanUnixMilli        int64
+	LastIncrementalScanUnixMilli int64
+	EstimatedRoomIds             map[string]bool
 }
 
+// the phases of a room delete job, in the order they happen.
+// DeleteProgress.Phase records which one the job is currently in so it can be resumed after a restart.
+const (
+	DeletePhaseShutdown           = "shutdown"
+	DeletePhaseWaitForShutdown    = "waitForShutdown"
+	DeletePhaseCollectStateGroups = "collectStateGroups"
+	DeletePhaseStateGroupsState   = "deleteStateGroupsState"
+	DeletePhaseStateGroups        = "deleteStateGroups"
+	DeletePhaseRejoin             = "rejoinKickedUsers"
+)
+
 type DiskUsage struct {
 	DiskSizeBytes int64
 	OtherBytes    int64
@@ -38,12 +102,33 @@ type DiskUsage struct {
 }
 
 var isRunningScheduledTask bool
-var isDoingDeletes bool
-var mutex sync.Mutex
+
+// runningFromCommandLine is set for the commands in cli.go. The process exits as soon as the command returns,
+// so nothing may be started in the background, it would be killed halfway through.
+var runningFromCommandLine bool
+
+// runningJobs is locked while these flags are checked and changed. Only one delete job runs at a time, and a delete job
+// never runs at the same time as the maintenance phase, which rewrites or vacuums the tables the job deletes from.
+// A stopped job also can't be changed at the same time as doRoomDeletes starts working on it.
+var runningJobs = struct {
+	sync.Mutex
+	deletes     bool
+	maintenance bool
+}{}
+
+// how often doRoomDeletes asks synapse whether the rooms are done deleting
+var deleteStatusPollInterval = time.Second * 5
 var matrixAdmin *MatrixAdmin
 
 func main() {
-	mutex = sync.Mutex{}
+	// the command and its flags are taken out of os.Args so they don't get mixed up with the configuration flags
+	command := ""
+	commandArgs := []string{}
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		commandArgs = os.Args[2:]
+		os.Args = os.Args[:1]
+	}
 
 	config := Config{}
 	ignoreCommandlineFlags := []string{}
@@ -53,6 +138,16 @@ func main() {
 	}
 
 	validateConfig(&config)
+	auditLogKey = []byte(config.AuditLogKey)
+
+	if command != "" {
+		runningFromCommandLine = true
+		os.MkdirAll("data", 0755)
+		storage = initStorage(&config)
+		exitCode := runCommand(&config, command, commandArgs)
+		storage.Close()
+		os.Exit(exitCode)
+	}
 
 	currentDirectory, err := os.Getwd()
 	if err != nil {
@@ -66,10 +161,17 @@ func main() {
 	os.MkdirAll("data", 0755)
 	os.MkdirAll("data/sessions", 0755)
 
+	storage = initStorage(&config)
+
 	db := initDatabase(&config)
 	matrixAdmin = initMatrixAdmin(&config)
 	frontend := initFrontend(&config, db)
 
+	if config.BotEnabled {
+		janitorBot = initBot(&config, db)
+		go janitorBot.Run()
+	}
+
 	log.Printf("🧹 matrix-synapse-diskspace-janitor is about to try to start listening on :%d\n", config.FrontendPort)
 	go frontend.ListenAndServe()
 
@@ -77,8 +179,16 @@ func main() {
 	deleteRooms, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
 	if err != nil {
 		log.Printf("ERROR!: can't read data/deleteRooms.json: %+v\n", err)
-	} else if deleteRooms.Rooms != nil && len(deleteRooms.Rooms) != 0 {
-		go doRoomDeletes(db)
+	} else if deleteRooms.Rooms != nil && len(deleteRooms.Rooms) != 0 && !deleteRooms.Paused {
+		go doRoomDeletes(db, &config)
+	}
+
+	// resume a previously stopped media cleanup
+	mediaCleanup, err := ReadJsonFile[MediaCleanupProgress]("data/mediaCleanup.json")
+	if err != nil {
+		log.Printf("ERROR!: can't read data/mediaCleanup.json: %+v\n", err)
+	} else if mediaCleanup.Phase != "" {
+		go doMediaCleanup()
 	}
 
 	for {
@@ -88,11 +198,19 @@ func main() {
 		} else {
 			sinceLastScheduledTaskDuration := time.Since(time.UnixMilli(janitorState.LastScheduledTaskRunUnixMilli))
 			if !isRunningScheduledTask && sinceLastScheduledTaskDuration > time.Hour*24 {
-				go runScheduledTask(db, &config, true, true)
-
+				// the scheduled task only counts new state_groups_state rows,
+				// the whole table gets recounted once a week to correct for rows that synapse removed on its own
+				scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+				if err != nil {
+					log.Printf("ERROR!: can't read data/stateGroupsStateScan.json: %+v\n", err)
+				}
+				fullScan := time.Since(time.UnixMilli(scanState.LastFullScanUnixMilli)) > time.Hour*24*7
+				go runScheduledTask(db, &config, true, fullScan)
 			}
 		}
 
+		runMaintenanceIfDue(db, &config)
+
 		time.Sleep(time.Second * 10)
 	}
 }
@@ -101,6 +219,7 @@ func runScheduledTask(db *DBModel, config *Config, measureMediaSize bool, stateG
 
 	isRunningScheduledTask = true
 	log.Println("starting runScheduledTask...")
+	scheduledTaskStartTime := time.Now()
 
 	originalDiskUsage, err := ReadJsonFile[DiskUsage]("data/diskUsage.json")
 	if err != nil {
@@ -154,36 +273,27 @@ func runScheduledTask(db *DBModel, config *Config, measureMediaSize bool, stateG
 		log.Printf("ERROR!: runScheduledTask can't write data/diskUsage.json: %s\n", err)
 	}
 
-	if stateGroupsStateScan {
-		log.Println("starting db.StateGroupsStateStream()...")
-		stream, err := db.StateGroupsStateStream()
-		if err != nil {
-			log.Fatalf("Can't start because %+v\n", err)
-		}
+	log.Println("scanStateGroupsState...")
+	scanStartTime := time.Now()
+	err = scanStateGroupsState(db, stateGroupsStateScan)
+	scanDuration := time.Since(scanStartTime)
+	scanSucceeded := err == nil
+	if err != nil {
+		log.Printf("ERROR!: runScheduledTask can't scanStateGroupsState: %s\n", err)
+	}
 
-		lastUpdateTime := time.Now()
-		updateCounter := 0
-		rowCounter := 0
-		rowCountByRoom := map[string]int{}
-
-		for row := range stream.Channel {
-			rowCountByRoom[row.RoomID] = rowCountByRoom[row.RoomID] + 1
-			updateCounter += 1
-			rowCounter += 1
-			if updateCounter > 10000 {
-				if time.Now().After(lastUpdateTime.Add(time.Second * 60)) {
-					lastUpdateTime = time.Now()
-					percent := int((float64(rowCounter) / float64(stream.EstimatedCount)) * float64(100))
-					log.Printf("state_groups_state table scan %d/%d (%d%s) ... \n", rowCounter, stream.EstimatedCount, percent, "%")
-				}
-				updateCounter = 0
-			}
-		}
+	log.Println("saveHistorySnapshot...")
+	err = saveHistorySnapshot(config, diskUsage, tables)
+	if err != nil {
+		log.Printf("ERROR!: runScheduledTask can't saveHistorySnapshot: %s\n", err)
+	}
 
-		err = WriteJsonFile("data/stateGroupsStateRowCountByRoom.json", rowCountByRoom)
-		if err != nil {
-			log.Printf("ERROR!: runScheduledTask can't write data/stateGroupsStateRowCountByRoom.json: %s\n", err)
-		}
+	// the policies can start delete jobs in the background, so the command line scan leaves them to the running janitor
+	if runningFromCommandLine {
+		log.Println("skipping runCleanupPolicies, the cleanup policies only run in the janitor itself")
+	} else {
+		log.Println("runCleanupPolicies...")
+		runCleanupPolicies(db, config)
 	}
 
 	log.Println("updating data/janitorState.json...")
@@ -194,24 +304,198 @@ func runScheduledTask(db *DBModel, config *Config, measureMediaSize bool, stateG
 	}
 
 	janitorState.LastScheduledTaskRunUnixMilli = time.Now().UnixMilli()
+	janitorState.LastScheduledTaskDurationMilli = time.Since(scheduledTaskStartTime).Milliseconds()
+	janitorState.LastStateGroupsStateScanDurationMilli = scanDuration.Milliseconds()
+	if scanSucceeded {
+		janitorState.LastStateGroupsStateScanSuccessUnixMilli = time.Now().UnixMilli()
+	}
 
 	err = WriteJsonFile("data/janitorState.json", janitorState)
 	if err != nil {
 		log.Printf("ERROR!: runScheduledTask can't write data/janitorState.json: %s\n", err)
 	}
 
+	botNotify("%s", scheduledTaskSummary(diskUsage, tables, time.Since(scheduledTaskStartTime)))
+
 	log.Println("runScheduledTask completed!")
 	isRunningScheduledTask = false
 }
 
-func doRoomDeletes(db *DBModel) {
-	if isDoingDeletes {
-		log.Println("doRoomDeletes(): isDoingDeletes already!")
+// scanStateGroupsState updates data/stateGroupsStateRowCountByRoom.json.
+// A full scan recounts every room and the resulting counts are exact.
+// Otherwise, only the state groups that were created since the last scan are counted and added to the stored counts.
+// Rooms which received new rows this way are marked as estimated until the next full scan,
+// because synapse may have removed some of their older rows in the meantime.
+func scanStateGroupsState(db *DBModel, fullScan bool) error {
+	scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+	if err != nil {
+		return err
+	}
+	if scanState.LastFullScanUnixMilli == 0 {
+		fullScan = true
+	}
+
+	if fullScan {
+		log.Println("counting all state_groups_state rows by room, this can take a while...")
+		rowCountByRoom, maxStateGroup, err := db.GetStateGroupsStateRowCountByRoom(-1)
+		if err != nil {
+			return err
+		}
+
+		err = WriteJsonFile("data/stateGroupsStateRowCountByRoom.json", rowCountByRoom)
+		if err != nil {
+			return err
+		}
+
+		scanState = StateGroupsStateScanState{
+			MaxStateGroup:         maxStateGroup,
+			LastFullScanUnixMilli: time.Now().UnixMilli(),
+			EstimatedRoomIds:      map[string]bool{},
+		}
+		return WriteJsonFile("data/stateGroupsStateScan.json", scanState)
+	}
+
+	log.Printf("counting state_groups_state rows by room for state groups above %d...\n", scanState.MaxStateGroup)
+	newRowCountByRoom, maxStateGroup, err := db.GetStateGroupsStateRowCountByRoom(scanState.MaxStateGroup)
+	if err != nil {
+		return err
+	}
+
+	rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		return err
+	}
+	if rowCountByRoom == nil {
+		rowCountByRoom = map[string]int{}
+	}
+	if scanState.EstimatedRoomIds == nil {
+		scanState.EstimatedRoomIds = map[string]bool{}
+	}
+	for roomId, rows := range newRowCountByRoom {
+		rowCountByRoom[roomId] = rowCountByRoom[roomId] + rows
+		scanState.EstimatedRoomIds[roomId] = true
+	}
+
+	err = WriteJsonFile("data/stateGroupsStateRowCountByRoom.json", rowCountByRoom)
+	if err != nil {
+		return err
+	}
+
+	scanState.MaxStateGroup = maxStateGroup
+	scanState.LastIncrementalScanUnixMilli = time.Now().UnixMilli()
+	return WriteJsonFile("data/stateGroupsStateScan.json", scanState)
+}
+
+// getRemoteServersForRoom lists the servers that a room can be joined through: the server that created the room,
+// then every other server that has members in it.
+func getRemoteServersForRoom(roomId string) ([]string, error) {
+	members, err := matrixAdmin.GetRoomMembers(roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	servers := []string{}
+	seen := map[string]bool{matrixAdmin.MatrixServerPublicDomain: true}
+	userIdsAndRoomId := append([]string{roomId}, members...)
+	for _, id := range userIdsAndRoomId {
+		colonIndex := strings.Index(id, ":")
+		if colonIndex == -1 {
+			continue
+		}
+		server := id[colonIndex+1:]
+		if !seen[server] {
+			seen[server] = true
+			servers = append(servers, server)
+		}
+	}
+	return servers, nil
+}
+
+// forgetRoomsInRowCounts removes rooms which were just deleted from the stored state_groups_state counts,
+// otherwise they would keep showing up until the next full scan.
+func forgetRoomsInRowCounts(rooms []MatrixRoom) error {
+	rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		return err
+	}
+	scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+	if err != nil {
+		return err
+	}
+	for _, room := range rooms {
+		delete(rowCountByRoom, room.Id)
+		delete(scanState.EstimatedRoomIds, room.Id)
+	}
+	err = WriteJsonFile("data/stateGroupsStateRowCountByRoom.json", rowCountByRoom)
+	if err != nil {
+		return err
+	}
+	return WriteJsonFile("data/stateGroupsStateScan.json", scanState)
+}
+
+// startRoomDeletes saves a new delete job and starts working on it in the background.
+// if another delete job exists, the new one waits in data/deleteJobQueue.json and is started when the others are done.
+func startRoomDeletes(db *DBModel, config *Config, rooms []MatrixRoom, submittedBy string, reason DeleteJobReason) (DeleteProgress, error) {
+	deleteProgress, startNow, err := queueRoomDeletes(config, rooms, submittedBy, reason)
+	if err != nil {
+		return deleteProgress, err
+	}
+
+	if startNow {
+		go doRoomDeletes(db, config)
+	}
+
+	return deleteProgress, nil
+}
+
+// queueRoomDeletes saves a new delete job without starting it.
+// The returned bool is true when the job is the current one instead of waiting behind another job.
+func queueRoomDeletes(config *Config, rooms []MatrixRoom, submittedBy string, reason DeleteJobReason) (DeleteProgress, bool, error) {
+	reason, err := validateDeleteJobReason(config, reason)
+	if err != nil {
+		return DeleteProgress{}, false, err
+	}
+	return enqueueDeleteJob(DeleteProgress{
+		Rooms:           rooms,
+		SubmittedBy:     submittedBy,
+		DeleteJobReason: reason,
+	})
+}
+
+func isDoingDeletes() bool {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	return runningJobs.deletes
+}
+
+func doRoomDeletes(db *DBModel, config *Config) {
+	runningJobs.Lock()
+	if runningJobs.deletes {
+		runningJobs.Unlock()
+		log.Println("doRoomDeletes(): a delete job is running already!")
+		return
+	}
+	if runningJobs.maintenance {
+		runningJobs.Unlock()
+		log.Println("doRoomDeletes(): the maintenance phase is running, the delete job will start when it is finished")
 		return
 	}
-	isDoingDeletes = true
+	runningJobs.deletes = true
+	runningJobs.Unlock()
+
+	stop := startDeleteJobStop()
+	// set when this job is finished and there is another one waiting in the queue
+	startNext := false
 	defer func() {
-		isDoingDeletes = false
+		finishDeleteJobStop()
+		runningJobs.Lock()
+		runningJobs.deletes = false
+		runningJobs.Unlock()
+		if startNext && runningFromCommandLine {
+			log.Println("doRoomDeletes(): the next delete job in the queue will be started by the janitor")
+		} else if startNext {
+			go doRoomDeletes(db, config)
+		}
 	}()
 
 	deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
@@ -225,118 +509,492 @@ func doRoomDeletes(db *DBModel) {
 		return
 	}
 
-	log.Printf("doRoomDeletes(): starting to delete %d rooms\n", len(deleteProgress.Rooms))
+	if deleteProgress.Paused {
+		log.Printf("doRoomDeletes(): delete job %s was paused by %s, not resuming it\n", deleteProgress.Id, deleteProgress.PausedBy)
+		return
+	}
+
+	if deleteProgress.Phase == "" {
+		deleteProgress.Phase = DeletePhaseShutdown
+	}
+	deleteProgress.Error = ""
+	deleteProgress.Status = DeleteJobStatusRunning
+	if deleteProgress.StartedUnixMilli == 0 {
+		deleteProgress.StartedUnixMilli = time.Now().UnixMilli()
+	}
+	if deleteProgress.PhaseDurationsMilli == nil {
+		deleteProgress.PhaseDurationsMilli = map[string]int64{}
+	}
+	// time spent paused, stopped or restarting is not counted towards the phase
+	deleteProgress.PhaseStartedUnixMilli = time.Now().UnixMilli()
+
+	countPhaseTime := func() {
+		now := time.Now().UnixMilli()
+		deleteProgress.PhaseDurationsMilli[deleteProgress.Phase] += now - deleteProgress.PhaseStartedUnixMilli
+		deleteProgress.PhaseStartedUnixMilli = now
+	}
+	setPhase := func(phase string) {
+		countPhaseTime()
+		deleteProgress.Phase = phase
+	}
 
-	for _, room := range deleteProgress.Rooms {
-		err := matrixAdmin.DeleteRoom(room.Id, room.Ban)
+	// every phase transition (and every bit of progress inside a phase) is saved to deleteRooms.json
+	// so that if the janitor is restarted, it can pick up where it left off instead of starting over.
+	saveProgress := func() bool {
+		err := WriteJsonFile("data/deleteRooms.json", deleteProgress)
 		if err != nil {
-			log.Printf("doRoomDeletes(): Can't do room deletes because deleting %s returned %s\n", room.Id, err)
-			return
+			log.Printf("doRoomDeletes(): Can't do room deletes because can't write deleteRooms.json: %s\n", err)
+			return false
 		}
+		return true
+	}
+
+	// the error is saved with the job so the deleting page can show why it stopped
+	fail := func(format string, args ...interface{}) {
+		countPhaseTime()
+		deleteProgress.Status = DeleteJobStatusFailed
+		deleteProgress.Error = fmt.Sprintf(format, args...)
+		log.Printf("doRoomDeletes(): %s\n", deleteProgress.Error)
+		saveProgress()
 	}
 
-	log.Printf("doRoomDeletes(): waiting for %d rooms to be done deleting...\n", len(deleteProgress.Rooms))
+	log.Printf("doRoomDeletes(): starting to delete %d rooms at phase '%s'\n", len(deleteProgress.Rooms), deleteProgress.Phase)
+	botNotify("%s", deleteProgressSummary(deleteProgress))
 
-	isDoneWaitingForRoomDeletesToFinish := false
-	for !isDoneWaitingForRoomDeletesToFinish {
+	completed := false
+	stopped := false
+	defer func() {
+		if !completed && !stopped {
+			botNotify("delete job %s stopped in phase %s: %s", deleteProgress.Id, deleteProgress.Phase, deleteProgress.Error)
+		}
+	}()
 
-		allRoomsDeletionComplete := true
+	// stopRequested is checked wherever the job can stop without losing track of what it has done
+	stopRequested := func() bool {
+		select {
+		case <-stop:
+		default:
+			return false
+		}
+		stopped = true
+		countPhaseTime()
+		action, userId := getDeleteJobStopRequest()
+		if action == DeleteJobStopCancel {
+			startNext, err = cancelDeleteJob(deleteProgress, userId)
+			if err != nil {
+				log.Printf("doRoomDeletes(): can't cancel delete job %s: %s\n", deleteProgress.Id, err)
+			}
+			return true
+		}
+		deleteProgress.Status = DeleteJobStatusPaused
+		deleteProgress.Paused = true
+		deleteProgress.PausedBy = userId
+		if saveProgress() {
+			log.Printf("doRoomDeletes(): %s paused delete job %s in phase %s\n", userId, deleteProgress.Id, deleteProgress.Phase)
+			botNotify("%s paused delete job %s in phase %s", userId, deleteProgress.Id, deleteProgress.Phase)
+		}
+		return true
+	}
+
+	if deleteProgress.Phase == DeletePhaseShutdown {
+		// rooms may have been protected after the job was submitted, so check again right before deleting anything
+		allowedRooms, refused, err := removeProtectedRooms(db, config, deleteProgress.Rooms)
+		if err != nil {
+			fail("Can't do room deletes because can't check protected rooms: %s", err)
+			return
+		}
+		for _, message := range refused {
+			log.Printf("doRoomDeletes(): %s\n", message)
+		}
+		if len(allowedRooms) == 0 {
+			log.Println("doRoomDeletes(): all the rooms in this job are protected, removing it")
+			stopped = true
+			deleteProgress.Error = "all the rooms in this job are protected"
+			startNext, err = finishDeleteJob(deleteProgress, DeleteJobStatusCancelled)
+			if err != nil {
+				log.Printf("doRoomDeletes(): failed to finish delete job %s: %s\n", deleteProgress.Id, err)
+			}
+			return
+		}
+		deleteProgress.Rooms = allowedRooms
+
+		// a room that synapse refuses to delete doesn't hold up the others, it is retried or dropped from the job afterwards
+		failedRooms := 0
 		for i, room := range deleteProgress.Rooms {
-			// TODO do something with the users that this returns? i.e. re-add them to the room later?
-			status, _, err := matrixAdmin.GetDeleteRoomStatus(room.Id)
+			if stopRequested() {
+				return
+			}
+			if room.DeleteRequested {
+				continue
+			}
+			deleteProgress.Rooms[i].Error = ""
+			if room.Rejoin && !room.Ban {
+				// once the room is purged, synapse won't know which servers it can join it through anymore
+				servers, err := getRemoteServersForRoom(room.Id)
+				if err != nil {
+					log.Printf("doRoomDeletes(): getting servers for %s returned %s\n", room.Id, err)
+					deleteProgress.Rooms[i].Error = fmt.Sprintf("can't get the servers to rejoin through: %s", err)
+					deleteProgress.Rooms[i].Status = "failed"
+					failedRooms++
+					if !saveProgress() {
+						return
+					}
+					continue
+				}
+				deleteProgress.Rooms[i].RejoinServers = servers
+			}
+			shutdown, err := getRoomShutdown(config, deleteProgress.DeleteJobReason, room)
+			if err == nil {
+				deleteProgress.Rooms[i].DeleteId, err = matrixAdmin.DeleteRoom(room.Id, room.Ban, shutdown)
+			}
 			if err != nil {
-				log.Printf("doRoomDeletes(): Can't do room deletes because GetDeleteRoomStatus('%s') returned %s\n", room.Id, err)
+				log.Printf("doRoomDeletes(): deleting %s returned %s\n", room.Id, err)
+				deleteProgress.Rooms[i].Error = err.Error()
+				deleteProgress.Rooms[i].Status = "failed"
+				failedRooms++
+			} else {
+				deleteProgress.Rooms[i].DeleteRequested = true
+			}
+			if !saveProgress() {
 				return
 			}
-			deleteProgress.Rooms[i] = MatrixRoom{
-				Id:         room.Id,
-				IdWithName: room.IdWithName,
-				Ban:        room.Ban,
-				Status:     status,
+		}
+		if failedRooms > 0 {
+			fail("synapse couldn't delete %d of the rooms, retry them or drop them from the job", failedRooms)
+			return
+		}
+
+		setPhase(DeletePhaseWaitForShutdown)
+		if !saveProgress() {
+			return
+		}
+	}
+
+	if deleteProgress.Phase == DeletePhaseWaitForShutdown {
+		log.Printf("doRoomDeletes(): waiting for %d rooms to be done deleting...\n", len(deleteProgress.Rooms))
+
+		isDoneWaitingForRoomDeletesToFinish := false
+		for !isDoneWaitingForRoomDeletesToFinish {
+
+			if stopRequested() {
+				return
 			}
 
-			if status != "complete" {
-				allRoomsDeletionComplete = false
+			allRoomsDeletionComplete := true
+			failedRooms := 0
+			for i, room := range deleteProgress.Rooms {
+				if room.Error != "" {
+					failedRooms++
+					continue
+				}
+				status, users, err := matrixAdmin.GetDeleteRoomStatus(room.Id, room.DeleteId)
+				if isTemporaryMatrixAdminError(err) {
+					// synapse is still down after all the retries, the deletion itself may well be fine, so keep waiting
+					log.Printf("doRoomDeletes(): GetDeleteRoomStatus('%s') returned %s, will check again\n", room.Id, err)
+					allRoomsDeletionComplete = false
+					continue
+				}
+				if err != nil {
+					// retrying the room asks synapse to delete it again
+					log.Printf("doRoomDeletes(): GetDeleteRoomStatus('%s') returned %s\n", room.Id, err)
+					deleteProgress.Rooms[i].Error = err.Error()
+					deleteProgress.Rooms[i].Status = "failed"
+					deleteProgress.Rooms[i].DeleteRequested = false
+					failedRooms++
+					continue
+				}
+				deleteProgress.Rooms[i].Status = status
+				for _, userId := range users {
+					isLocal := strings.HasSuffix(userId, fmt.Sprintf(":%s", config.MatrixServerPublicDomain))
+					alreadySaved := false
+					for _, kickedUserId := range room.KickedUsers {
+						alreadySaved = alreadySaved || kickedUserId == userId
+					}
+					if isLocal && !alreadySaved {
+						deleteProgress.Rooms[i].KickedUsers = append(deleteProgress.Rooms[i].KickedUsers, userId)
+					}
+				}
+
+				if status != "complete" {
+					allRoomsDeletionComplete = false
+				}
+			}
+
+			if allRoomsDeletionComplete && failedRooms > 0 {
+				// the failed rooms have to be deleted again before the job can move on
+				setPhase(DeletePhaseShutdown)
+				fail("synapse couldn't delete %d of the rooms, retry them or drop them from the job", failedRooms)
+				return
+			}
+
+			if allRoomsDeletionComplete {
+				isDoneWaitingForRoomDeletesToFinish = true
+				setPhase(DeletePhaseCollectStateGroups)
+				botNotify("delete job %s: synapse is done deleting the rooms, now deleting their state groups", deleteProgress.Id)
+			}
+
+			if !saveProgress() {
+				return
+			}
+
+			if !isDoneWaitingForRoomDeletesToFinish {
+				select {
+				case <-stop:
+				case <-time.After(deleteStatusPollInterval):
+				}
 			}
 		}
+	}
+
+	var allStateGroupsToDelete []int64
+
+	if stopRequested() {
+		return
+	}
 
-		err = WriteJsonFile("data/deleteRooms.json", deleteProgress)
+	if deleteProgress.Phase == DeletePhaseCollectStateGroups {
+		// synapse may know about a room again by now, for example when someone joined it over federation, and then
+		// its state groups are in use. This matters most for orphan purges, which are queued from a scan that may be old.
+		roomIds := []string{}
+		for _, room := range deleteProgress.Rooms {
+			roomIds = append(roomIds, room.Id)
+		}
+		existing, err := db.GetExistingRoomIds(roomIds)
 		if err != nil {
-			log.Println("doRoomDeletes(): Can't do room deletes because can't write deleteRooms.json")
+			fail("Can't do room deletes because can't check whether the rooms exist again: %s", err)
+			return
+		}
+		if len(existing) == len(deleteProgress.Rooms) {
+			fail("all of the rooms exist again, their state groups are in use. cancel the job")
 			return
 		}
+		remainingRooms := []MatrixRoom{}
+		for _, room := range deleteProgress.Rooms {
+			if existing[room.Id] {
+				log.Printf("doRoomDeletes(): %s exists again, taking it out of delete job %s\n", room.Id, deleteProgress.Id)
+				botNotify("delete job %s: %s exists again, its state groups are in use and will not be deleted", deleteProgress.Id, room.Id)
+				deleteProgress.SkippedRoomIds = append(deleteProgress.SkippedRoomIds, room.Id)
+				continue
+			}
+			remainingRooms = append(remainingRooms, room)
+		}
+		deleteProgress.Rooms = remainingRooms
 
-		if allRoomsDeletionComplete {
-			isDoneWaitingForRoomDeletesToFinish = true
-		} else {
-			time.Sleep(time.Second * 5)
+		log.Printf("doRoomDeletes(): getting state group ids for %d rooms...\n", len(deleteProgress.Rooms))
+
+		deleteProgress.BytesPerRow, err = getStateGroupTablesBytesPerRow(db)
+		if err != nil {
+			log.Printf("doRoomDeletes(): can't get bytes per row, the space reclaimed won't be estimated: %s\n", err)
+		}
+
+		allStateGroupsToDelete = []int64{}
+		for _, room := range deleteProgress.Rooms {
+			log.Printf("db.GetStateGroupsForRoom(%s)\n", room.Id)
+			stateGroups, err := db.GetStateGroupsForRoom(room.Id)
+			if err != nil {
+				fail("Can't do room deletes because getting state group ids for %s returned %s", room.Id, err)
+				return
+			}
+			allStateGroupsToDelete = append(allStateGroupsToDelete, stateGroups...)
 		}
-	}
 
-	log.Printf("doRoomDeletes(): getting state group ids for %d rooms...\n", len(deleteProgress.Rooms))
+		sort.Slice(allStateGroupsToDelete, func(i, j int) bool {
+			return allStateGroupsToDelete[i] < allStateGroupsToDelete[j]
+		})
 
-	allStateGroupsToDelete := []int64{}
-	for _, room := range deleteProgress.Rooms {
-		log.Printf("db.GetStateGroupsForRoom(%s)\n", room.Id)
-		stateGroups, err := db.GetStateGroupsForRoom(room.Id)
+		err = WriteStateGroupIdsFile("data/stateGroupsToDelete.txt", allStateGroupsToDelete)
 		if err != nil {
-			log.Printf("doRoomDeletes(): Can't do room deletes because getting state group ids for %s returned %s\n", room.Id, err)
+			fail("Can't do room deletes because can't write stateGroupsToDelete.txt: %s", err)
+			return
+		}
+
+		setPhase(DeletePhaseStateGroupsState)
+		deleteProgress.StateGroupsStateIndex = 0
+		deleteProgress.StateGroupsStateProgress = 0
+		deleteProgress.StateGroupsStateStatus = DeleteStateGroupsStateStatus{}
+		if !saveProgress() {
 			return
 		}
-		allStateGroupsToDelete = append(allStateGroupsToDelete, stateGroups...)
 	}
 
-	sort.Slice(allStateGroupsToDelete, func(i, j int) bool {
-		return allStateGroupsToDelete[i] < allStateGroupsToDelete[j]
-	})
+	if deleteProgress.Phase == DeletePhaseStateGroupsState {
+		if allStateGroupsToDelete == nil {
+			allStateGroupsToDelete, err = ReadStateGroupIdsFile("data/stateGroupsToDelete.txt")
+			if err != nil {
+				fail("Can't resume room deletes because can't read stateGroupsToDelete.txt: %s", err)
+				return
+			}
+		}
 
-	allStateGroupsToDeleteFile, err := os.OpenFile("data/stateGroupsToDelete.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
-	for _, stateGroupId := range allStateGroupsToDelete {
-		fmt.Fprintf(allStateGroupsToDeleteFile, "%d\n", stateGroupId)
-	}
-	allStateGroupsToDeleteFile.Close()
+		log.Printf(
+			"doRoomDeletes(): deleting %d state groups from state_groups_state, starting at %d...\n",
+			len(allStateGroupsToDelete), deleteProgress.StateGroupsStateIndex,
+		)
 
-	log.Printf("doRoomDeletes(): deleting %d state groups from  state_groups_state...\n", len(allStateGroupsToDelete))
+		deleteProgress.StateGroupsToDelete = len(allStateGroupsToDelete)
 
-	statusChannel := db.DeleteStateGroupsState(allStateGroupsToDelete, 0)
-	lastUpdateTime := time.Now()
-	for status := range statusChannel {
-		if time.Since(lastUpdateTime) > time.Second*5 {
-			lastUpdateTime = time.Now()
-			deleteProgress.StateGroupsStateProgress = int((float64(status.StateGroupsDeleted) / float64(len(allStateGroupsToDelete))) * float64(100))
+		// the rows and errors counted by a previous run of this job (before a restart) are added on top
+		previousRowsDeleted := deleteProgress.StateGroupsStateStatus.RowsDeleted
+		previousErrors := deleteProgress.StateGroupsStateStatus.Errors
 
-			log.Printf(
-				"doRoomDeletes(): %d/%d (%d rows) (%d errors) (%d%s)\n",
-				status.StateGroupsDeleted, len(allStateGroupsToDelete), status.RowsDeleted,
-				status.Errors, deleteProgress.StateGroupsStateProgress, "%",
+		// the workers stop when the job is paused or cancelled, or when its progress can't be saved anymore
+		workersStop := make(chan struct{})
+		var closeWorkersStop sync.Once
+		stopWorkers := func() { closeWorkersStop.Do(func() { close(workersStop) }) }
+		defer stopWorkers()
+		go func() {
+			select {
+			case <-stop:
+				stopWorkers()
+			case <-workersStop:
+			}
+		}()
+
+		statusChannel := db.DeleteStateGroupsState(allStateGroupsToDelete, deleteProgress.StateGroupsStateIndex, workersStop)
+		lastUpdateTime := time.Now()
+		lastNotifiedProgress := deleteProgress.StateGroupsStateProgress
+		for status := range statusChannel {
+			status.RowsDeleted += previousRowsDeleted
+			status.Errors += previousErrors
+			deleteProgress.StateGroupsStateStatus = status
+			deleteProgress.StateGroupsStateIndex = int(status.StateGroupsDeleted)
+			if time.Since(lastUpdateTime) > time.Second*5 {
+				lastUpdateTime = time.Now()
+				deleteProgress.StateGroupsStateProgress = int((float64(status.StateGroupsDeleted) / float64(len(allStateGroupsToDelete))) * float64(100))
+
+				log.Printf(
+					"doRoomDeletes(): %d/%d (%d rows) (%d errors) (%d%s)\n",
+					status.StateGroupsDeleted, len(allStateGroupsToDelete), status.RowsDeleted,
+					status.Errors, deleteProgress.StateGroupsStateProgress, "%",
+				)
+
+				if !saveProgress() {
+					// the batches that are still running have to finish before the job lets go of the database
+					stopWorkers()
+					for range statusChannel {
+					}
+					return
+				}
+
+				if deleteProgress.StateGroupsStateProgress/25 > lastNotifiedProgress/25 {
+					lastNotifiedProgress = deleteProgress.StateGroupsStateProgress
+					botNotify("%s", deleteProgressSummary(deleteProgress))
+				}
+			}
+		}
+
+		// the state_groups rows can't be deleted before all of their state_groups_state rows are gone,
+		// otherwise the leftover rows would not belong to any state group and nothing could find them anymore
+		if deleteProgress.StateGroupsStateStatus.Error != "" {
+			deleteProgress.StateGroupsStateProgress = int((float64(deleteProgress.StateGroupsStateIndex) / float64(len(allStateGroupsToDelete))) * float64(100))
+			fail(
+				"deleting from state_groups_state failed at state group %d of %d, resume the job to try again: %s",
+				deleteProgress.StateGroupsStateIndex, len(allStateGroupsToDelete), deleteProgress.StateGroupsStateStatus.Error,
 			)
+			return
+		}
 
-			err = WriteJsonFile("data/deleteRooms.json", deleteProgress)
-			if err != nil {
-				log.Println("doRoomDeletes(): Can't do room deletes because can't write deleteRooms.json")
+		// after a pause or cancel, the low watermark of the batches that did finish is where the job picks up again
+		if deleteProgress.StateGroupsStateIndex < len(allStateGroupsToDelete) {
+			deleteProgress.StateGroupsStateProgress = int((float64(deleteProgress.StateGroupsStateIndex) / float64(len(allStateGroupsToDelete))) * float64(100))
+			if !saveProgress() || stopRequested() {
 				return
 			}
 		}
+
+		setPhase(DeletePhaseStateGroups)
+		deleteProgress.StateGroupsStateIndex = len(allStateGroupsToDelete)
+		deleteProgress.StateGroupsStateProgress = 100
+		if !saveProgress() {
+			return
+		}
 	}
 
-	log.Println("doRoomDeletes(): deleting from state_groups_state complete! now cleaning up state_groups...")
+	if stopRequested() {
+		return
+	}
+
+	if deleteProgress.Phase == DeletePhaseStateGroups {
+		log.Println("doRoomDeletes(): deleting from state_groups_state complete! now cleaning up state_groups...")
+
+		totalStateGroupRows := 0
+		for _, room := range deleteProgress.Rooms {
+			rowsDeleted, err := db.DeleteStateGroupsForRoom(room.Id)
+			if err != nil {
+				log.Printf("doRoomDeletes(): DeleteStateGroupsForRoom('%s') returned %s\n", room.Id, err)
+			}
+			totalStateGroupRows += int(rowsDeleted)
+		}
+
+		log.Printf("doRoomDeletes(): %d state_groups related rows deleted. \n", totalStateGroupRows)
+		deleteProgress.StateGroupRowsDeleted = int64(totalStateGroupRows)
 
-	totalStateGroupRows := 0
-	for _, room := range deleteProgress.Rooms {
-		rowsDeleted, err := db.DeleteStateGroupsForRoom(room.Id)
+		err = forgetRoomsInRowCounts(deleteProgress.Rooms)
 		if err != nil {
-			log.Printf("doRoomDeletes(): DeleteStateGroupsForRoom('%s') returned %s\n", room.Id, err)
+			log.Printf("doRoomDeletes(): forgetRoomsInRowCounts returned %s\n", err)
+		}
+
+		setPhase(DeletePhaseRejoin)
+		if !saveProgress() {
+			return
+		}
+	}
+
+	if deleteProgress.Phase == DeletePhaseRejoin {
+		for i, room := range deleteProgress.Rooms {
+			if !room.Rejoin || room.Ban || len(room.KickedUsers) == 0 {
+				continue
+			}
+			log.Printf("doRoomDeletes(): re-joining %d users to %s via %v...\n", len(room.KickedUsers), room.Id, room.RejoinServers)
+
+			if room.RejoinResults == nil {
+				deleteProgress.Rooms[i].RejoinResults = map[string]string{}
+			}
+			for _, userId := range room.KickedUsers {
+				if stopRequested() {
+					return
+				}
+				if deleteProgress.Rooms[i].RejoinResults[userId] == "joined" {
+					continue
+				}
+				result := "joined"
+				err := matrixAdmin.JoinRoom(room.Id, userId, room.RejoinServers)
+				if err != nil {
+					log.Printf("doRoomDeletes(): JoinRoom('%s', '%s') returned %s\n", room.Id, userId, err)
+					result = err.Error()
+				}
+				deleteProgress.Rooms[i].RejoinResults[userId] = result
+				if !saveProgress() {
+					return
+				}
+			}
 		}
-		totalStateGroupRows += int(rowsDeleted)
 	}
 
-	log.Printf("doRoomDeletes(): %d state_groups related rows deleted. \n", totalStateGroupRows)
+	countPhaseTime()
+	deleteProgress.EstimatedBytesReclaimed = int64(
+		float64(deleteProgress.StateGroupsStateStatus.RowsDeleted)*deleteProgress.BytesPerRow["state_groups_state"] +
+			float64(deleteProgress.StateGroupRowsDeleted)*deleteProgress.BytesPerRow["state_groups"],
+	)
 
-	err = os.Remove("data/deleteRooms.json")
+	startNext, err = finishDeleteJob(deleteProgress, DeleteJobStatusComplete)
 	if err != nil {
-		log.Printf("doRoomDeletes(): failed to remove deleteRooms.json: %s\n", err)
+		log.Printf("doRoomDeletes(): failed to finish delete job %s: %s\n", deleteProgress.Id, err)
 	}
 
+	completed = true
+	botNotify(
+		"delete job %s is complete: %d rooms, %d state_groups_state rows deleted, about %s reclaimed",
+		deleteProgress.Id, len(deleteProgress.Rooms), deleteProgress.StateGroupsStateStatus.RowsDeleted,
+		formatBytes(deleteProgress.EstimatedBytesReclaimed),
+	)
+
+	// postgres keeps the space from the deleted rows for itself until the tables are vacuumed
+	queueMaintenance(config, PendingMaintenance{
+		DeleteJobId: deleteProgress.Id,
+		RowsDeleted: deleteProgress.StateGroupsStateStatus.RowsDeleted,
+	})
+
 	log.Println("doRoomDeletes(): completed successfully!!")
 }
 
@@ -375,6 +1033,38 @@ func validateConfig(config *Config) {
 		errors = append(errors, "Can't start because PostgresFolder is required")
 	}
 
+	if config.AuditLogKey != "" && len(config.AuditLogKey) < 16 {
+		errors = append(errors, "Can't start because AuditLogKey has to be at least 16 characters long")
+	}
+
+	for _, apiToken := range config.ApiTokens {
+		if apiToken.Name == "" || len(apiToken.Token) < 16 {
+			errors = append(errors, "Can't start because every one of the ApiTokens needs a Name and a Token at least 16 characters long")
+		}
+	}
+
+	switch config.MaintenanceMode {
+	case "", MaintenanceModeVacuum, MaintenanceModeVacuumFull, MaintenanceModePgRepack:
+	default:
+		errors = append(errors, fmt.Sprintf(
+			"Can't start because MaintenanceMode '%s' is not one of '%s', '%s' or '%s'",
+			config.MaintenanceMode, MaintenanceModeVacuum, MaintenanceModeVacuumFull, MaintenanceModePgRepack,
+		))
+	}
+
+	policyNames := map[string]bool{}
+	for _, policy := range config.CleanupPolicies {
+		if policy.Name == "" || policyNames[policy.Name] {
+			errors = append(errors, "Can't start because every one of the CleanupPolicies needs a unique Name")
+		}
+		policyNames[policy.Name] = true
+		if policy.MinStateGroupsStateRows <= 0 {
+			errors = append(errors, fmt.Sprintf("Can't start because CleanupPolicies '%s' MinStateGroupsStateRows is required", policy.Name))
+		}
+	}
+
+	errors = append(errors, validateDeleteMessageConfig(config)...)
+
 	if len(errors) > 0 {
 		log.Fatalln(strings.Join(errors, "\n"))
 	}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+const (
+	MaintenanceModeVacuum     = "vacuum"
+	MaintenanceModeVacuumFull = "vacuumFull"
+	MaintenanceModePgRepack   = "pgRepack"
+)
+
+// the tables that doRoomDeletes deletes rows from
+var maintenanceTables = []string{"state_groups_state", "state_groups", "state_group_edges", "event_to_state_groups"}
+
+type PendingMaintenance struct {
+	DeleteJobId     string
+	QueuedUnixMilli int64
+	QueuedByUserID  string
+	RowsDeleted     int64
+}
+
+type MaintenanceTableResult struct {
+	Name        string
+	Method      string
+	BytesBefore int64
+	BytesAfter  int64
+	// Fallback is why a plain VACUUM ran instead of the configured MaintenanceMode
+	Fallback string
+	Error    string
+}
+
+type MaintenanceResult struct {
+	DeleteJobId         string
+	Mode                string
+	StartedUnixMilli    int64
+	DurationMilli       int64
+	PostgresBytesBefore int64
+	PostgresBytesAfter  int64
+	Tables              []MaintenanceTableResult
+}
+
+// queueMaintenance asks for the maintenance phase to run during the next maintenance window.
+// It does nothing when MaintenanceMode is not configured.
+func queueMaintenance(config *Config, pending PendingMaintenance) {
+	if config.MaintenanceMode == "" {
+		return
+	}
+	pending.QueuedUnixMilli = time.Now().UnixMilli()
+	err := WriteJsonFile("data/maintenance.json", pending)
+	if err != nil {
+		log.Printf("ERROR!: can't write data/maintenance.json: %s\n", err)
+	}
+}
+
+// isInMaintenanceWindow uses UTC hours. The window can wrap around midnight, for example from 22 to 4.
+// When the start and end hour are the same, any time is fine.
+func isInMaintenanceWindow(config *Config, now time.Time) bool {
+	start := config.MaintenanceWindowStartHour
+	end := config.MaintenanceWindowEndHour
+	if start == end {
+		return true
+	}
+	hour := now.UTC().Hour()
+	if start < end {
+		return hour >= start && hour < end
+	}
+	return hour >= start || hour < end
+}
+
+func isDoingMaintenance() bool {
+	runningJobs.Lock()
+	defer runningJobs.Unlock()
+	return runningJobs.maintenance
+}
+
+// runMaintenanceIfDue is called from the main loop. It starts the maintenance phase in the background when
+// some is queued, the maintenance window is open and no delete job is running.
+// Delete jobs that are submitted while it runs wait for it, see doRoomDeletes.
+func runMaintenanceIfDue(db *DBModel, config *Config) {
+	if config.MaintenanceMode == "" || !isInMaintenanceWindow(config, time.Now()) {
+		return
+	}
+	pending, err := ReadJsonFile[PendingMaintenance]("data/maintenance.json")
+	if err != nil {
+		log.Printf("ERROR!: can't read data/maintenance.json: %s\n", err)
+		return
+	}
+	if pending.QueuedUnixMilli == 0 {
+		return
+	}
+
+	runningJobs.Lock()
+	if runningJobs.deletes || runningJobs.maintenance {
+		runningJobs.Unlock()
+		return
+	}
+	runningJobs.maintenance = true
+	runningJobs.Unlock()
+
+	go func() {
+		defer func() {
+			runningJobs.Lock()
+			runningJobs.maintenance = false
+			runningJobs.Unlock()
+
+			// start the delete job that was submitted or resumed while the maintenance was running
+			deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+			if err != nil {
+				log.Printf("ERROR!: can't read data/deleteRooms.json: %s\n", err)
+			} else if len(deleteProgress.Rooms) != 0 && !deleteProgress.Paused {
+				go doRoomDeletes(db, config)
+			}
+		}()
+		doMaintenance(db, config, pending)
+	}()
+}
+
+func doMaintenance(db *DBModel, config *Config, pending PendingMaintenance) {
+	log.Printf("doMaintenance(): starting '%s' maintenance after delete job %s\n", config.MaintenanceMode, pending.DeleteJobId)
+	startTime := time.Now()
+
+	result := MaintenanceResult{
+		DeleteJobId:      pending.DeleteJobId,
+		Mode:             config.MaintenanceMode,
+		StartedUnixMilli: startTime.UnixMilli(),
+		Tables:           []MaintenanceTableResult{},
+	}
+
+	postgresBytes, err := GetTotalFilesizeWithinFolder(config.PostgresFolder)
+	if err != nil {
+		log.Printf("doMaintenance(): can't GetTotalFilesizeWithinFolder(\"%s\"): %s\n", config.PostgresFolder, err)
+	}
+	result.PostgresBytesBefore = postgresBytes
+
+	headroomPercent := config.MaintenanceHeadroomPercent
+	if headroomPercent <= 0 {
+		headroomPercent = 20
+	}
+
+	for _, table := range maintenanceTables {
+		tableResult := MaintenanceTableResult{Name: table, Method: config.MaintenanceMode}
+
+		tableResult.BytesBefore, err = db.GetTableTotalSize(table)
+		if err != nil {
+			tableResult.Error = err.Error()
+			result.Tables = append(result.Tables, tableResult)
+			continue
+		}
+
+		// VACUUM FULL and pg_repack write a complete new copy of the table before they drop the old one
+		if config.MaintenanceMode != MaintenanceModeVacuum {
+			availableBytes, _, err := GetAvaliableDiskSpace(config.PostgresFolder)
+			requiredBytes := int64(float64(tableResult.BytesBefore) * (1 + float64(headroomPercent)/100))
+			if err != nil || availableBytes < requiredBytes {
+				log.Printf(
+					"doMaintenance(): not enough free disk space to rewrite %s (%s free, %s needed), running a plain VACUUM instead\n",
+					table, formatBytes(availableBytes), formatBytes(requiredBytes),
+				)
+				tableResult.Method = MaintenanceModeVacuum
+				tableResult.Fallback = fmt.Sprintf(
+					"only %s free, %s needed to rewrite the table, ran a plain VACUUM instead", formatBytes(availableBytes), formatBytes(requiredBytes),
+				)
+			}
+		}
+
+		log.Printf("doMaintenance(): %s on %s (%s)...\n", tableResult.Method, table, formatBytes(tableResult.BytesBefore))
+		switch tableResult.Method {
+		case MaintenanceModeVacuum:
+			err = db.VacuumTable(table, false)
+		case MaintenanceModeVacuumFull:
+			err = db.VacuumTable(table, true)
+		case MaintenanceModePgRepack:
+			err = runPgRepack(config, table)
+		default:
+			err = fmt.Errorf("unknown MaintenanceMode '%s'", tableResult.Method)
+		}
+		if err != nil {
+			log.Printf("doMaintenance(): %s on %s failed: %s\n", tableResult.Method, table, err)
+			tableResult.Error = err.Error()
+		}
+
+		tableResult.BytesAfter, err = db.GetTableTotalSize(table)
+		if err != nil {
+			log.Printf("doMaintenance(): %s\n", err)
+		}
+		result.Tables = append(result.Tables, tableResult)
+	}
+
+	postgresBytes, err = GetTotalFilesizeWithinFolder(config.PostgresFolder)
+	if err != nil {
+		log.Printf("doMaintenance(): can't GetTotalFilesizeWithinFolder(\"%s\"): %s\n", config.PostgresFolder, err)
+	}
+	result.PostgresBytesAfter = postgresBytes
+	result.DurationMilli = time.Since(startTime).Milliseconds()
+
+	err = AppendJsonLine("data/maintenanceHistory.jsonl", result)
+	if err != nil {
+		log.Printf("ERROR!: doMaintenance can't append to data/maintenanceHistory.jsonl: %s\n", err)
+	}
+	err = RemoveJsonFile("data/maintenance.json")
+	if err != nil {
+		log.Printf("ERROR!: doMaintenance can't remove data/maintenance.json: %s\n", err)
+	}
+
+	log.Printf(
+		"doMaintenance(): done in %s, the postgres folder went from %s to %s\n",
+		time.Since(startTime).Round(time.Second), formatBytes(result.PostgresBytesBefore), formatBytes(result.PostgresBytesAfter),
+	)
+	botNotify(
+		"🧽 %s maintenance finished in %s: the postgres folder went from %s to %s",
+		result.Mode, time.Since(startTime).Round(time.Second), formatBytes(result.PostgresBytesBefore), formatBytes(result.PostgresBytesAfter),
+	)
+}
+
+// runPgRepack runs the external pg_repack command, which rewrites the table like VACUUM FULL does
+// but only holds an exclusive lock for a moment at the start and at the end.
+func runPgRepack(config *Config, table string) error {
+	command := config.PgRepackCommand
+	if command == "" {
+		command = "pg_repack"
+	}
+	args := append(append([]string{}, config.PgRepackArgs...), fmt.Sprintf("--table=public.%s", table))
+	output, err := exec.Command(command, args...).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "%s %s failed: %s", command, strings.Join(args, " "), string(output))
+	}
+	return nil
+}
+
+func registerMaintenanceRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/maintenance", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		if request.Method == "POST" {
+			if config.MaintenanceMode == "" {
+				app.setFlash(responseWriter, session, "error", "MaintenanceMode is not configured in config.json")
+			} else {
+				log.Printf("%s queued the maintenance phase\n", session.UserID)
+				appendAuditLog(session.UserID, AuditActionMaintenanceQueued, "", config.MaintenanceMode)
+				queueMaintenance(config, PendingMaintenance{QueuedByUserID: session.UserID})
+			}
+			http.Redirect(responseWriter, request, "/maintenance", http.StatusFound)
+			return
+		}
+
+		pending, err := ReadJsonFile[PendingMaintenance]("data/maintenance.json")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading maintenance json"
+		}
+		results, err := ReadJsonLines[MaintenanceResult]("data/maintenanceHistory.jsonl")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading maintenanceHistory jsonl"
+		}
+		// newest first
+		recentResults := []MaintenanceResult{}
+		for i := len(results) - 1; i >= 0 && len(recentResults) < 50; i-- {
+			recentResults = append(recentResults, results[i])
+		}
+
+		maintenanceTemplateData := struct {
+			Mode        string
+			WindowStart int
+			WindowEnd   int
+			Running     bool
+			Pending     PendingMaintenance
+			Results     []MaintenanceResult
+		}{
+			config.MaintenanceMode, config.MaintenanceWindowStartHour, config.MaintenanceWindowEndHour,
+			isDoingMaintenance(), pending, recentResults,
+		}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "maintenance.html", maintenanceTemplateData)
+	})
+}
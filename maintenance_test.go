@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIsInMaintenanceWindow(t *testing.T) {
+	testCases := []struct {
+		name   string
+		start  int
+		end    int
+		hour   int
+		inside bool
+	}{
+		{"no window", 0, 0, 13, true},
+		{"same start and end", 5, 5, 4, true},
+		{"start of the window", 2, 6, 2, true},
+		{"inside the window", 2, 6, 5, true},
+		{"end of the window", 2, 6, 6, false},
+		{"before the window", 2, 6, 1, false},
+		{"wraps around midnight, before midnight", 22, 4, 23, true},
+		{"wraps around midnight, at midnight", 22, 4, 0, true},
+		{"wraps around midnight, after midnight", 22, 4, 3, true},
+		{"wraps around midnight, end of the window", 22, 4, 4, false},
+		{"wraps around midnight, outside", 22, 4, 12, false},
+		{"wraps around midnight, just before the start", 22, 4, 21, false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			config := &Config{MaintenanceWindowStartHour: testCase.start, MaintenanceWindowEndHour: testCase.end}
+			now := time.Date(2024, 3, 10, testCase.hour, 30, 0, 0, time.UTC)
+			if isInMaintenanceWindow(config, now) != testCase.inside {
+				t.Errorf("isInMaintenanceWindow(%d-%d) at %02d:30 should be %t", testCase.start, testCase.end, testCase.hour, testCase.inside)
+			}
+		})
+	}
+
+	// the window is in UTC no matter which time zone the time is in
+	config := &Config{MaintenanceWindowStartHour: 2, MaintenanceWindowEndHour: 6}
+	now := time.Date(2024, 3, 10, 3, 0, 0, 0, time.UTC).In(time.FixedZone("UTC+10", 10*60*60))
+	if !isInMaintenanceWindow(config, now) {
+		t.Errorf("03:00 UTC in another time zone should be inside of the 2-6 window")
+	}
+}
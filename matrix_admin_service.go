@@ -2,10 +2,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,13 +23,20 @@ type MatrixAdmin struct {
 	MatrixServerPublicDomain string
 	URL                      string
 	Token                    string
+	// requests that fail because synapse is down, overloaded or rate limiting are retried up to MaxRetries times,
+	// waiting RetryBaseDelay before the first retry and twice as long before every next one, up to RetryMaxDelay
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
 }
 
 type DeleteRoomRequest struct {
-	Block      bool   `json:"block"`
-	ForcePurge bool   `json:"force_purge"`
-	Purge      bool   `json:"purge"`
-	Message    string `json:"message"`
+	Block         bool   `json:"block"`
+	ForcePurge    bool   `json:"force_purge"`
+	Purge         bool   `json:"purge"`
+	Message       string `json:"message"`
+	NewRoomUserId string `json:"new_room_user_id,omitempty"`
+	RoomName      string `json:"room_name,omitempty"`
 }
 
 type DeleteRoomResponse struct {
@@ -47,6 +59,61 @@ type ShutdownRoom struct {
 	NewRoomId         string   `json:"new_room_id"`
 }
 
+type JoinRoomRequest struct {
+	UserId string `json:"user_id"`
+}
+
+type PurgeMediaCacheResponse struct {
+	Deleted int64 `json:"deleted"`
+}
+
+type RoomMediaResponse struct {
+	Local  []string `json:"local"`
+	Remote []string `json:"remote"`
+}
+
+type UserMediaResponse struct {
+	Media []UserMedia `json:"media"`
+	Total int64       `json:"total"`
+}
+
+type UserMedia struct {
+	MediaId            string `json:"media_id"`
+	MediaLength        int64  `json:"media_length"`
+	MediaType          string `json:"media_type"`
+	UploadName         string `json:"upload_name"`
+	CreatedTs          int64  `json:"created_ts"`
+	LastAccessTs       int64  `json:"last_access_ts"`
+	QuarantinedBy      string `json:"quarantined_by"`
+	SafeFromQuarantine bool   `json:"safe_from_quarantine"`
+}
+
+type WhoAmIResponse struct {
+	UserId string `json:"user_id"`
+}
+
+type RoomMessageContent struct {
+	MsgType string `json:"msgtype"`
+	Body    string `json:"body"`
+}
+
+type RoomMessageEvent struct {
+	EventId string             `json:"event_id"`
+	Sender  string             `json:"sender"`
+	Content RoomMessageContent `json:"content"`
+}
+
+type SyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events []RoomMessageEvent `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
 type LoginRequestBody struct {
 	Identifier        LoginIdentifier `json:"identifier"`
 	DeviceDisplayName string          `json:"initial_device_display_name"`
@@ -67,206 +134,419 @@ type RoomMembersResponseBody struct {
 	Members []string `json:"members"`
 }
 
+// https://element-hq.github.io/synapse/latest/admin_api/rooms.html#room-details-api
 type RoomDetails struct {
-	Name           string `json:"name"`
-	CanonicalAlias string `json:"canonical_alias"`
+	RoomId             string `json:"room_id"`
+	Name               string `json:"name"`
+	Topic              string `json:"topic"`
+	CanonicalAlias     string `json:"canonical_alias"`
+	JoinedMembers      int    `json:"joined_members"`
+	JoinedLocalMembers int    `json:"joined_local_members"`
+	Version            string `json:"version"`
+	Creator            string `json:"creator"`
+	Encryption         string `json:"encryption"`
+	Federatable        bool   `json:"federatable"`
+	Public             bool   `json:"public"`
+	JoinRules          string `json:"join_rules"`
+	GuestAccess        string `json:"guest_access"`
+	HistoryVisibility  string `json:"history_visibility"`
+	StateEvents        int64  `json:"state_events"`
+	RoomType           string `json:"room_type"`
 }
 
-func initMatrixAdmin(config *Config) *MatrixAdmin {
-
-	return &MatrixAdmin{
-		Client: http.Client{
-			Timeout: 10 * time.Second,
-		},
-		AdminMatrixRoomId:        config.AdminMatrixRoomId,
-		MatrixServerPublicDomain: config.MatrixServerPublicDomain,
-		URL:                      config.MatrixURL,
-		Token:                    config.MatrixAdminToken,
-	}
-}
+// how long one attempt at each kind of request may take. Synapse answers most admin requests right away,
+// but joining a room over federation and purging the remote media cache can take a while.
+const (
+	matrixAdminDefaultTimeout    = 10 * time.Second
+	matrixAdminDeleteRoomTimeout = 30 * time.Second
+	matrixAdminJoinRoomTimeout   = 2 * time.Minute
+	matrixAdminPurgeMediaTimeout = 10 * time.Minute
+	// notices are only informational, so they are not allowed to hold anything up
+	matrixAdminSendNoticeTimeout = 5 * time.Second
+	// added on top of the long poll timeout of a /sync request
+	matrixAdminSyncTimeoutMargin = 10 * time.Second
+)
 
-// curl -H "Content-Type: application/json" -X DELETE "localhost:8008/_synapse/admin/v2/rooms/$roomid?access_token=xxxxxxxxx" \
-// 	--data '{ "block": false, "force_purge": true, "purge": true, "message": "This room is being cleaned, stand by..." }'
+// the values of RoomDeletionStatus.Status, from the least to the most complete
+const (
+	RoomDeletionStatusShuttingDown = "shutting_down"
+	RoomDeletionStatusPurging      = "purging"
+	RoomDeletionStatusFailed       = "failed"
+	RoomDeletionStatusComplete     = "complete"
+)
 
-func (admin *MatrixAdmin) DeleteRoom(roomId string, ban bool) error {
+// MatrixAdminError is returned by the MatrixAdmin methods when synapse answered with an error status,
+// or when it could not be reached at all, in which case StatusCode is 0 and Err is the network error.
+type MatrixAdminError struct {
+	Method string
+	// Path never contains the access token, it is sent in the Authorization header
+	Path       string
+	StatusCode int
+	// ErrCode and Message are the errcode and error fields of the synapse error response, like M_NOT_FOUND
+	ErrCode  string
+	Message  string
+	Attempts int
+	// RetryAfter is how long synapse asked us to wait before trying again, for 429 responses
+	RetryAfter time.Duration
+	Err        error
+}
 
-	deleteRequestBodyObject := DeleteRoomRequest{
-		Block:      ban,
-		ForcePurge: true,
-		Purge:      true,
-		Message:    "This room is being cleaned, stand by...",
+func (err *MatrixAdminError) Error() string {
+	attempts := ""
+	if err.Attempts > 1 {
+		attempts = fmt.Sprintf(" (gave up after %d attempts)", err.Attempts)
 	}
-	deleteRequestBody, err := json.Marshal(deleteRequestBodyObject)
-	if err != nil {
-		return errors.Wrapf(err, "matrixAdmin.DeleteRoom('%s') cannot serialize deleteRequestBodyObject as JSON", roomId)
+	if err.StatusCode == 0 {
+		return fmt.Sprintf("HTTP %s %s: %s%s", err.Method, err.Path, err.Err, attempts)
 	}
-	deleteURLWithoutToken := fmt.Sprintf("%s/_synapse/admin/v2/rooms/%s?access_token=", admin.URL, roomId)
-	deleteURL := fmt.Sprintf("%s%s", deleteURLWithoutToken, admin.Token)
-	deleteRequest, err := http.NewRequest("DELETE", deleteURL, bytes.NewBuffer(deleteRequestBody))
-
-	if err != nil {
-		return errors.Wrapf(err, "matrixAdmin.DeleteRoom('%s') cannot create deleteRequest", roomId)
+	if err.ErrCode != "" {
+		return fmt.Sprintf("HTTP %s %s: HTTP %d %s: %s%s", err.Method, err.Path, err.StatusCode, err.ErrCode, err.Message, attempts)
 	}
+	return fmt.Sprintf("HTTP %s %s: HTTP %d: %s%s", err.Method, err.Path, err.StatusCode, err.Message, attempts)
+}
 
-	deleteResponse, err := admin.Client.Do(deleteRequest)
+func (err *MatrixAdminError) Unwrap() error {
+	return err.Err
+}
 
-	if err != nil {
-		return errors.New(fmt.Sprintf(
-			"HTTP DELETE %sxxxxxxx: %s",
-			deleteURLWithoutToken, err.Error(),
-		))
-	}
+// Temporary is true for errors that are worth trying again later, like synapse restarting or rate limiting
+func (err *MatrixAdminError) Temporary() bool {
+	return err.StatusCode == 0 || err.StatusCode == http.StatusTooManyRequests || err.StatusCode >= 500
+}
 
-	if deleteResponse.StatusCode >= 300 {
-		responseBodyString := "read error"
-		responseBody, err := ioutil.ReadAll(deleteResponse.Body)
-		if err == nil {
-			responseBodyString = string(responseBody)
-		}
+func (err *MatrixAdminError) NotFound() bool {
+	return err.StatusCode == http.StatusNotFound
+}
+
+func (err *MatrixAdminError) RateLimited() bool {
+	return err.StatusCode == http.StatusTooManyRequests
+}
 
-		return errors.New(fmt.Sprintf(
-			"HTTP DELETE %sxxxxxxx: HTTP %d: %s",
-			deleteURLWithoutToken, deleteResponse.StatusCode, responseBodyString,
-		))
+// asMatrixAdminError finds a *MatrixAdminError in a chain of wrapped errors
+func asMatrixAdminError(err error) (*MatrixAdminError, bool) {
+	var matrixAdminError *MatrixAdminError
+	if stderrors.As(err, &matrixAdminError) {
+		return matrixAdminError, true
 	}
+	return nil, false
+}
 
-	return nil
+func isTemporaryMatrixAdminError(err error) bool {
+	matrixAdminError, ok := asMatrixAdminError(err)
+	return ok && matrixAdminError.Temporary()
 }
 
-func (admin *MatrixAdmin) GetDeleteRoomStatus(roomId string) (string, []string, error) {
+func isNotFoundMatrixAdminError(err error) bool {
+	matrixAdminError, ok := asMatrixAdminError(err)
+	return ok && matrixAdminError.NotFound()
+}
 
-	statusURLWithoutToken := fmt.Sprintf("%s/_synapse/admin/v2/rooms/%s/delete_status?access_token=", admin.URL, roomId)
-	statusURL := fmt.Sprintf("%s%s", statusURLWithoutToken, admin.Token)
+// matrixErrorResponse is the body of an error response from synapse
+type matrixErrorResponse struct {
+	ErrCode      string `json:"errcode"`
+	Error        string `json:"error"`
+	RetryAfterMs int64  `json:"retry_after_ms"`
+}
 
-	statusResponse, err := admin.Client.Get(statusURL)
+type matrixAdminRequest struct {
+	Method string
+	// Path has to be built with matrixPath so the room ids, user ids and media ids in it are escaped
+	Path  string
+	Query url.Values
+	// Body is serialized as json when it is not nil
+	Body    interface{}
+	Timeout time.Duration
+	// AccessToken is used instead of the MatrixAdminToken when it is set
+	AccessToken string
+	// Anonymous requests don't send an Authorization header at all
+	Anonymous bool
+	// Retry decides which temporary errors are retried, matrixAdminRetryTemporary when it is empty
+	Retry string
+}
 
-	if err != nil {
-		return "", nil, errors.New(fmt.Sprintf("HTTP GET %sxxxxxxx: %s", statusURLWithoutToken, err.Error()))
+const (
+	// matrixAdminRetryTemporary retries network errors, 429 and 5xx responses
+	matrixAdminRetryTemporary = ""
+	// matrixAdminRetryRateLimited only retries 429 responses, for requests that must not be sent twice:
+	// after a timeout or a 5xx response synapse may have done what was asked anyway
+	matrixAdminRetryRateLimited = "rateLimited"
+	// matrixAdminRetryNever is for requests that someone is waiting on, like logging in
+	matrixAdminRetryNever = "never"
+)
+
+// matrixPath fills in a path like /_synapse/admin/v1/rooms/%s and escapes every argument as a single path segment
+func matrixPath(format string, args ...string) string {
+	escapedArgs := make([]interface{}, len(args))
+	for i, arg := range args {
+		escapedArgs[i] = url.PathEscape(arg)
 	}
+	return fmt.Sprintf(format, escapedArgs...)
+}
 
-	if statusResponse.StatusCode >= 300 {
-		responseBodyString := "read error"
-		responseBody, err := ioutil.ReadAll(statusResponse.Body)
-		if err == nil {
-			responseBodyString = string(responseBody)
-		}
+func initMatrixAdmin(config *Config) *MatrixAdmin {
 
-		return "", nil, errors.New(fmt.Sprintf(
-			"HTTP GET %sxxxxxxx: HTTP %d: %s",
-			statusURLWithoutToken, statusResponse.StatusCode, responseBodyString,
-		))
+	return &MatrixAdmin{
+		// every request gets its own timeout, see matrixAdminRequest.Timeout
+		Client:                   http.Client{},
+		AdminMatrixRoomId:        config.AdminMatrixRoomId,
+		MatrixServerPublicDomain: config.MatrixServerPublicDomain,
+		URL:                      strings.TrimSuffix(config.MatrixURL, "/"),
+		Token:                    config.MatrixAdminToken,
+		MaxRetries:               6,
+		RetryBaseDelay:           time.Second,
+		RetryMaxDelay:            30 * time.Second,
 	}
+}
 
-	responseBody, err := ioutil.ReadAll(statusResponse.Body)
-	if err != nil {
-		return "", nil, errors.New(fmt.Sprintf("HTTP GET %sxxxxxxx: read error: %s", statusURLWithoutToken, err.Error()))
+// do sends a request to synapse and decodes the json response into responseObject, unless it is nil.
+// Network errors, 429 and 5xx responses are retried with exponential backoff, so a restart of synapse
+// doesn't fail whatever was waiting on it. Every other error status is returned right away as a *MatrixAdminError.
+func (admin *MatrixAdmin) do(request matrixAdminRequest, responseObject interface{}) error {
+	var requestBody []byte
+	if request.Body != nil {
+		var err error
+		requestBody, err = json.Marshal(request.Body)
+		if err != nil {
+			return errors.Wrapf(err, "HTTP %s %s: can't serialize the request body as json", request.Method, request.Path)
+		}
 	}
-	var responseObject RoomDeletionStatusResponse
-	err = json.Unmarshal(responseBody, &responseObject)
-	if err != nil {
-		return "", nil, errors.New(fmt.Sprintf("HTTP GET %sxxxxxxx: json parse error: %s", statusURLWithoutToken, err.Error()))
+	if request.Timeout == 0 {
+		request.Timeout = matrixAdminDefaultTimeout
 	}
 
-	users := map[string]bool{}
-	errorsSet := map[string]bool{}
-	mostCompleteStatus := ""
-
-	for _, result := range responseObject.Results {
-		for _, userid := range result.ShutdownRoom.KickedUsers {
-			users[userid] = true
-		}
-		for _, userid := range result.ShutdownRoom.FailedToKickUsers {
-			users[userid] = true
-		}
-		if result.Error != "" {
-			errorsSet[result.Error] = true
-		}
-		if result.Status == "shutting_down" {
-			if mostCompleteStatus == "" {
-				mostCompleteStatus = result.Status
+	for attempt := 1; ; attempt++ {
+		responseBody, retryAfter, matrixAdminError := admin.attempt(request, requestBody)
+		if matrixAdminError != nil {
+			matrixAdminError.Attempts = attempt
+			matrixAdminError.RetryAfter = retryAfter
+			retry := matrixAdminError.Temporary()
+			if request.Retry == matrixAdminRetryRateLimited {
+				retry = matrixAdminError.RateLimited()
+			} else if request.Retry == matrixAdminRetryNever {
+				retry = false
 			}
-		} else if result.Status == "purging" {
-			if mostCompleteStatus == "" || mostCompleteStatus == "shutting_down" {
-				mostCompleteStatus = result.Status
+			if !retry || attempt > admin.MaxRetries {
+				return matrixAdminError
 			}
-		} else if result.Status == "failed" {
-			if mostCompleteStatus == "" || mostCompleteStatus == "shutting_down" || mostCompleteStatus == "purging" {
-				mostCompleteStatus = result.Status
+
+			delay := admin.RetryBaseDelay << (attempt - 1)
+			if delay > admin.RetryMaxDelay || delay <= 0 {
+				delay = admin.RetryMaxDelay
 			}
-		} else if result.Status == "complete" {
-			if mostCompleteStatus == "" || mostCompleteStatus == "shutting_down" || mostCompleteStatus == "purging" || mostCompleteStatus == "failed" {
-				mostCompleteStatus = result.Status
+			if retryAfter > delay {
+				delay = retryAfter
 			}
+			log.Printf("matrixAdmin: %s, trying again in %s\n", matrixAdminError, delay)
+			time.Sleep(delay)
+			continue
 		}
 
+		if responseObject == nil {
+			return nil
+		}
+		err := json.Unmarshal(responseBody, responseObject)
+		if err != nil {
+			return errors.Wrapf(err, "HTTP %s %s: response json parse error", request.Method, request.Path)
+		}
+		return nil
 	}
-	usersSlice := []string{}
-	for userid := range users {
-		usersSlice = append(usersSlice, userid)
+}
+
+// attempt sends the request once. On 429 responses it also returns how long synapse asked us to wait.
+func (admin *MatrixAdmin) attempt(request matrixAdminRequest, requestBody []byte) ([]byte, time.Duration, *MatrixAdminError) {
+	ctx, cancel := context.WithTimeout(context.Background(), request.Timeout)
+	defer cancel()
+
+	requestURL := fmt.Sprintf("%s%s", admin.URL, request.Path)
+	if query := request.Query.Encode(); query != "" {
+		requestURL = fmt.Sprintf("%s?%s", requestURL, query)
+	}
+	var bodyReader io.Reader
+	if requestBody != nil {
+		bodyReader = bytes.NewReader(requestBody)
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, request.Method, requestURL, bodyReader)
+	if err != nil {
+		return nil, 0, &MatrixAdminError{Method: request.Method, Path: request.Path, Err: err}
+	}
+	if requestBody != nil {
+		httpRequest.Header.Set("Content-Type", "application/json")
+	}
+	httpRequest.Header.Set("Accept", "application/json")
+	if !request.Anonymous {
+		accessToken := admin.Token
+		if request.AccessToken != "" {
+			accessToken = request.AccessToken
+		}
+		httpRequest.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 	}
 
-	if mostCompleteStatus == "failed" {
-		errorsSlice := []string{}
-		for errString := range errorsSet {
-			errorsSlice = append(errorsSlice, errString)
+	response, err := admin.Client.Do(httpRequest)
+	if err != nil {
+		// the url error repeats the whole url, the path is already part of the MatrixAdminError
+		if urlError, isUrlError := err.(*url.Error); isUrlError {
+			err = urlError.Err
 		}
+		return nil, 0, &MatrixAdminError{Method: request.Method, Path: request.Path, Err: err}
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, 0, &MatrixAdminError{Method: request.Method, Path: request.Path, Err: errors.Wrap(err, "read error")}
+	}
+	if response.StatusCode < 300 {
+		return responseBody, 0, nil
+	}
 
-		return "", nil, errors.New(fmt.Sprintf("room deletion failed: \n%s", strings.Join(errorsSlice, "\n")))
+	matrixAdminError := &MatrixAdminError{Method: request.Method, Path: request.Path, StatusCode: response.StatusCode}
+	var errorResponse matrixErrorResponse
+	if json.Unmarshal(responseBody, &errorResponse) == nil && errorResponse.ErrCode != "" {
+		matrixAdminError.ErrCode = errorResponse.ErrCode
+		matrixAdminError.Message = errorResponse.Error
+	} else {
+		matrixAdminError.Message = string(responseBody)
+		if len(matrixAdminError.Message) > 500 {
+			matrixAdminError.Message = fmt.Sprintf("%s...", matrixAdminError.Message[:500])
+		}
 	}
 
-	return mostCompleteStatus, usersSlice, nil
+	retryAfter := time.Duration(errorResponse.RetryAfterMs) * time.Millisecond
+	if retryAfter == 0 {
+		if seconds, err := strconv.Atoi(response.Header.Get("Retry-After")); err == nil {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+	}
+	return nil, retryAfter, matrixAdminError
 }
 
-func (admin *MatrixAdmin) GetRoomName(roomId string) (string, error) {
+// https://element-hq.github.io/synapse/latest/admin_api/rooms.html#version-2-new-version
+// DeleteRoom asks synapse to shut down and purge a room in the background and returns the delete_id of the task,
+// GetDeleteRoomStatus tells when it is done.
+// The request is not retried after a timeout or a 5xx response, because synapse may have started the deletion anyway.
+// Instead, DeleteRoom asks synapse whether the room is being deleted before it reports the error.
 
-	urlWithoutToken := fmt.Sprintf(
-		"%s/_synapse/admin/v1/rooms/%s?access_token=",
-		admin.URL, roomId,
-	)
-	url := fmt.Sprintf("%s%s", urlWithoutToken, admin.Token)
-	response, err := admin.Client.Get(url)
-	if err != nil {
-		return "", errors.Wrapf(err, "HTTP GET %sxxxxxxx", urlWithoutToken)
-	}
+func (admin *MatrixAdmin) DeleteRoom(roomId string, ban bool, shutdown RoomShutdown) (string, error) {
 
-	responseBody, err := ioutil.ReadAll(response.Body)
+	deleteRequestBodyObject := DeleteRoomRequest{
+		Block:         ban,
+		ForcePurge:    true,
+		Purge:         true,
+		Message:       shutdown.Message,
+		NewRoomUserId: shutdown.NewRoomUserId,
+	}
+	// synapse only uses the room name when it creates a new room for the kicked users
+	if shutdown.NewRoomUserId != "" {
+		deleteRequestBodyObject.RoomName = shutdown.RoomName
+	}
+
+	var responseObject DeleteRoomResponse
+	err := admin.do(matrixAdminRequest{
+		Method:  "DELETE",
+		Path:    matrixPath("/_synapse/admin/v2/rooms/%s", roomId),
+		Body:    deleteRequestBodyObject,
+		Timeout: matrixAdminDeleteRoomTimeout,
+		Retry:   matrixAdminRetryRateLimited,
+	}, &responseObject)
+	if err == nil || !isTemporaryMatrixAdminError(err) {
+		return responseObject.DeleteId, err
+	}
+
+	newest, statusErr := admin.getNewestRoomDeletion(roomId)
+	// any task means synapse took the request, even when that task failed it is the one to report on
+	if statusErr == nil && newest.Status != "" {
+		log.Printf("matrixAdmin: %s, but synapse is deleting %s anyway (%s)\n", err, roomId, newest.Status)
+		return newest.DeleteId, nil
+	}
+	return "", err
+}
+
+// GetDeleteRoomStatus returns the status of the delete task with the given delete_id, along with every user that
+// was kicked from the room. Synapse keeps the tasks of earlier attempts to delete the room around, so a retried room
+// has to be polled by the delete_id of the retry.
+// Without a delete_id (jobs that were saved before delete_ids were kept) it falls back to the newest task of the room.
+func (admin *MatrixAdmin) GetDeleteRoomStatus(roomId, deleteId string) (string, []string, error) {
+
+	var deletion RoomDeletionStatus
+	var err error
+	if deleteId != "" {
+		err = admin.do(matrixAdminRequest{
+			Method: "GET",
+			Path:   matrixPath("/_synapse/admin/v2/rooms/delete_status/%s", deleteId),
+		}, &deletion)
+	} else {
+		deletion, err = admin.getNewestRoomDeletion(roomId)
+	}
 	if err != nil {
-		return "", errors.Wrapf(err, "HTTP GET %sxxxxxxx read error", urlWithoutToken)
+		return "", nil, err
 	}
 
-	if response.StatusCode == 404 {
-		return "no name found", nil
+	users := append([]string{}, deletion.ShutdownRoom.KickedUsers...)
+	users = append(users, deletion.ShutdownRoom.FailedToKickUsers...)
+
+	if deletion.Status == RoomDeletionStatusFailed {
+		return "", nil, errors.New(fmt.Sprintf("room deletion failed: \n%s", deletion.Error))
 	}
 
-	if response.StatusCode != 200 {
-		return "", fmt.Errorf(
-			"HTTP GET %sxxxxxxx: HTTP %d: %s",
-			urlWithoutToken, response.StatusCode, string(responseBody),
-		)
+	return deletion.Status, users, nil
+}
+
+// getNewestRoomDeletion returns the delete task that was started last for a room. Synapse lists them oldest first.
+func (admin *MatrixAdmin) getNewestRoomDeletion(roomId string) (RoomDeletionStatus, error) {
+
+	var responseObject RoomDeletionStatusResponse
+	err := admin.do(matrixAdminRequest{
+		Method: "GET",
+		Path:   matrixPath("/_synapse/admin/v2/rooms/%s/delete_status", roomId),
+	}, &responseObject)
+	if err != nil {
+		return RoomDeletionStatus{}, err
 	}
+	if len(responseObject.Results) == 0 {
+		return RoomDeletionStatus{}, nil
+	}
+	return responseObject.Results[len(responseObject.Results)-1], nil
+}
 
-	var responseObject RoomDetails
-	err = json.Unmarshal(responseBody, &responseObject)
+func (admin *MatrixAdmin) GetRoomName(roomId string) (string, error) {
+
+	roomDetails, err := admin.GetRoomDetails(roomId)
 	if err != nil {
-		return "", errors.Wrapf(err, "HTTP GET %sxxxxxxxxx response json parse error", urlWithoutToken)
+		return "", err
 	}
 
-	if responseObject.CanonicalAlias != "" {
-		return responseObject.CanonicalAlias, nil
+	if roomDetails.CanonicalAlias != "" {
+		return roomDetails.CanonicalAlias, nil
 	}
-	if responseObject.Name != "" {
-		return responseObject.Name, nil
+	if roomDetails.Name != "" {
+		return roomDetails.Name, nil
 	}
 	return "no name found", nil
 }
 
+// GetRoomDetails returns empty RoomDetails if synapse does not know about the room
+func (admin *MatrixAdmin) GetRoomDetails(roomId string) (RoomDetails, error) {
+
+	var responseObject RoomDetails
+	err := admin.do(matrixAdminRequest{
+		Method: "GET",
+		Path:   matrixPath("/_synapse/admin/v1/rooms/%s", roomId),
+	}, &responseObject)
+	if isNotFoundMatrixAdminError(err) {
+		return RoomDetails{}, nil
+	}
+	if err != nil {
+		return RoomDetails{}, err
+	}
+
+	return responseObject, nil
+}
+
 // curl 'https://matrix.cyberia.club/_matrix/client/r0/login' -X POST  -H 'Accept: application/json' -H 'content-type: application/json'
 //  --data-raw '{"type":"m.login.password","password":"xxxxxxxxx","identifier":{"type":"m.id.user","user":"forestjohnson"},"initial_device_display_name":"chat.cyberia.club (Firefox, Ubuntu)"}'
 
 func (admin *MatrixAdmin) Login(username, password string) (bool, error) {
 
-	loginURL := fmt.Sprintf("%s/_matrix/client/v3/login", admin.URL)
-
 	loginRequestBodyObject := LoginRequestBody{
 		Identifier: LoginIdentifier{
 			Type: "m.id.user",
@@ -276,81 +556,236 @@ func (admin *MatrixAdmin) Login(username, password string) (bool, error) {
 		Password:          password,
 		Type:              "m.login.password",
 	}
-	loginRequestBody, err := json.Marshal(loginRequestBodyObject)
+
+	// someone is waiting on the login form, so a rate limit or a synapse restart is returned right away
+	var responseObject LoginResponseBody
+	err := admin.do(matrixAdminRequest{
+		Method:    "POST",
+		Path:      "/_matrix/client/v3/login",
+		Body:      loginRequestBodyObject,
+		Anonymous: true,
+		Retry:     matrixAdminRetryNever,
+	}, &responseObject)
 	if err != nil {
-		return false, errors.Wrap(err, "can't serialize LoginRequestBody to json")
+		// a wrong username or password, anything else is worth showing
+		if matrixAdminError, ok := asMatrixAdminError(err); ok && !matrixAdminError.Temporary() {
+			return false, nil
+		}
+		return false, err
 	}
-	loginResponse, err := admin.Client.Post(loginURL, "application/json", bytes.NewBuffer(loginRequestBody))
+
+	err = admin.do(matrixAdminRequest{
+		Method:      "POST",
+		Path:        "/_matrix/client/v3/logout",
+		Body:        map[string]interface{}{},
+		AccessToken: responseObject.AccessToken,
+		Retry:       matrixAdminRetryNever,
+	}, nil)
 	if err != nil {
 		return false, err
 	}
 
-	//log.Printf("%s loginResponse.StatusCode: %d\n", username, loginResponse.StatusCode)
+	members, err := admin.getRoomMembers(admin.AdminMatrixRoomId, matrixAdminRetryNever)
+	if err != nil {
+		return false, err
+	}
+	if len(members) == 0 {
+		return false, fmt.Errorf("%s room did not have any members", admin.AdminMatrixRoomId)
+	}
 
-	if loginResponse.StatusCode > 200 {
-		return false, nil
+	for _, member := range members {
+		if member == fmt.Sprintf("@%s:%s", username, admin.MatrixServerPublicDomain) {
+			return true, nil
+		}
 	}
 
-	responseBody, err := ioutil.ReadAll(loginResponse.Body)
+	return false, nil
+}
+
+func (admin *MatrixAdmin) GetRoomMembers(roomId string) ([]string, error) {
+	return admin.getRoomMembers(roomId, matrixAdminRetryTemporary)
+}
+
+// getRoomMembers lets Login check the admin room without retrying, someone is waiting on the login page
+func (admin *MatrixAdmin) getRoomMembers(roomId string, retry string) ([]string, error) {
+
+	var responseObject RoomMembersResponseBody
+	err := admin.do(matrixAdminRequest{
+		Method: "GET",
+		Path:   matrixPath("/_synapse/admin/v1/rooms/%s/members", roomId),
+		Retry:  retry,
+	}, &responseObject)
 	if err != nil {
-		return false, errors.Wrapf(err, "HTTP POST %s read error", loginURL)
+		return nil, err
 	}
-	var responseObject LoginResponseBody
-	err = json.Unmarshal(responseBody, &responseObject)
+
+	return responseObject.Members, nil
+}
+
+// GetLocalRoomMembers returns only the members of the room who are users on this homeserver
+func (admin *MatrixAdmin) GetLocalRoomMembers(roomId string) ([]string, error) {
+	members, err := admin.GetRoomMembers(roomId)
 	if err != nil {
-		return false, errors.Wrapf(err, "HTTP POST %s response json parse error", loginURL)
+		return nil, err
 	}
 
-	logoutURL := fmt.Sprintf("%s/_matrix/client/v3/logout", admin.URL)
-	logoutRequest, err := http.NewRequest("POST", logoutURL, nil)
-	if err != nil {
-		return false, errors.Wrap(err, "matrixAdmin.Login(...) cannot create logoutRequest")
+	localMembers := []string{}
+	for _, member := range members {
+		if strings.HasSuffix(member, fmt.Sprintf(":%s", admin.MatrixServerPublicDomain)) {
+			localMembers = append(localMembers, member)
+		}
 	}
+	return localMembers, nil
+}
+
+// curl -X POST -H "Authorization: Bearer xxxxxxxxx" "localhost:8008/_synapse/admin/v1/join/$roomid?server_name=matrix.org" \
+// 	--data '{ "user_id": "@someone:cyberia.club" }'
 
-	logoutRequest.Header.Add("Authorization", fmt.Sprintf("Bearer %s", responseObject.AccessToken))
+// JoinRoom makes a local user join a room. The servers are used to join over federation,
+// which is needed when this homeserver has no copy of the room anymore.
+func (admin *MatrixAdmin) JoinRoom(roomId string, userId string, servers []string) error {
+
+	return admin.do(matrixAdminRequest{
+		Method:  "POST",
+		Path:    matrixPath("/_synapse/admin/v1/join/%s", roomId),
+		Query:   url.Values{"server_name": servers},
+		Body:    JoinRoomRequest{UserId: userId},
+		Timeout: matrixAdminJoinRoomTimeout,
+	}, nil)
+}
 
-	_, err = admin.Client.Do(logoutRequest)
+// PurgeRemoteMediaCache removes the local copies of remote media which was last accessed before the given time.
+// Returns the number of files that synapse deleted.
+func (admin *MatrixAdmin) PurgeRemoteMediaCache(beforeUnixMilli int64) (int64, error) {
+
+	var responseObject PurgeMediaCacheResponse
+	err := admin.do(matrixAdminRequest{
+		Method:  "POST",
+		Path:    "/_synapse/admin/v1/purge_media_cache",
+		Query:   url.Values{"before_ts": []string{strconv.FormatInt(beforeUnixMilli, 10)}},
+		Body:    map[string]interface{}{},
+		Timeout: matrixAdminPurgeMediaTimeout,
+	}, &responseObject)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
 
-	roomMembersURLWithoutToken := fmt.Sprintf(
-		"%s/_synapse/admin/v1/rooms/%s/members?access_token=",
-		admin.URL, admin.AdminMatrixRoomId,
-	)
-	roomMembersURL := fmt.Sprintf("%s%s", roomMembersURLWithoutToken, admin.Token)
-	roomMembersResponse, err := admin.Client.Get(roomMembersURL)
+	return responseObject.Deleted, nil
+}
+
+// DeleteLocalMedia deletes a single piece of media that was uploaded to this homeserver
+func (admin *MatrixAdmin) DeleteLocalMedia(mediaId string) error {
+
+	return admin.do(matrixAdminRequest{
+		Method: "DELETE",
+		Path:   matrixPath("/_synapse/admin/v1/media/%s/%s", admin.MatrixServerPublicDomain, mediaId),
+	}, nil)
+}
+
+// GetRoomMedia lists the mxc:// URIs of all the media that was posted in a room
+func (admin *MatrixAdmin) GetRoomMedia(roomId string) (RoomMediaResponse, error) {
+
+	var responseObject RoomMediaResponse
+	err := admin.do(matrixAdminRequest{
+		Method: "GET",
+		Path:   matrixPath("/_synapse/admin/v1/room/%s/media", roomId),
+	}, &responseObject)
 	if err != nil {
-		return false, errors.Wrapf(err, "HTTP GET %sxxxxxxx", roomMembersURLWithoutToken)
+		return RoomMediaResponse{}, err
 	}
 
-	roomMembersResponseBody, err := ioutil.ReadAll(roomMembersResponse.Body)
+	return responseObject, nil
+}
+
+// GetUserMedia lists the biggest media uploaded by a local user
+func (admin *MatrixAdmin) GetUserMedia(userId string, limit int) (UserMediaResponse, error) {
+
+	var responseObject UserMediaResponse
+	err := admin.do(matrixAdminRequest{
+		Method: "GET",
+		Path:   matrixPath("/_synapse/admin/v1/users/%s/media", userId),
+		Query: url.Values{
+			"limit":    []string{strconv.Itoa(limit)},
+			"order_by": []string{"media_length"},
+			"dir":      []string{"b"},
+		},
+	}, &responseObject)
 	if err != nil {
-		return false, errors.Wrapf(err, "HTTP GET %sxxxxxxx read error", roomMembersURLWithoutToken)
+		return UserMediaResponse{}, err
 	}
 
-	if roomMembersResponse.StatusCode != 200 {
-		return false, fmt.Errorf(
-			"HTTP GET %sxxxxxxx: HTTP %d: %s",
-			roomMembersURLWithoutToken, roomMembersResponse.StatusCode, string(roomMembersResponseBody),
-		)
+	return responseObject, nil
+}
+
+// WhoAmI returns the matrix user id that the MatrixAdminToken belongs to
+func (admin *MatrixAdmin) WhoAmI() (string, error) {
+
+	var responseObject WhoAmIResponse
+	err := admin.do(matrixAdminRequest{
+		Method: "GET",
+		Path:   "/_matrix/client/v3/account/whoami",
+	}, &responseObject)
+	if err != nil {
+		return "", err
 	}
 
-	var roomMembersResponseObject RoomMembersResponseBody
-	err = json.Unmarshal(roomMembersResponseBody, &roomMembersResponseObject)
+	return responseObject.UserId, nil
+}
+
+// SendNotice posts a plain text m.notice message to a room as the user that the MatrixAdminToken belongs to.
+// The transaction id stays the same when the request is retried, so synapse won't post the message twice.
+func (admin *MatrixAdmin) SendNotice(roomId string, text string) error {
+
+	transactionId := fmt.Sprintf("janitor%d", time.Now().UnixNano())
+	return admin.do(matrixAdminRequest{
+		Method:  "PUT",
+		Path:    matrixPath("/_matrix/client/v3/rooms/%s/send/m.room.message/%s", roomId, transactionId),
+		Body:    RoomMessageContent{MsgType: "m.notice", Body: text},
+		Timeout: matrixAdminSendNoticeTimeout,
+		Retry:   matrixAdminRetryNever,
+	}, nil)
+}
+
+// SyncRoomMessages long-polls /sync for new m.room.message events in one room.
+// Pass the returned next batch token as since on the next call. With an empty since, only the token is interesting.
+func (admin *MatrixAdmin) SyncRoomMessages(roomId string, since string, timeoutMilli int) (string, []RoomMessageEvent, error) {
+
+	filter, err := json.Marshal(map[string]interface{}{
+		"presence":     map[string]interface{}{"types": []string{}},
+		"account_data": map[string]interface{}{"types": []string{}},
+		"room": map[string]interface{}{
+			"rooms":        []string{roomId},
+			"state":        map[string]interface{}{"types": []string{}},
+			"ephemeral":    map[string]interface{}{"types": []string{}},
+			"account_data": map[string]interface{}{"types": []string{}},
+			"timeline":     map[string]interface{}{"types": []string{"m.room.message"}, "limit": 50},
+		},
+	})
 	if err != nil {
-		return false, errors.Wrapf(err, "HTTP GET %sxxxxxxxxx response json parse error", roomMembersURLWithoutToken)
+		return "", nil, errors.Wrap(err, "matrixAdmin.SyncRoomMessages() cannot serialize filter as JSON")
 	}
-	if len(roomMembersResponseObject.Members) == 0 {
-		return false, errors.Wrapf(err, "%s room did not have any members", admin.AdminMatrixRoomId)
+
+	query := url.Values{}
+	query.Set("filter", string(filter))
+	query.Set("timeout", strconv.Itoa(timeoutMilli))
+	if since != "" {
+		query.Set("since", since)
 	}
 
-	for _, member := range roomMembersResponseObject.Members {
-		//log.Printf("%s == %s\n", member, fmt.Sprintf("@%s:%s", username, admin.MatrixServerPublicDomain))
-		if member == fmt.Sprintf("@%s:%s", username, admin.MatrixServerPublicDomain) {
-			return true, nil
-		}
+	var responseObject SyncResponse
+	err = admin.do(matrixAdminRequest{
+		Method:  "GET",
+		Path:    "/_matrix/client/v3/sync",
+		Query:   query,
+		Timeout: time.Duration(timeoutMilli)*time.Millisecond + matrixAdminSyncTimeoutMargin,
+	}, &responseObject)
+	if err != nil {
+		return "", nil, err
 	}
 
-	return false, nil
+	events := []RoomMessageEvent{}
+	if room, has := responseObject.Rooms.Join[roomId]; has {
+		events = room.Timeline.Events
+	}
+	return responseObject.NextBatch, events, nil
 }
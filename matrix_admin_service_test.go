@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatrixAdminSendsTheTokenInTheAuthorizationHeader(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom("!abc/def:example.com", "slashes", "", "@alice:example.com")
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	members, err := admin.GetRoomMembers("!abc/def:example.com")
+	if err != nil {
+		t.Fatalf("GetRoomMembers: %s", err)
+	}
+	if len(members) != 1 || members[0] != "@alice:example.com" {
+		t.Errorf("GetRoomMembers returned %v", members)
+	}
+
+	requests := synapse.Requests()
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	if requests[0].EscapedPath != "/_synapse/admin/v1/rooms/%21abc%2Fdef:example.com/members" {
+		t.Errorf("the room id was not escaped: %s", requests[0].EscapedPath)
+	}
+	if requests[0].Authorization != "Bearer syt_admin_token" {
+		t.Errorf("Authorization header is '%s'", requests[0].Authorization)
+	}
+	if strings.Contains(requests[0].RawQuery, "access_token") {
+		t.Errorf("the access token was sent in the query string: %s", requests[0].RawQuery)
+	}
+}
+
+func TestMatrixAdminRetriesRateLimitedAndFailedRequests(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom("!a:example.com", "a", "#a:example.com", "@alice:example.com")
+	synapse.Fail(
+		"GET /_synapse/admin/v1/rooms/!a:example.com",
+		fakeSynapseFailure{StatusCode: http.StatusTooManyRequests, ErrCode: "M_LIMIT_EXCEEDED", RetryAfterMs: 50},
+		fakeSynapseFailure{StatusCode: http.StatusBadGateway},
+	)
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	startTime := time.Now()
+	details, err := admin.GetRoomDetails("!a:example.com")
+	if err != nil {
+		t.Fatalf("GetRoomDetails: %s", err)
+	}
+	if details.CanonicalAlias != "#a:example.com" {
+		t.Errorf("GetRoomDetails returned %+v", details)
+	}
+	if count := synapse.RequestCount("GET", "/_synapse/admin/v1/rooms/!a:example.com"); count != 3 {
+		t.Errorf("expected 3 attempts, got %d", count)
+	}
+	if elapsed := time.Since(startTime); elapsed < 50*time.Millisecond {
+		t.Errorf("retry_after_ms was not honoured, the retries only took %s", elapsed)
+	}
+}
+
+func TestMatrixAdminGivesUpAfterMaxRetries(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom("!a:example.com", "a", "", "@alice:example.com")
+	failures := []fakeSynapseFailure{}
+	for i := 0; i < 10; i++ {
+		failures = append(failures, fakeSynapseFailure{StatusCode: http.StatusServiceUnavailable})
+	}
+	synapse.Fail("GET /_synapse/admin/v1/rooms/!a:example.com/members", failures...)
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	_, err := admin.GetRoomMembers("!a:example.com")
+	matrixAdminError, ok := asMatrixAdminError(err)
+	if !ok {
+		t.Fatalf("expected a MatrixAdminError, got %v", err)
+	}
+	if matrixAdminError.StatusCode != http.StatusServiceUnavailable || !matrixAdminError.Temporary() {
+		t.Errorf("unexpected error %+v", matrixAdminError)
+	}
+	if matrixAdminError.Attempts != admin.MaxRetries+1 {
+		t.Errorf("expected %d attempts, got %d", admin.MaxRetries+1, matrixAdminError.Attempts)
+	}
+	if count := synapse.RequestCount("GET", "/_synapse/admin/v1/rooms/!a:example.com/members"); count != admin.MaxRetries+1 {
+		t.Errorf("expected %d requests, got %d", admin.MaxRetries+1, count)
+	}
+}
+
+func TestMatrixAdminDoesNotRetryClientErrors(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	_, err := admin.DeleteRoom("!unknown:example.com", false, RoomShutdown{Message: "bye"})
+	matrixAdminError, ok := asMatrixAdminError(err)
+	if !ok {
+		t.Fatalf("expected a MatrixAdminError, got %v", err)
+	}
+	if matrixAdminError.StatusCode != http.StatusBadRequest || matrixAdminError.ErrCode != "M_UNKNOWN" || matrixAdminError.Temporary() {
+		t.Errorf("unexpected error %+v", matrixAdminError)
+	}
+	if matrixAdminError.Attempts != 1 {
+		t.Errorf("a client error was retried %d times", matrixAdminError.Attempts-1)
+	}
+
+	admin.Token = "wrong"
+	_, err = admin.GetRoomMembers(testAdminRoomId)
+	if matrixAdminError, ok := asMatrixAdminError(err); !ok || matrixAdminError.ErrCode != "M_UNKNOWN_TOKEN" {
+		t.Errorf("expected M_UNKNOWN_TOKEN, got %v", err)
+	}
+}
+
+func TestMatrixAdminRetriesWhenSynapseIsDown(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+	synapse.Server.Close()
+
+	_, err := admin.WhoAmI()
+	matrixAdminError, ok := asMatrixAdminError(err)
+	if !ok {
+		t.Fatalf("expected a MatrixAdminError, got %v", err)
+	}
+	if matrixAdminError.StatusCode != 0 || matrixAdminError.Err == nil || !isTemporaryMatrixAdminError(err) {
+		t.Errorf("unexpected error %+v", matrixAdminError)
+	}
+	if matrixAdminError.Attempts != admin.MaxRetries+1 {
+		t.Errorf("expected %d attempts, got %d", admin.MaxRetries+1, matrixAdminError.Attempts)
+	}
+}
+
+func TestGetRoomDetailsOfAnUnknownRoom(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	details, err := admin.GetRoomDetails("!unknown:example.com")
+	if err != nil {
+		t.Fatalf("GetRoomDetails: %s", err)
+	}
+	if details.RoomId != "" {
+		t.Errorf("expected empty RoomDetails, got %+v", details)
+	}
+}
+
+func TestDeleteRoomStatusTransitions(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom("!a:example.com", "a", "", "@alice:example.com", "@bob:example.com", "@carol:remote.org")
+	failing := synapse.AddRoom("!b:example.com", "b", "", "@alice:example.com")
+	failing.DeleteStatuses = []string{RoomDeletionStatusShuttingDown, RoomDeletionStatusFailed}
+	failing.DeleteError = "the purge blew up"
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	_, _, err := admin.GetDeleteRoomStatus("!a:example.com", "")
+	if !isNotFoundMatrixAdminError(err) {
+		t.Errorf("expected 404 before the room was deleted, got %v", err)
+	}
+
+	deleteId, err := admin.DeleteRoom("!a:example.com", true, RoomShutdown{Message: "bye", NewRoomUserId: "@janitor:example.com", RoomName: "notice"})
+	if err != nil {
+		t.Fatalf("DeleteRoom: %s", err)
+	}
+	if deleteId == "" {
+		t.Errorf("DeleteRoom didn't return the delete_id")
+	}
+	deleteRequests := synapse.Room("!a:example.com").DeleteRequests
+	if len(deleteRequests) != 1 {
+		t.Fatalf("expected 1 delete request, got %d", len(deleteRequests))
+	}
+	expectedRequest := DeleteRoomRequest{
+		Block: true, ForcePurge: true, Purge: true, Message: "bye", NewRoomUserId: "@janitor:example.com", RoomName: "notice",
+	}
+	if deleteRequests[0] != expectedRequest {
+		t.Errorf("delete request was %+v", deleteRequests[0])
+	}
+
+	for _, expectedStatus := range []string{RoomDeletionStatusShuttingDown, RoomDeletionStatusPurging, RoomDeletionStatusComplete} {
+		status, users, err := admin.GetDeleteRoomStatus("!a:example.com", deleteId)
+		if err != nil {
+			t.Fatalf("GetDeleteRoomStatus: %s", err)
+		}
+		if status != expectedStatus {
+			t.Errorf("expected status %s, got %s", expectedStatus, status)
+		}
+		sort.Strings(users)
+		if strings.Join(users, ",") != "@alice:example.com,@bob:example.com" {
+			t.Errorf("expected the local members to be kicked, got %v", users)
+		}
+	}
+
+	// jobs that were saved before the delete_id was kept have to make do with the per room status
+	_, err = admin.DeleteRoom("!b:example.com", false, RoomShutdown{Message: "bye", RoomName: "ignored"})
+	if err != nil {
+		t.Fatalf("DeleteRoom: %s", err)
+	}
+	var body map[string]interface{}
+	requests := synapse.Requests()
+	json.Unmarshal(requests[len(requests)-1].Body, &body)
+	if _, has := body["room_name"]; has {
+		t.Errorf("room_name was sent without new_room_user_id: %v", body)
+	}
+
+	status, _, err := admin.GetDeleteRoomStatus("!b:example.com", "")
+	if err != nil || status != RoomDeletionStatusShuttingDown {
+		t.Errorf("expected %s, got %s %v", RoomDeletionStatusShuttingDown, status, err)
+	}
+	_, _, err = admin.GetDeleteRoomStatus("!b:example.com", "")
+	if err == nil || !strings.Contains(err.Error(), "the purge blew up") {
+		t.Errorf("expected the deletion to fail, got %v", err)
+	}
+}
+
+func TestRetriedRoomDeletionCompletes(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom("!a:example.com", "a", "", "@alice:example.com")
+	synapse.SetDeleteStatuses("!a:example.com", "the purge blew up", RoomDeletionStatusShuttingDown, RoomDeletionStatusFailed)
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	failedDeleteId, err := admin.DeleteRoom("!a:example.com", false, RoomShutdown{Message: "bye"})
+	if err != nil {
+		t.Fatalf("DeleteRoom: %s", err)
+	}
+	admin.GetDeleteRoomStatus("!a:example.com", failedDeleteId)
+	_, _, err = admin.GetDeleteRoomStatus("!a:example.com", failedDeleteId)
+	if err == nil || !strings.Contains(err.Error(), "the purge blew up") {
+		t.Fatalf("expected the first deletion to fail, got %v", err)
+	}
+
+	// the failed task is still listed for the room, the retry must not be reported as failed because of it
+	synapse.SetDeleteStatuses("!a:example.com", "", RoomDeletionStatusShuttingDown, RoomDeletionStatusPurging, RoomDeletionStatusComplete)
+	retryDeleteId, err := admin.DeleteRoom("!a:example.com", false, RoomShutdown{Message: "bye"})
+	if err != nil {
+		t.Fatalf("DeleteRoom: %s", err)
+	}
+	if retryDeleteId == failedDeleteId {
+		t.Fatalf("the retry got the delete_id of the failed deletion")
+	}
+	for _, expectedStatus := range []string{RoomDeletionStatusShuttingDown, RoomDeletionStatusPurging, RoomDeletionStatusComplete} {
+		status, _, err := admin.GetDeleteRoomStatus("!a:example.com", retryDeleteId)
+		if err != nil || status != expectedStatus {
+			t.Errorf("expected the retry to be %s, got %s %v", expectedStatus, status, err)
+		}
+	}
+
+	// without a delete_id the newest task of the room is the one that counts
+	status, _, err := admin.GetDeleteRoomStatus("!a:example.com", "")
+	if err != nil || status != RoomDeletionStatusComplete {
+		t.Errorf("expected the newest deletion to be %s, got %s %v", RoomDeletionStatusComplete, status, err)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom(testAdminRoomId, "admins", "", "@janitor:example.com", "@alice:example.com")
+	synapse.AddUser("alice", "alice's password")
+	synapse.AddUser("mallory", "mallory's password")
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	success, err := admin.Login("alice", "alice's password")
+	if err != nil || !success {
+		t.Errorf("alice can't log in: %t %v", success, err)
+	}
+	success, err = admin.Login("alice", "wrong")
+	if err != nil || success {
+		t.Errorf("alice logged in with the wrong password: %t %v", success, err)
+	}
+	success, err = admin.Login("mallory", "mallory's password")
+	if err != nil || success {
+		t.Errorf("mallory is not in the admin room but logged in: %t %v", success, err)
+	}
+
+	for _, request := range synapse.Requests() {
+		if request.Path == "/_matrix/client/v3/login" && request.Authorization != "" {
+			t.Errorf("the admin token was sent to the login endpoint")
+		}
+		if request.Path == "/_matrix/client/v3/logout" && !strings.HasPrefix(request.Authorization, "Bearer syt_user_token_") {
+			t.Errorf("logout was sent with '%s' instead of the token of the user", request.Authorization)
+		}
+	}
+	synapse.mutex.Lock()
+	defer synapse.mutex.Unlock()
+	if len(synapse.accessTokens) != 0 {
+		t.Errorf("%d access tokens were not logged out", len(synapse.accessTokens))
+	}
+}
+
+func TestDeleteRoomIsNotSentTwice(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom("!a:example.com", "a", "", "@alice:example.com")
+	synapse.AddRoom("!b:example.com", "b", "", "@alice:example.com")
+	synapse.AddRoom("!c:example.com", "c", "", "@alice:example.com")
+	// synapse started deleting !a, but the proxy in front of it timed out
+	synapse.Fail("DELETE /_synapse/admin/v2/rooms/!a:example.com", fakeSynapseFailure{StatusCode: http.StatusGatewayTimeout, AfterHandling: true})
+	// the request for !b never got to synapse
+	synapse.Fail("DELETE /_synapse/admin/v2/rooms/!b:example.com", fakeSynapseFailure{StatusCode: http.StatusBadGateway})
+	// rate limiting is the one thing that is retried, synapse did not do anything with the request
+	synapse.Fail("DELETE /_synapse/admin/v2/rooms/!c:example.com", fakeSynapseFailure{StatusCode: http.StatusTooManyRequests, RetryAfterMs: 1})
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	deleteId, err := admin.DeleteRoom("!a:example.com", false, RoomShutdown{Message: "bye"})
+	if err != nil || deleteId == "" {
+		t.Errorf("synapse is deleting !a but DeleteRoom returned '%s' %v", deleteId, err)
+	}
+	_, err = admin.DeleteRoom("!b:example.com", false, RoomShutdown{Message: "bye"})
+	if matrixAdminError, ok := asMatrixAdminError(err); !ok || matrixAdminError.StatusCode != http.StatusBadGateway {
+		t.Errorf("expected the 502 for !b, got %v", err)
+	}
+	_, err = admin.DeleteRoom("!c:example.com", false, RoomShutdown{Message: "bye"})
+	if err != nil {
+		t.Errorf("the rate limited delete of !c was not retried: %s", err)
+	}
+
+	for roomId, expected := range map[string]int{"!a:example.com": 1, "!b:example.com": 1, "!c:example.com": 2} {
+		if count := synapse.RequestCount("DELETE", fmt.Sprintf("/_synapse/admin/v2/rooms/%s", roomId)); count != expected {
+			t.Errorf("expected %d DELETE requests for %s, got %d", expected, roomId, count)
+		}
+	}
+}
+
+func TestLoginIsNotRetried(t *testing.T) {
+	synapse := newFakeSynapse(t)
+	synapse.AddRoom(testAdminRoomId, "admins", "", "@janitor:example.com", "@alice:example.com")
+	synapse.AddUser("alice", "alice's password")
+	synapse.Fail("POST /_matrix/client/v3/login", fakeSynapseFailure{StatusCode: http.StatusTooManyRequests, ErrCode: "M_LIMIT_EXCEEDED", RetryAfterMs: 5000})
+	admin := synapse.newMatrixAdmin(testAdminRoomId)
+
+	_, err := admin.Login("alice", "alice's password")
+	matrixAdminError, ok := asMatrixAdminError(err)
+	if !ok || !matrixAdminError.RateLimited() || matrixAdminError.RetryAfter != 5*time.Second {
+		t.Fatalf("expected the 429 to be returned, got %v", err)
+	}
+	if count := synapse.RequestCount("POST", "/_matrix/client/v3/login"); count != 1 {
+		t.Errorf("the login was sent %d times", count)
+	}
+
+	// the requests after a successful login are not retried either
+	membersPath := fmt.Sprintf("/_synapse/admin/v1/rooms/%s/members", testAdminRoomId)
+	synapse.Fail("GET "+membersPath, fakeSynapseFailure{StatusCode: http.StatusServiceUnavailable})
+	_, err = admin.Login("alice", "alice's password")
+	if matrixAdminError, ok := asMatrixAdminError(err); !ok || matrixAdminError.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected the 503 to be returned, got %v", err)
+	}
+	if count := synapse.RequestCount("GET", membersPath); count != 1 {
+		t.Errorf("the admin room members were requested %d times", count)
+	}
+}
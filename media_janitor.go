@@ -0,0 +1,346 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MediaCleanupOptions struct {
+	// cached copies of remote media that nobody looked at for this many days are purged. 0 means don't purge
+	RemoteCacheMaxAgeDays int
+	// local media that nobody looked at for this many days is deleted. 0 means don't delete local media
+	LocalMaxAgeDays   int
+	LocalMinSizeBytes int64
+	MaxFilesPerRun    int
+	MaxBytesPerRun    int64
+}
+
+type MediaCleanupReport struct {
+	Options MediaCleanupOptions
+	// the remote media cache is purged up to RemoteCacheBeforeUnixMilli, which keeps it within MaxFilesPerRun and MaxBytesPerRun
+	RemoteCacheBeforeUnixMilli int64
+	RemoteCacheFiles           int64
+	RemoteCacheBytes           int64
+	LocalMedia                 []LocalMedia
+	LocalBytes                 int64
+}
+
+type MediaCleanupProgress struct {
+	Options                    MediaCleanupOptions
+	Phase                      string
+	StartedUnixMilli           int64
+	RemoteCacheBeforeUnixMilli int64
+	RemoteCachePurged          int64
+	LocalMedia                 []LocalMedia
+	LocalMediaIndex            int
+	LocalBytesDeleted          int64
+	Errors                     []string
+}
+
+const (
+	MediaPhasePurgeRemoteCache = "purgeRemoteCache"
+	MediaPhaseDeleteLocalMedia = "deleteLocalMedia"
+)
+
+// mediaCleanup is locked while a media cleanup is being started and while the running flag is checked and changed,
+// so two admins pressing start at the same time can't both start one
+var mediaCleanup = struct {
+	sync.Mutex
+	running bool
+}{}
+
+func getDefaultMediaCleanupOptions(config *Config) MediaCleanupOptions {
+	options := MediaCleanupOptions{
+		RemoteCacheMaxAgeDays: config.MediaRemoteCacheMaxAgeDays,
+		LocalMaxAgeDays:       config.MediaLocalMaxAgeDays,
+		LocalMinSizeBytes:     config.MediaLocalMinSizeBytes,
+		MaxFilesPerRun:        config.MediaMaxFilesPerRun,
+		MaxBytesPerRun:        config.MediaMaxBytesPerRun,
+	}
+	if options.MaxFilesPerRun <= 0 {
+		options.MaxFilesPerRun = 1000
+	}
+	return options
+}
+
+// buildMediaCleanupReport works out what a media cleanup with these options would delete without changing anything.
+func buildMediaCleanupReport(db *DBModel, options MediaCleanupOptions) (MediaCleanupReport, error) {
+	report := MediaCleanupReport{
+		Options:    options,
+		LocalMedia: []LocalMedia{},
+	}
+
+	if options.RemoteCacheMaxAgeDays > 0 {
+		before := time.Now().Add(-time.Hour * 24 * time.Duration(options.RemoteCacheMaxAgeDays)).UnixMilli()
+		cutoff, files, bytez, err := db.GetRemoteMediaCachePurgeCutoff(before, options.MaxFilesPerRun, options.MaxBytesPerRun)
+		if err != nil {
+			return report, err
+		}
+		report.RemoteCacheBeforeUnixMilli = cutoff
+		report.RemoteCacheFiles = files
+		report.RemoteCacheBytes = bytez
+	}
+
+	if options.LocalMaxAgeDays > 0 {
+		before := time.Now().Add(-time.Hour * 24 * time.Duration(options.LocalMaxAgeDays)).UnixMilli()
+		candidates, err := db.GetLocalMediaCandidates(before, options.LocalMinSizeBytes, options.MaxFilesPerRun, matrixAdmin.MatrixServerPublicDomain)
+		if err != nil {
+			return report, err
+		}
+		for _, media := range candidates {
+			if options.MaxBytesPerRun > 0 && report.LocalBytes+media.MediaLength > options.MaxBytesPerRun {
+				continue
+			}
+			report.LocalMedia = append(report.LocalMedia, media)
+			report.LocalBytes += media.MediaLength
+		}
+	}
+
+	return report, nil
+}
+
+// startMediaCleanup saves a new media cleanup job to data/mediaCleanup.json and starts working on it in the background.
+func startMediaCleanup(db *DBModel, options MediaCleanupOptions) error {
+	mediaCleanup.Lock()
+	defer mediaCleanup.Unlock()
+
+	existing, err := ReadJsonFile[MediaCleanupProgress]("data/mediaCleanup.json")
+	if err != nil {
+		return err
+	}
+	if existing.Phase != "" {
+		return fmt.Errorf("can't start media cleanup because another one is already in progress")
+	}
+
+	// the list of local media and the remote cache cutoff are decided up front so the limits hold even if the job is resumed after a restart
+	report, err := buildMediaCleanupReport(db, options)
+	if err != nil {
+		return err
+	}
+
+	err = WriteJsonFile("data/mediaCleanup.json", MediaCleanupProgress{
+		Options:                    options,
+		Phase:                      MediaPhasePurgeRemoteCache,
+		StartedUnixMilli:           time.Now().UnixMilli(),
+		RemoteCacheBeforeUnixMilli: report.RemoteCacheBeforeUnixMilli,
+		LocalMedia:                 report.LocalMedia,
+		Errors:                     []string{},
+	})
+	if err != nil {
+		return err
+	}
+
+	go doMediaCleanup()
+
+	return nil
+}
+
+func doMediaCleanup() {
+	mediaCleanup.Lock()
+	if mediaCleanup.running {
+		mediaCleanup.Unlock()
+		log.Println("doMediaCleanup(): a media cleanup is running already!")
+		return
+	}
+	mediaCleanup.running = true
+	mediaCleanup.Unlock()
+	defer func() {
+		mediaCleanup.Lock()
+		mediaCleanup.running = false
+		mediaCleanup.Unlock()
+	}()
+
+	progress, err := ReadJsonFile[MediaCleanupProgress]("data/mediaCleanup.json")
+	if err != nil {
+		log.Printf("doMediaCleanup(): Can't do media cleanup because can't read mediaCleanup.json: %s\n", err)
+		return
+	}
+	if progress.Phase == "" {
+		log.Println("doMediaCleanup(): Can't do media cleanup because there is nothing to clean up")
+		return
+	}
+
+	saveProgress := func() bool {
+		err := WriteJsonFile("data/mediaCleanup.json", progress)
+		if err != nil {
+			log.Printf("doMediaCleanup(): Can't do media cleanup because can't write mediaCleanup.json: %s\n", err)
+			return false
+		}
+		return true
+	}
+
+	if progress.Phase == MediaPhasePurgeRemoteCache {
+		if progress.Options.RemoteCacheMaxAgeDays > 0 {
+			before := progress.RemoteCacheBeforeUnixMilli
+			if before == 0 {
+				before = time.Now().Add(-time.Hour * 24 * time.Duration(progress.Options.RemoteCacheMaxAgeDays)).UnixMilli()
+			}
+			log.Printf("doMediaCleanup(): purging remote media cache last accessed before %s...\n", time.UnixMilli(before).Format(time.RFC3339))
+			deleted, err := matrixAdmin.PurgeRemoteMediaCache(before)
+			if err != nil {
+				log.Printf("doMediaCleanup(): PurgeRemoteMediaCache returned %s\n", err)
+				progress.Errors = append(progress.Errors, err.Error())
+			}
+			progress.RemoteCachePurged = deleted
+		}
+
+		progress.Phase = MediaPhaseDeleteLocalMedia
+		if !saveProgress() {
+			return
+		}
+	}
+
+	if progress.Phase == MediaPhaseDeleteLocalMedia {
+		log.Printf("doMediaCleanup(): deleting %d local media starting at %d...\n", len(progress.LocalMedia), progress.LocalMediaIndex)
+
+		lastUpdateTime := time.Now()
+		for progress.LocalMediaIndex < len(progress.LocalMedia) {
+			media := progress.LocalMedia[progress.LocalMediaIndex]
+			err := matrixAdmin.DeleteLocalMedia(media.MediaId)
+			if err != nil {
+				log.Printf("doMediaCleanup(): DeleteLocalMedia('%s') returned %s\n", media.MediaId, err)
+				progress.Errors = append(progress.Errors, fmt.Sprintf("%s: %s", media.MediaId, err))
+			} else {
+				progress.LocalBytesDeleted += media.MediaLength
+			}
+			progress.LocalMediaIndex++
+
+			if time.Since(lastUpdateTime) > time.Second*5 {
+				lastUpdateTime = time.Now()
+				if !saveProgress() {
+					return
+				}
+			}
+		}
+	}
+
+	log.Printf(
+		"doMediaCleanup(): purged %d remote media files, deleted %d local media files (%s) with %d errors\n",
+		progress.RemoteCachePurged, progress.LocalMediaIndex, formatBytes(progress.LocalBytesDeleted), len(progress.Errors),
+	)
+
+	err = WriteJsonFile("data/lastMediaCleanup.json", progress)
+	if err != nil {
+		log.Printf("doMediaCleanup(): failed to write lastMediaCleanup.json: %s\n", err)
+	}
+
+	err = RemoveJsonFile("data/mediaCleanup.json")
+	if err != nil {
+		log.Printf("doMediaCleanup(): failed to remove mediaCleanup.json: %s\n", err)
+	}
+
+	log.Println("doMediaCleanup(): completed successfully!!")
+}
+
+func parseMediaCleanupOptions(request *http.Request, defaults MediaCleanupOptions) MediaCleanupOptions {
+	options := defaults
+	parseInt := func(name string) (int64, bool) {
+		value, err := strconv.ParseInt(strings.TrimSpace(request.PostFormValue(name)), 10, 64)
+		return value, err == nil && value >= 0
+	}
+	if value, ok := parseInt("remoteCacheMaxAgeDays"); ok {
+		options.RemoteCacheMaxAgeDays = int(value)
+	}
+	if value, ok := parseInt("localMaxAgeDays"); ok {
+		options.LocalMaxAgeDays = int(value)
+	}
+	if value, ok := parseInt("localMinSizeBytes"); ok {
+		options.LocalMinSizeBytes = value
+	}
+	if value, ok := parseInt("maxFilesPerRun"); ok && value > 0 {
+		options.MaxFilesPerRun = int(value)
+	}
+	if value, ok := parseInt("maxBytesPerRun"); ok {
+		options.MaxBytesPerRun = value
+	}
+	return options
+}
+
+func registerMediaRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/media", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		progress, err := ReadJsonFile[MediaCleanupProgress]("data/mediaCleanup.json")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading mediaCleanup json"
+		}
+		if progress.Phase != "" {
+			app.buildPageFromTemplate(responseWriter, request, session, "media_cleaning.html", progress)
+			return
+		}
+
+		options := getDefaultMediaCleanupOptions(config)
+		var report *MediaCleanupReport
+		var roomMedia *RoomMediaResponse
+		var userMedia *UserMediaResponse
+		inspectRoomId := ""
+		inspectUserId := ""
+
+		if request.Method == "POST" {
+			options = parseMediaCleanupOptions(request, options)
+
+			switch request.PostFormValue("action") {
+			case "start":
+				err := startMediaCleanup(app.DB, options)
+				if err != nil {
+					log.Printf("can't start media cleanup: %s\n", err)
+					app.setFlash(responseWriter, session, "error", "an error occurred starting the media cleanup")
+				} else {
+					appendAuditLog(session.UserID, AuditActionMediaCleanupStarted, "", fmt.Sprintf("%+v", options))
+				}
+				http.Redirect(responseWriter, request, "/media", http.StatusFound)
+				return
+			case "dryrun":
+				dryRunReport, err := buildMediaCleanupReport(app.DB, options)
+				if err != nil {
+					app.unhandledError(responseWriter, request, err)
+					return
+				}
+				report = &dryRunReport
+			case "inspectRoom":
+				inspectRoomId = strings.TrimSpace(request.PostFormValue("roomId"))
+				media, err := matrixAdmin.GetRoomMedia(inspectRoomId)
+				if err != nil {
+					log.Printf("can't get media for room %s: %s\n", inspectRoomId, err)
+					(*session.Flash)["error"] = fmt.Sprintf("an error occurred listing the media in %s", inspectRoomId)
+				} else {
+					roomMedia = &media
+				}
+			case "inspectUser":
+				inspectUserId = strings.TrimSpace(request.PostFormValue("userId"))
+				media, err := matrixAdmin.GetUserMedia(inspectUserId, 100)
+				if err != nil {
+					log.Printf("can't get media for user %s: %s\n", inspectUserId, err)
+					(*session.Flash)["error"] = fmt.Sprintf("an error occurred listing the media uploaded by %s", inspectUserId)
+				} else {
+					userMedia = &media
+				}
+			}
+		}
+
+		lastCleanup, err := ReadJsonFile[MediaCleanupProgress]("data/lastMediaCleanup.json")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading lastMediaCleanup json"
+		}
+
+		mediaTemplateData := struct {
+			Options       MediaCleanupOptions
+			Report        *MediaCleanupReport
+			LastCleanup   MediaCleanupProgress
+			InspectRoomId string
+			RoomMedia     *RoomMediaResponse
+			InspectUserId string
+			UserMedia     *UserMediaResponse
+		}{options, report, lastCleanup, inspectRoomId, roomMedia, inspectUserId, userMedia}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "media.html", mediaTemplateData)
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// registerMetricsRoutes serves the data that runScheduledTask and doRoomDeletes save to data/
+// in the prometheus text exposition format, see https://prometheus.io/docs/instrumenting/exposition_formats/
+func registerMetricsRoutes(app *FrontendApp, config *Config) {
+
+	topRooms := config.MetricsTopRooms
+	if topRooms <= 0 {
+		topRooms = 20
+	}
+
+	app.Router.HandleFunc("/metrics", func(responseWriter http.ResponseWriter, request *http.Request) {
+		// without a MetricsToken nobody gets in, unless MetricsAllowUnauthenticated says that everyone can
+		authorized := config.MetricsToken == "" && config.MetricsAllowUnauthenticated
+		if config.MetricsToken != "" {
+			expected := []byte(fmt.Sprintf("Bearer %s", config.MetricsToken))
+			authorized = subtle.ConstantTimeCompare(expected, []byte(request.Header.Get("Authorization"))) == 1
+		}
+		if !authorized {
+			responseWriter.Header().Add("Content-Type", "text/plain")
+			responseWriter.WriteHeader(http.StatusUnauthorized)
+			responseWriter.Write([]byte("401 unauthorized"))
+			return
+		}
+
+		metrics := &bytes.Buffer{}
+
+		diskUsage, err := ReadJsonFile[DiskUsage]("data/diskUsage.json")
+		if err != nil {
+			log.Printf("ERROR!: /metrics can't read data/diskUsage.json: %s\n", err)
+		} else {
+			writeMetricHeader(metrics, "janitor_disk_bytes", "gauge", "disk usage measured by the last scheduled task, by category")
+			freeBytes := diskUsage.DiskSizeBytes - (diskUsage.PostgresBytes + diskUsage.MediaBytes + diskUsage.OtherBytes)
+			writeMetric(metrics, "janitor_disk_bytes", map[string]string{"category": "postgres"}, float64(diskUsage.PostgresBytes))
+			writeMetric(metrics, "janitor_disk_bytes", map[string]string{"category": "media"}, float64(diskUsage.MediaBytes))
+			writeMetric(metrics, "janitor_disk_bytes", map[string]string{"category": "other"}, float64(diskUsage.OtherBytes))
+			writeMetric(metrics, "janitor_disk_bytes", map[string]string{"category": "free"}, float64(freeBytes))
+
+			writeMetricHeader(metrics, "janitor_disk_size_bytes", "gauge", "total size of the disk")
+			writeMetric(metrics, "janitor_disk_size_bytes", nil, float64(diskUsage.DiskSizeBytes))
+		}
+
+		tables, err := ReadJsonFile[[]DBTableSize]("data/dbTableSizes.json")
+		if err != nil {
+			log.Printf("ERROR!: /metrics can't read data/dbTableSizes.json: %s\n", err)
+		} else {
+			writeMetricHeader(metrics, "janitor_db_table_bytes", "gauge", "size of each database table")
+			for _, table := range tables {
+				writeMetric(metrics, "janitor_db_table_bytes", map[string]string{"schema": table.Schema, "table": table.Name}, float64(table.Bytes))
+			}
+			writeMetricHeader(metrics, "janitor_db_table_total_bytes", "gauge", "size of each database table including indexes and TOAST")
+			for _, table := range tables {
+				writeMetric(metrics, "janitor_db_table_total_bytes", map[string]string{"schema": table.Schema, "table": table.Name}, float64(table.TotalBytes))
+			}
+			writeMetricHeader(metrics, "janitor_db_table_dead_tuples", "gauge", "dead tuples in each database table according to pg_stat_user_tables")
+			for _, table := range tables {
+				writeMetric(metrics, "janitor_db_table_dead_tuples", map[string]string{"schema": table.Schema, "table": table.Name}, float64(table.DeadTuples))
+			}
+			writeMetricHeader(metrics, "janitor_db_table_bloat_bytes", "gauge", "estimated space in each database table that a VACUUM FULL would give back")
+			for _, table := range tables {
+				writeMetric(metrics, "janitor_db_table_bloat_bytes", map[string]string{"schema": table.Schema, "table": table.Name}, float64(table.EstimatedBloatBytes))
+			}
+		}
+
+		rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+		if err != nil {
+			log.Printf("ERROR!: /metrics can't read data/stateGroupsStateRowCountByRoom.json: %s\n", err)
+		}
+		scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+		if err != nil {
+			log.Printf("ERROR!: /metrics can't read data/stateGroupsStateScan.json: %s\n", err)
+		}
+		if rowCountByRoom != nil {
+			roomIds := []string{}
+			totalRows := 0
+			for roomId, rows := range rowCountByRoom {
+				roomIds = append(roomIds, roomId)
+				totalRows += rows
+			}
+			sort.Slice(roomIds, func(i, j int) bool {
+				return rowCountByRoom[roomIds[i]] > rowCountByRoom[roomIds[j]]
+			})
+			if len(roomIds) > topRooms {
+				roomIds = roomIds[:topRooms]
+			}
+
+			writeMetricHeader(metrics, "janitor_state_groups_state_rows", "gauge", "total number of rows counted in state_groups_state")
+			writeMetric(metrics, "janitor_state_groups_state_rows", nil, float64(totalRows))
+
+			writeMetricHeader(metrics, "janitor_room_state_groups_state_rows", "gauge", "number of state_groups_state rows for the rooms with the most rows")
+			for _, roomId := range roomIds {
+				estimated := "false"
+				if scanState.EstimatedRoomIds[roomId] {
+					estimated = "true"
+				}
+				writeMetric(metrics, "janitor_room_state_groups_state_rows", map[string]string{"room_id": roomId, "estimated": estimated}, float64(rowCountByRoom[roomId]))
+			}
+		}
+
+		janitorState, err := ReadJsonFile[JanitorState]("data/janitorState.json")
+		if err != nil {
+			log.Printf("ERROR!: /metrics can't read data/janitorState.json: %s\n", err)
+		} else {
+			writeMetricHeader(metrics, "janitor_scheduled_task_running", "gauge", "1 if the scheduled task is running right now")
+			writeMetric(metrics, "janitor_scheduled_task_running", nil, boolToFloat(isRunningScheduledTask))
+
+			writeMetricHeader(metrics, "janitor_scheduled_task_last_run_timestamp_seconds", "gauge", "when the scheduled task last completed")
+			writeMetric(metrics, "janitor_scheduled_task_last_run_timestamp_seconds", nil, float64(janitorState.LastScheduledTaskRunUnixMilli)/1000)
+
+			writeMetricHeader(metrics, "janitor_scheduled_task_duration_seconds", "gauge", "how long the last scheduled task took")
+			writeMetric(metrics, "janitor_scheduled_task_duration_seconds", nil, float64(janitorState.LastScheduledTaskDurationMilli)/1000)
+
+			writeMetricHeader(metrics, "janitor_state_groups_state_scan_last_success_timestamp_seconds", "gauge", "when state_groups_state was last counted successfully")
+			writeMetric(metrics, "janitor_state_groups_state_scan_last_success_timestamp_seconds", nil, float64(janitorState.LastStateGroupsStateScanSuccessUnixMilli)/1000)
+
+			writeMetricHeader(metrics, "janitor_state_groups_state_scan_duration_seconds", "gauge", "how long the last state_groups_state count took")
+			writeMetric(metrics, "janitor_state_groups_state_scan_duration_seconds", nil, float64(janitorState.LastStateGroupsStateScanDurationMilli)/1000)
+
+			writeMetricHeader(metrics, "janitor_state_groups_state_last_full_scan_timestamp_seconds", "gauge", "when state_groups_state was last counted in full")
+			writeMetric(metrics, "janitor_state_groups_state_last_full_scan_timestamp_seconds", nil, float64(scanState.LastFullScanUnixMilli)/1000)
+		}
+
+		deleteProgress, err := ReadJsonFile[DeleteProgress]("data/deleteRooms.json")
+		if err != nil {
+			log.Printf("ERROR!: /metrics can't read data/deleteRooms.json: %s\n", err)
+		} else {
+			roomsPending := 0
+			for _, room := range deleteProgress.Rooms {
+				if room.Status != "complete" {
+					roomsPending++
+				}
+			}
+
+			writeMetricHeader(metrics, "janitor_delete_in_progress", "gauge", "1 if rooms are being deleted right now")
+			writeMetric(metrics, "janitor_delete_in_progress", nil, boolToFloat(isDoingDeletes()))
+
+			writeMetricHeader(metrics, "janitor_delete_rooms", "gauge", "number of rooms in the current delete job")
+			writeMetric(metrics, "janitor_delete_rooms", nil, float64(len(deleteProgress.Rooms)))
+
+			writeMetricHeader(metrics, "janitor_delete_rooms_pending", "gauge", "number of rooms in the current delete job that synapse has not finished deleting")
+			writeMetric(metrics, "janitor_delete_rooms_pending", nil, float64(roomsPending))
+
+			writeMetricHeader(metrics, "janitor_delete_state_groups", "gauge", "number of state groups the current delete job has to remove from state_groups_state")
+			writeMetric(metrics, "janitor_delete_state_groups", nil, float64(deleteProgress.StateGroupsToDelete))
+
+			writeMetricHeader(metrics, "janitor_delete_state_groups_deleted", "gauge", "number of state groups removed from state_groups_state so far")
+			writeMetric(metrics, "janitor_delete_state_groups_deleted", nil, float64(deleteProgress.StateGroupsStateStatus.StateGroupsDeleted))
+
+			writeMetricHeader(metrics, "janitor_delete_rows_deleted", "gauge", "number of state_groups_state rows deleted so far")
+			writeMetric(metrics, "janitor_delete_rows_deleted", nil, float64(deleteProgress.StateGroupsStateStatus.RowsDeleted))
+
+			writeMetricHeader(metrics, "janitor_delete_errors", "gauge", "number of failed state_groups_state delete statements")
+			writeMetric(metrics, "janitor_delete_errors", nil, float64(deleteProgress.StateGroupsStateStatus.Errors))
+		}
+
+		responseWriter.Header().Add("Content-Type", "text/plain; version=0.0.4")
+		responseWriter.Write(metrics.Bytes())
+	})
+}
+
+func writeMetricHeader(buffer *bytes.Buffer, name, metricType, help string) {
+	fmt.Fprintf(buffer, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buffer, "# TYPE %s %s\n", name, metricType)
+}
+
+func writeMetric(buffer *bytes.Buffer, name string, labels map[string]string, value float64) {
+	if len(labels) == 0 {
+		fmt.Fprintf(buffer, "%s %g\n", name, value)
+		return
+	}
+
+	labelNames := []string{}
+	for labelName := range labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+
+	labelStrings := []string{}
+	for _, labelName := range labelNames {
+		labelStrings = append(labelStrings, fmt.Sprintf("%s=\"%s\"", labelName, escapeMetricLabelValue(labels[labelName])))
+	}
+	fmt.Fprintf(buffer, "%s{%s} %g\n", name, strings.Join(labelStrings, ","), value)
+}
+
+func escapeMetricLabelValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+func boolToFloat(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+type OrphanedRoom struct {
+	RoomId               string
+	StateGroups          int64
+	StateGroupsStateRows int64
+	EstimatedBytes       int64
+}
+
+type OrphanScan struct {
+	ScannedUnixMilli     int64
+	DurationMilli        int64
+	Rooms                []OrphanedRoom
+	StateGroups          int64
+	StateGroupsStateRows int64
+	EstimatedBytes       int64
+	Error                string
+}
+
+// orphanScan is locked while the running flag is checked and changed, so two admins pressing scan at the same time
+// can't both start one
+var orphanScan = struct {
+	sync.Mutex
+	running bool
+}{}
+
+func isScanningOrphans() bool {
+	orphanScan.Lock()
+	defer orphanScan.Unlock()
+	return orphanScan.running
+}
+
+// startOrphanScan returns false when a scan is running already
+func startOrphanScan() bool {
+	orphanScan.Lock()
+	defer orphanScan.Unlock()
+	if orphanScan.running {
+		return false
+	}
+	orphanScan.running = true
+	return true
+}
+
+// scanOrphanedStateGroups finds state groups whose room is gone from the rooms table and saves what it found to
+// data/orphanedStateGroups.json. Rooms that the current or a queued delete job is working on are left out, the jobs will get to them.
+func scanOrphanedStateGroups(db *DBModel) (OrphanScan, error) {
+	scanStartTime := time.Now()
+	scan := OrphanScan{Rooms: []OrphanedRoom{}}
+
+	inDeleteJob, err := getDeleteJobRoomIds()
+	if err != nil {
+		return scan, err
+	}
+
+	log.Println("scanOrphanedStateGroups(): counting state groups for rooms that don't exist anymore...")
+	countByRoom, err := db.GetOrphanedStateGroupCountByRoom()
+	if err != nil {
+		return scan, err
+	}
+
+	bytesPerRow, err := getStateGroupTablesBytesPerRow(db)
+	if err != nil {
+		return scan, errors.Wrap(err, "can't estimate the size of orphaned state groups")
+	}
+
+	for roomId, stateGroups := range countByRoom {
+		if inDeleteJob[roomId] {
+			continue
+		}
+		rows, err := db.CountStateGroupsStateRowsForRoom(roomId)
+		if err != nil {
+			return scan, err
+		}
+		room := OrphanedRoom{
+			RoomId:               roomId,
+			StateGroups:          stateGroups,
+			StateGroupsStateRows: rows,
+			EstimatedBytes: int64(
+				float64(stateGroups)*bytesPerRow["state_groups"] + float64(rows)*bytesPerRow["state_groups_state"],
+			),
+		}
+		scan.Rooms = append(scan.Rooms, room)
+		scan.StateGroups += room.StateGroups
+		scan.StateGroupsStateRows += room.StateGroupsStateRows
+		scan.EstimatedBytes += room.EstimatedBytes
+	}
+	sort.Slice(scan.Rooms, func(i, j int) bool {
+		return scan.Rooms[i].StateGroupsStateRows > scan.Rooms[j].StateGroupsStateRows
+	})
+
+	scan.ScannedUnixMilli = time.Now().UnixMilli()
+	scan.DurationMilli = time.Since(scanStartTime).Milliseconds()
+	log.Printf("scanOrphanedStateGroups(): found %d state groups for %d rooms that don't exist\n", scan.StateGroups, len(scan.Rooms))
+
+	return scan, WriteJsonFile("data/orphanedStateGroups.json", scan)
+}
+
+// queueOrphanPurge saves a delete job for rooms that synapse has already forgotten about. The job starts at
+// DeletePhaseCollectStateGroups, since there is nothing left to shut down, and then goes through the same
+// state group deletion pipeline as any other delete job.
+// The scan may be hours old, so every room is checked against the rooms table again here, and once more by
+// doRoomDeletes right before it collects the state groups.
+// The returned bool is true when the job is the current one instead of waiting behind another job.
+func queueOrphanPurge(db *DBModel, config *Config, roomIds []string, submittedBy string) (DeleteProgress, bool, error) {
+	scan, err := ReadJsonFile[OrphanScan]("data/orphanedStateGroups.json")
+	if err != nil {
+		return DeleteProgress{}, false, err
+	}
+	orphaned := map[string]bool{}
+	for _, room := range scan.Rooms {
+		orphaned[room.RoomId] = true
+	}
+	existing, err := db.GetExistingRoomIds(roomIds)
+	if err != nil {
+		return DeleteProgress{}, false, err
+	}
+
+	rooms := []MatrixRoom{}
+	for _, roomId := range roomIds {
+		if !orphaned[roomId] {
+			return DeleteProgress{}, false, fmt.Errorf("%s was not found by the last orphaned state groups scan", roomId)
+		}
+		if existing[roomId] {
+			return DeleteProgress{}, false, fmt.Errorf("%s exists again since the last orphaned state groups scan, its state groups are in use", roomId)
+		}
+		rooms = append(rooms, MatrixRoom{
+			Id:         roomId,
+			IdWithName: fmt.Sprintf("%s: (orphaned state groups)", roomId),
+			Status:     "complete",
+		})
+	}
+	rooms, refused, err := removeProtectedRooms(db, config, rooms)
+	if err != nil {
+		return DeleteProgress{}, false, err
+	}
+	for _, message := range refused {
+		log.Printf("queueOrphanPurge(): %s\n", message)
+	}
+	if len(rooms) == 0 {
+		return DeleteProgress{}, false, errors.New("all of the rooms are protected")
+	}
+
+	return enqueueDeleteJob(DeleteProgress{
+		Rooms:       rooms,
+		Phase:       DeletePhaseCollectStateGroups,
+		SubmittedBy: submittedBy,
+		// synapse has already forgotten these rooms, so there is nobody to send a shutdown message to
+		DeleteJobReason: DeleteJobReason{Reason: "purge orphaned state groups"},
+	})
+}
+
+func registerOrphanRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/orphans", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		if request.Method == "POST" {
+			switch request.PostFormValue("action") {
+			case "scan":
+				if startOrphanScan() {
+					appendAuditLog(session.UserID, AuditActionOrphanScan, "", "")
+					go func() {
+						defer func() {
+							orphanScan.Lock()
+							orphanScan.running = false
+							orphanScan.Unlock()
+						}()
+						_, err := scanOrphanedStateGroups(app.DB)
+						if err != nil {
+							log.Printf("ERROR!: can't scan for orphaned state groups: %s\n", err)
+							err = WriteJsonFile("data/orphanedStateGroups.json", OrphanScan{
+								ScannedUnixMilli: time.Now().UnixMilli(),
+								Rooms:            []OrphanedRoom{},
+								Error:            err.Error(),
+							})
+							if err != nil {
+								log.Printf("ERROR!: can't write data/orphanedStateGroups.json: %s\n", err)
+							}
+						}
+					}()
+				}
+			case "purge":
+				request.ParseForm()
+				roomIds := request.PostForm["roomId"]
+				if len(roomIds) == 0 {
+					app.setFlash(responseWriter, session, "error", "no rooms were selected")
+					http.Redirect(responseWriter, request, "/orphans", http.StatusFound)
+					return
+				}
+				job, startNow, err := queueOrphanPurge(app.DB, config, roomIds, session.UserID)
+				if err != nil {
+					log.Printf("can't purge orphaned state groups: %s\n", err)
+					app.setFlash(responseWriter, session, "error", err.Error())
+					http.Redirect(responseWriter, request, "/orphans", http.StatusFound)
+					return
+				}
+				log.Printf("%s started purging orphaned state groups for %d rooms\n", session.UserID, len(roomIds))
+				if startNow {
+					go doRoomDeletes(app.DB, config)
+				} else {
+					app.setFlash(responseWriter, session, "info", fmt.Sprintf("delete job %s is queued behind another delete job", job.Id))
+				}
+				http.Redirect(responseWriter, request, "/", http.StatusFound)
+				return
+			}
+			http.Redirect(responseWriter, request, "/orphans", http.StatusFound)
+			return
+		}
+
+		scan, err := ReadJsonFile[OrphanScan]("data/orphanedStateGroups.json")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading orphanedStateGroups json"
+		}
+
+		orphansTemplateData := struct {
+			Scanning bool
+			Scan     OrphanScan
+		}{isScanningOrphans(), scan}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "orphans.html", orphansTemplateData)
+	})
+}
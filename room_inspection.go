@@ -0,0 +1,157 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+type EventTypeCount struct {
+	Type  string
+	Count int64
+}
+
+type RoomServer struct {
+	Server  string
+	Members int
+}
+
+type RoomInspection struct {
+	RoomId string
+	// Found is false when synapse doesn't know about the room, the database numbers can still be there
+	Found            bool
+	Details          RoomDetails
+	Protected        bool
+	ProtectedBecause string
+
+	LocalMembers  []string
+	RemoteMembers int
+	Servers       []RoomServer
+
+	StateGroups          int64
+	StateGroupsStateRows int64
+	StateRowsByType      []EventTypeCount
+	Events               int64
+	EventsByType         []EventTypeCount
+	OldestEventUnixMilli int64
+	NewestEventUnixMilli int64
+}
+
+// inspectRoom gathers what we look at before deciding whether to delete a room
+func inspectRoom(db *DBModel, config *Config, roomId string) (RoomInspection, error) {
+	inspection := RoomInspection{
+		RoomId:          roomId,
+		LocalMembers:    []string{},
+		Servers:         []RoomServer{},
+		StateRowsByType: []EventTypeCount{},
+		EventsByType:    []EventTypeCount{},
+	}
+
+	details, err := matrixAdmin.GetRoomDetails(roomId)
+	if err != nil {
+		return inspection, errors.Wrap(err, "can't get room details")
+	}
+	inspection.Found = details.RoomId != ""
+	inspection.Details = details
+
+	protection, err := getRoomProtection(db, config)
+	if err != nil {
+		return inspection, err
+	}
+	inspection.Protected, inspection.ProtectedBecause = protection.isRoomProtected(roomId)
+
+	if inspection.Found {
+		members, err := matrixAdmin.GetRoomMembers(roomId)
+		if err != nil {
+			return inspection, errors.Wrap(err, "can't get room members")
+		}
+		membersByServer := map[string]int{}
+		for _, member := range members {
+			server := member[strings.Index(member, ":")+1:]
+			membersByServer[server]++
+			if server == config.MatrixServerPublicDomain {
+				inspection.LocalMembers = append(inspection.LocalMembers, member)
+			} else {
+				inspection.RemoteMembers++
+			}
+		}
+		for server, count := range membersByServer {
+			inspection.Servers = append(inspection.Servers, RoomServer{Server: server, Members: count})
+		}
+		sort.Slice(inspection.Servers, func(i, j int) bool {
+			if inspection.Servers[i].Members == inspection.Servers[j].Members {
+				return inspection.Servers[i].Server < inspection.Servers[j].Server
+			}
+			return inspection.Servers[i].Members > inspection.Servers[j].Members
+		})
+		sort.Strings(inspection.LocalMembers)
+	}
+
+	inspection.StateGroups, err = db.CountStateGroupsForRoom(roomId)
+	if err != nil {
+		return inspection, err
+	}
+	stateRowsByType, err := db.GetStateGroupsStateRowCountByTypeForRoom(roomId)
+	if err != nil {
+		return inspection, err
+	}
+	inspection.StateRowsByType, inspection.StateGroupsStateRows = sortEventTypeCounts(stateRowsByType)
+
+	eventsByType, err := db.GetEventCountByTypeForRoom(roomId)
+	if err != nil {
+		return inspection, err
+	}
+	inspection.EventsByType, inspection.Events = sortEventTypeCounts(eventsByType)
+
+	inspection.OldestEventUnixMilli, inspection.NewestEventUnixMilli, err = db.GetEventTimeRangeForRoom(roomId)
+	if err != nil {
+		return inspection, err
+	}
+
+	return inspection, nil
+}
+
+// sortEventTypeCounts returns the counts biggest first, along with their sum
+func sortEventTypeCounts(countByType map[string]int64) ([]EventTypeCount, int64) {
+	counts := []EventTypeCount{}
+	total := int64(0)
+	for eventType, count := range countByType {
+		counts = append(counts, EventTypeCount{Type: eventType, Count: count})
+		total += count
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].Count > counts[j].Count
+	})
+	return counts, total
+}
+
+func registerRoomInspectionRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/rooms/", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		roomId := strings.TrimPrefix(request.URL.Path, "/rooms/")
+		if roomId == "" {
+			http.Redirect(responseWriter, request, "/rooms", http.StatusFound)
+			return
+		}
+		if !strings.HasPrefix(roomId, "!") {
+			app.setFlash(responseWriter, session, "error", "that is not a room id")
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		inspection, err := inspectRoom(app.DB, config, roomId)
+		if err != nil {
+			log.Printf("can't inspect %s: %s\n", roomId, err)
+			(*session.Flash)["error"] = err.Error()
+		}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "room.html", inspection)
+	})
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const roomListPageSize = 50
+
+type RoomListFilter struct {
+	Search          string
+	MinRows         int
+	MinLocalMembers int
+	// MaxLocalMembers is -1 when there is no maximum
+	MaxLocalMembers int
+	Sort            string
+	Ascending       bool
+	Page            int
+}
+
+type RoomListEntry struct {
+	Id           string
+	Name         string
+	Rows         int
+	Percent      float64
+	Estimated    bool
+	Members      int
+	LocalMembers int
+	Protected    bool
+	Denylisted   bool
+	Selected     bool
+	Ban          bool
+	Rejoin       bool
+}
+
+type RoomSelection struct {
+	Ban    bool
+	Rejoin bool
+}
+
+// the rooms each admin has picked on the /rooms page, by user id, so the selection survives going to another page
+type RoomSelections map[string]map[string]RoomSelection
+
+func parseRoomListFilter(values url.Values) RoomListFilter {
+	filter := RoomListFilter{
+		Search:          strings.TrimSpace(values.Get("search")),
+		MaxLocalMembers: -1,
+		Sort:            values.Get("sort"),
+		Ascending:       values.Get("order") == "asc",
+		Page:            1,
+	}
+	if parsed, err := strconv.Atoi(values.Get("minRows")); err == nil && parsed > 0 {
+		filter.MinRows = parsed
+	}
+	if parsed, err := strconv.Atoi(values.Get("minLocalMembers")); err == nil && parsed > 0 {
+		filter.MinLocalMembers = parsed
+	}
+	if parsed, err := strconv.Atoi(values.Get("maxLocalMembers")); err == nil && parsed >= 0 {
+		filter.MaxLocalMembers = parsed
+	}
+	if parsed, err := strconv.Atoi(values.Get("page")); err == nil && parsed > 1 {
+		filter.Page = parsed
+	}
+	switch filter.Sort {
+	case "name", "members", "localMembers":
+	default:
+		filter.Sort = "rows"
+	}
+	return filter
+}
+
+// URL links to the same filter on another page
+func (filter RoomListFilter) URL(page int) string {
+	values := url.Values{}
+	if filter.Search != "" {
+		values.Set("search", filter.Search)
+	}
+	if filter.MinRows > 0 {
+		values.Set("minRows", strconv.Itoa(filter.MinRows))
+	}
+	if filter.MinLocalMembers > 0 {
+		values.Set("minLocalMembers", strconv.Itoa(filter.MinLocalMembers))
+	}
+	if filter.MaxLocalMembers >= 0 {
+		values.Set("maxLocalMembers", strconv.Itoa(filter.MaxLocalMembers))
+	}
+	values.Set("sort", filter.Sort)
+	if filter.Ascending {
+		values.Set("order", "asc")
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	return fmt.Sprintf("/rooms?%s", values.Encode())
+}
+
+// SortURL links to the list sorted by the given column, sorting by the current column again flips the order
+func (filter RoomListFilter) SortURL(column string) string {
+	sorted := filter
+	sorted.Ascending = column == filter.Sort && !filter.Ascending
+	sorted.Sort = column
+	return sorted.URL(1)
+}
+
+// MaxLocalMembersValue is what goes in the form field, which is empty when there is no maximum
+func (filter RoomListFilter) MaxLocalMembersValue() string {
+	if filter.MaxLocalMembers < 0 {
+		return ""
+	}
+	return strconv.Itoa(filter.MaxLocalMembers)
+}
+
+// listRooms returns every room that the state_groups_state scan counted that matches the filter, sorted.
+// Whether the rooms are protected is left out, markProtectedRooms fills that in for the rooms on the page.
+func listRooms(db *DBModel, config *Config, filter RoomListFilter, selection map[string]RoomSelection) ([]RoomListEntry, error) {
+	rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		return nil, err
+	}
+	scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+	if err != nil {
+		return nil, err
+	}
+	statsByRoom, err := db.GetRoomStats()
+	if err != nil {
+		return nil, err
+	}
+
+	roomIds, totalRows := rankRoomsByRows(rowCountByRoom)
+	search := strings.ToLower(filter.Search)
+
+	rooms := []RoomListEntry{}
+	for _, roomId := range roomIds {
+		stats := statsByRoom[roomId]
+		rows := rowCountByRoom[roomId]
+		if rows < filter.MinRows || stats.LocalMembers < filter.MinLocalMembers {
+			continue
+		}
+		if filter.MaxLocalMembers >= 0 && stats.LocalMembers > filter.MaxLocalMembers {
+			continue
+		}
+		if search != "" &&
+			!strings.Contains(strings.ToLower(roomId), search) &&
+			!strings.Contains(strings.ToLower(stats.CanonicalAlias), search) &&
+			!strings.Contains(strings.ToLower(stats.Name), search) {
+			continue
+		}
+
+		name := stats.CanonicalAlias
+		if name == "" {
+			name = stats.Name
+		}
+		percent := float64(0)
+		if totalRows > 0 {
+			percent = (float64(rows) / float64(totalRows)) * float64(100)
+		}
+		selected, isSelected := selection[roomId]
+		rooms = append(rooms, RoomListEntry{
+			Id:           roomId,
+			Name:         name,
+			Rows:         rows,
+			Percent:      percent,
+			Estimated:    scanState.EstimatedRoomIds[roomId],
+			Members:      stats.JoinedMembers,
+			LocalMembers: stats.LocalMembers,
+			Selected:     isSelected,
+			Ban:          selected.Ban,
+			Rejoin:       selected.Rejoin,
+		})
+	}
+
+	// rankRoomsByRows already sorted them by rows, biggest first, which decides between rooms that are equal here
+	sort.SliceStable(rooms, func(i, j int) bool {
+		compared := 0
+		switch filter.Sort {
+		case "name":
+			compared = strings.Compare(strings.ToLower(rooms[i].Name), strings.ToLower(rooms[j].Name))
+		case "members":
+			compared = rooms[i].Members - rooms[j].Members
+		case "localMembers":
+			compared = rooms[i].LocalMembers - rooms[j].LocalMembers
+		default:
+			compared = rooms[i].Rows - rooms[j].Rows
+		}
+		if filter.Ascending {
+			return compared < 0
+		}
+		return compared > 0
+	})
+
+	return rooms, nil
+}
+
+// markProtectedRooms sets Protected and Denylisted on the rooms, looking up all of their aliases with one query
+func markProtectedRooms(db *DBModel, config *Config, rooms []RoomListEntry) error {
+	protection, err := getRoomProtection(db, config)
+	if err != nil {
+		return err
+	}
+	roomIds := []string{}
+	for _, room := range rooms {
+		roomIds = append(roomIds, room.Id)
+	}
+	err = protection.loadAliases(roomIds, false)
+	if err != nil {
+		// isRoomProtected marks the rooms as protected when their aliases can't be checked
+		log.Printf("markProtectedRooms(): can't load the aliases of %d rooms: %s\n", len(roomIds), err)
+	}
+	for i, room := range rooms {
+		rooms[i].Protected, _ = protection.isRoomProtected(room.Id)
+		rooms[i].Denylisted = !rooms[i].Protected && protection.isRoomDenylisted(room.Id)
+	}
+	return nil
+}
+
+func getRoomSelection(userId string) (map[string]RoomSelection, error) {
+	selections, err := ReadJsonFile[RoomSelections]("data/roomSelections.json")
+	if err != nil {
+		return nil, err
+	}
+	if selections[userId] == nil {
+		return map[string]RoomSelection{}, nil
+	}
+	return selections[userId], nil
+}
+
+func saveRoomSelection(userId string, selection map[string]RoomSelection) error {
+	selections, err := ReadJsonFile[RoomSelections]("data/roomSelections.json")
+	if err != nil {
+		return err
+	}
+	if selections == nil {
+		selections = RoomSelections{}
+	}
+	if len(selection) == 0 {
+		delete(selections, userId)
+	} else {
+		selections[userId] = selection
+	}
+	return WriteJsonFile("data/roomSelections.json", selections)
+}
+
+func registerRoomListRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/rooms", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		selection, err := getRoomSelection(session.UserID)
+		if err != nil {
+			app.unhandledError(responseWriter, request, err)
+			return
+		}
+
+		if request.Method == "POST" {
+			request.ParseForm()
+			filter := parseRoomListFilter(request.PostForm)
+
+			// only the rooms on the page that was submitted can change, the ones picked on other pages stay selected
+			for _, roomId := range request.PostForm["listed"] {
+				delete(selection, roomId)
+			}
+			for _, roomId := range request.PostForm["select"] {
+				selection[roomId] = RoomSelection{}
+			}
+			for _, roomId := range request.PostForm["ban"] {
+				if _, isSelected := selection[roomId]; isSelected {
+					selection[roomId] = RoomSelection{Ban: true}
+				}
+			}
+			for _, roomId := range request.PostForm["rejoin"] {
+				if selected, isSelected := selection[roomId]; isSelected && !selected.Ban {
+					selection[roomId] = RoomSelection{Rejoin: true}
+				}
+			}
+			if request.PostFormValue("action") == "clear" {
+				selection = map[string]RoomSelection{}
+			}
+			err = saveRoomSelection(session.UserID, selection)
+			if err != nil {
+				app.unhandledError(responseWriter, request, err)
+				return
+			}
+
+			if request.PostFormValue("action") != "delete" {
+				page, err := strconv.Atoi(request.PostFormValue("goto"))
+				if err != nil {
+					page = filter.Page
+				}
+				http.Redirect(responseWriter, request, filter.URL(page), http.StatusFound)
+				return
+			}
+
+			roomIds := []string{}
+			for roomId := range selection {
+				roomIds = append(roomIds, roomId)
+			}
+			sort.Strings(roomIds)
+			toDelete := []MatrixRoom{}
+			for _, roomId := range roomIds {
+				toDelete = append(toDelete, MatrixRoom{
+					Id:         roomId,
+					Ban:        selection[roomId].Ban,
+					Rejoin:     selection[roomId].Rejoin,
+					IdWithName: fmt.Sprintf("%s: %s", roomId, app.getMatrixRoomNameWithCache(roomId)),
+					Status:     "...",
+				})
+			}
+			toDelete, refused, err := removeProtectedRooms(app.DB, config, toDelete)
+			if err != nil {
+				app.unhandledError(responseWriter, request, err)
+				return
+			}
+			if len(toDelete) == 0 {
+				app.setFlash(responseWriter, session, "error", strings.Join(append(refused, "no rooms were selected"), "\n"))
+				http.Redirect(responseWriter, request, filter.URL(filter.Page), http.StatusFound)
+				return
+			}
+			if len(refused) > 0 {
+				(*session.Flash)["error"] = strings.Join(refused, "\n")
+			}
+
+			// the confirm form posts to / like the one on the panel does
+			report, err := buildDeletionReport(app.DB, toDelete)
+			if err != nil {
+				app.unhandledError(responseWriter, request, err)
+				return
+			}
+			app.buildDeleteConfirmationPage(responseWriter, request, session, config, report, defaultDeleteJobReason(config), "")
+			return
+		}
+
+		filter := parseRoomListFilter(request.URL.Query())
+		rooms, err := listRooms(app.DB, config, filter, selection)
+		if err != nil {
+			log.Printf("can't list rooms: %s\n", err)
+			(*session.Flash)["error"] = "an error occurred listing the rooms"
+		}
+
+		pages := (len(rooms) + roomListPageSize - 1) / roomListPageSize
+		if filter.Page > pages && pages > 0 {
+			filter.Page = pages
+		}
+		start := (filter.Page - 1) * roomListPageSize
+		end := start + roomListPageSize
+		if end > len(rooms) {
+			end = len(rooms)
+		}
+		if start > end {
+			start = end
+		}
+		err = markProtectedRooms(app.DB, config, rooms[start:end])
+		if err != nil {
+			log.Printf("can't check which rooms are protected: %s\n", err)
+			(*session.Flash)["error"] = "an error occurred reading roomProtection json"
+		}
+
+		previousPage := ""
+		if filter.Page > 1 {
+			previousPage = strconv.Itoa(filter.Page - 1)
+		}
+		nextPage := ""
+		if filter.Page < pages {
+			nextPage = strconv.Itoa(filter.Page + 1)
+		}
+
+		roomListTemplateData := struct {
+			Filter       RoomListFilter
+			Rooms        []RoomListEntry
+			Matched      int
+			Page         int
+			Pages        int
+			PreviousPage string
+			NextPage     string
+			Selected     int
+		}{
+			filter, rooms[start:end], len(rooms), filter.Page, pages, previousPage, nextPage, len(selection),
+		}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "rooms.html", roomListTemplateData)
+	})
+}
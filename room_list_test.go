@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseRoomListFilter(t *testing.T) {
+	testCases := []struct {
+		name   string
+		query  string
+		filter RoomListFilter
+	}{
+		{
+			name:   "defaults",
+			query:  "",
+			filter: RoomListFilter{MaxLocalMembers: -1, Sort: "rows", Page: 1},
+		},
+		{
+			name:  "everything set",
+			query: "search=+spam+&minRows=100&minLocalMembers=2&maxLocalMembers=0&sort=members&order=asc&page=3",
+			filter: RoomListFilter{
+				Search: "spam", MinRows: 100, MinLocalMembers: 2, MaxLocalMembers: 0, Sort: "members", Ascending: true, Page: 3,
+			},
+		},
+		{
+			name:   "unknown sort",
+			query:  "sort=DROP+TABLE&order=desc",
+			filter: RoomListFilter{MaxLocalMembers: -1, Sort: "rows", Page: 1},
+		},
+		{
+			name:   "numbers that don't parse or are out of range",
+			query:  "minRows=lots&minLocalMembers=-5&maxLocalMembers=-1&page=0",
+			filter: RoomListFilter{MaxLocalMembers: -1, Sort: "rows", Page: 1},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			values, err := url.ParseQuery(testCase.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			filter := parseRoomListFilter(values)
+			if filter != testCase.filter {
+				t.Errorf("parseRoomListFilter(%s) = %+v, expected %+v", testCase.query, filter, testCase.filter)
+			}
+			if testCase.query != "" && parseRoomListFilter(mustParseURLQuery(t, filter.URL(filter.Page))) != filter {
+				t.Errorf("the filter doesn't survive a round trip through its URL: %s", filter.URL(filter.Page))
+			}
+		})
+	}
+}
+
+func mustParseURLQuery(t *testing.T, link string) url.Values {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Query()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	errors "git.sequentialread.com/forest/pkg-errors"
+)
+
+// RoomProtection is used both for the lists in config.json and for the extra entries added on the /protection page,
+// which are saved in data/roomProtection.json. The two are merged, entries from config.json can't be removed from the panel.
+type RoomProtection struct {
+	ProtectedRoomIds           []string
+	ProtectedRoomAliasPatterns []string
+	DenylistRoomIds            []string
+
+	// db is where the aliases of the rooms are looked up, it is only set by getRoomProtection
+	db *DBModel
+}
+
+// how long the aliases of a room are remembered for the pages that list rooms.
+// Deleting a room always looks its aliases up again, see removeProtectedRooms.
+const roomAliasCacheDuration = time.Minute * 5
+
+type cachedRoomAliases struct {
+	Aliases         []string
+	LoadedUnixMilli int64
+}
+
+var roomAliasCache = struct {
+	sync.Mutex
+	rooms map[string]cachedRoomAliases
+}{rooms: map[string]cachedRoomAliases{}}
+
+func getRoomProtection(db *DBModel, config *Config) (RoomProtection, error) {
+	fromPanel, err := ReadJsonFile[RoomProtection]("data/roomProtection.json")
+	if err != nil {
+		return RoomProtection{}, err
+	}
+
+	return RoomProtection{
+		ProtectedRoomIds:           append(append([]string{config.AdminMatrixRoomId}, config.ProtectedRoomIds...), fromPanel.ProtectedRoomIds...),
+		ProtectedRoomAliasPatterns: append(append([]string{}, config.ProtectedRoomAliasPatterns...), fromPanel.ProtectedRoomAliasPatterns...),
+		DenylistRoomIds:            append(append([]string{}, config.DenylistRoomIds...), fromPanel.DenylistRoomIds...),
+		db:                         db,
+	}, nil
+}
+
+// loadAliases looks up the aliases of all the rooms that are not in the cache with one query, so that checking a
+// whole list of rooms doesn't cost a query per room. With fresh set, the cache is ignored.
+// Nothing is looked up when there are no alias patterns to match.
+func (protection RoomProtection) loadAliases(roomIds []string, fresh bool) error {
+	if len(protection.ProtectedRoomAliasPatterns) == 0 || len(roomIds) == 0 {
+		return nil
+	}
+
+	roomAliasCache.Lock()
+	toLoad := []string{}
+	cachedSince := time.Now().Add(-roomAliasCacheDuration).UnixMilli()
+	for _, roomId := range roomIds {
+		if cached, has := roomAliasCache.rooms[roomId]; fresh || !has || cached.LoadedUnixMilli < cachedSince {
+			toLoad = append(toLoad, roomId)
+		}
+	}
+	roomAliasCache.Unlock()
+	if len(toLoad) == 0 {
+		return nil
+	}
+	if protection.db == nil {
+		return errors.New("there is no database connection to load the room aliases from")
+	}
+
+	aliasesByRoom, err := protection.db.GetRoomAliases(toLoad)
+	if err != nil {
+		return err
+	}
+
+	roomAliasCache.Lock()
+	defer roomAliasCache.Unlock()
+	now := time.Now().UnixMilli()
+	for _, roomId := range toLoad {
+		roomAliasCache.rooms[roomId] = cachedRoomAliases{Aliases: aliasesByRoom[roomId], LoadedUnixMilli: now}
+	}
+	return nil
+}
+
+// isRoomProtected returns a reason when the room must not be deleted. Every alias of the room is matched against
+// the alias patterns, which use the same syntax as path.Match, for example "#*:cyberia.club".
+// Call loadAliases first when checking a lot of rooms.
+func (protection RoomProtection) isRoomProtected(roomId string) (bool, string) {
+	for _, protectedRoomId := range protection.ProtectedRoomIds {
+		if roomId == protectedRoomId {
+			return true, "its room id is protected"
+		}
+	}
+
+	if len(protection.ProtectedRoomAliasPatterns) == 0 {
+		return false, ""
+	}
+
+	err := protection.loadAliases([]string{roomId}, false)
+	if err != nil {
+		// if we can't tell what the aliases are, it's better to be safe than sorry
+		log.Printf("isRoomProtected(): can't get the aliases of %s: %s\n", roomId, err)
+		return true, "its aliases could not be checked"
+	}
+	roomAliasCache.Lock()
+	aliases := roomAliasCache.rooms[roomId].Aliases
+	roomAliasCache.Unlock()
+
+	for _, alias := range aliases {
+		for _, pattern := range protection.ProtectedRoomAliasPatterns {
+			matched, err := path.Match(pattern, alias)
+			if err != nil {
+				log.Printf("isRoomProtected(): invalid alias pattern '%s': %s\n", pattern, err)
+				continue
+			}
+			if matched {
+				return true, fmt.Sprintf("its alias %s matches %s", alias, pattern)
+			}
+		}
+	}
+
+	return false, ""
+}
+
+func (protection RoomProtection) isRoomDenylisted(roomId string) bool {
+	for _, denylistedRoomId := range protection.DenylistRoomIds {
+		if roomId == denylistedRoomId {
+			return true
+		}
+	}
+	return false
+}
+
+// removeProtectedRooms splits the rooms into the ones that may be deleted and a message for each one that may not.
+// The aliases of the rooms are looked up again instead of trusting the cache, since this is right before deleting them.
+func removeProtectedRooms(db *DBModel, config *Config, rooms []MatrixRoom) ([]MatrixRoom, []string, error) {
+	protection, err := getRoomProtection(db, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	roomIds := []string{}
+	for _, room := range rooms {
+		roomIds = append(roomIds, room.Id)
+	}
+	err = protection.loadAliases(roomIds, true)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allowed := []MatrixRoom{}
+	refused := []string{}
+	for _, room := range rooms {
+		protected, reason := protection.isRoomProtected(room.Id)
+		if protected {
+			refused = append(refused, fmt.Sprintf("%s can't be deleted because %s", room.Id, reason))
+		} else {
+			allowed = append(allowed, room)
+		}
+	}
+	return allowed, refused, nil
+}
+
+func registerRoomProtectionRoutes(app *FrontendApp, config *Config) {
+	app.handleWithSession("/protection", func(responseWriter http.ResponseWriter, request *http.Request, session Session) {
+		if session.UserID == "" {
+			http.Redirect(responseWriter, request, "/", http.StatusFound)
+			return
+		}
+
+		fromPanel, err := ReadJsonFile[RoomProtection]("data/roomProtection.json")
+		if err != nil {
+			(*session.Flash)["error"] = "an error occurred reading roomProtection json"
+		}
+
+		if request.Method == "POST" {
+			list := request.PostFormValue("list")
+			value := strings.TrimSpace(request.PostFormValue("value"))
+			remove := request.PostFormValue("action") == "remove"
+
+			var entries *[]string
+			switch list {
+			case "ProtectedRoomIds":
+				entries = &fromPanel.ProtectedRoomIds
+			case "ProtectedRoomAliasPatterns":
+				entries = &fromPanel.ProtectedRoomAliasPatterns
+			case "DenylistRoomIds":
+				entries = &fromPanel.DenylistRoomIds
+			}
+
+			if entries != nil && value != "" {
+				if list == "ProtectedRoomAliasPatterns" {
+					_, err = path.Match(value, "")
+				}
+				if err != nil {
+					app.setFlash(responseWriter, session, "error", fmt.Sprintf("'%s' is not a valid alias pattern", value))
+				} else {
+					updated := []string{}
+					for _, entry := range *entries {
+						if entry != value {
+							updated = append(updated, entry)
+						}
+					}
+					if !remove {
+						updated = append(updated, value)
+					}
+					*entries = updated
+
+					err = WriteJsonFile("data/roomProtection.json", fromPanel)
+					if err != nil {
+						log.Printf("can't write data/roomProtection.json: %s\n", err)
+						app.setFlash(responseWriter, session, "error", "an error occurred saving roomProtection json")
+					} else if remove {
+						appendAuditLog(session.UserID, AuditActionProtectionChanged, value, fmt.Sprintf("removed from %s", list))
+					} else {
+						appendAuditLog(session.UserID, AuditActionProtectionChanged, value, fmt.Sprintf("added to %s", list))
+					}
+				}
+			}
+
+			http.Redirect(responseWriter, request, "/protection", http.StatusFound)
+			return
+		}
+
+		protectionTemplateData := struct {
+			AdminMatrixRoomId string
+			FromConfig        RoomProtection
+			FromPanel         RoomProtection
+		}{
+			config.AdminMatrixRoomId,
+			RoomProtection{
+				ProtectedRoomIds:           config.ProtectedRoomIds,
+				ProtectedRoomAliasPatterns: config.ProtectedRoomAliasPatterns,
+				DenylistRoomIds:            config.DenylistRoomIds,
+			},
+			fromPanel,
+		}
+
+		app.buildPageFromTemplate(responseWriter, request, session, "protection.html", protectionTemplateData)
+	})
+}
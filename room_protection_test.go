@@ -0,0 +1,69 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRemoveProtectedRoomsMatchesEveryAlias(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.Config.ProtectedRoomAliasPatterns = []string{"#important-*:example.com"}
+	janitor.Config.ProtectedRoomIds = []string{"!pinned:example.com"}
+	for _, roomId := range []string{"!canonical:example.com", "!alt:example.com", "!local:example.com", "!other:example.com", "!pinned:example.com"} {
+		janitor.addRoom(t, roomId, roomId, 1, 1, "@alice:example.com")
+	}
+	_, err := janitor.DB.DB.Exec("UPDATE room_stats_state SET canonical_alias = '#important-news:example.com' WHERE room_id = '!canonical:example.com'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRoomAliases(t, janitor.DB, "!alt:example.com", nil, []string{"#chat:example.com", "#important-chat:example.com"})
+	setRoomAliases(t, janitor.DB, "!local:example.com", []string{"#important-room:example.com"}, nil)
+	setRoomAliases(t, janitor.DB, "!other:example.com", []string{"#other:example.com"}, []string{"#important:remote.org"})
+
+	rooms := []MatrixRoom{}
+	for _, roomId := range []string{"!canonical:example.com", "!alt:example.com", "!local:example.com", "!other:example.com", "!pinned:example.com"} {
+		rooms = append(rooms, MatrixRoom{Id: roomId})
+	}
+	allowed, refused, err := removeProtectedRooms(janitor.DB, janitor.Config, rooms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowed) != 1 || allowed[0].Id != "!other:example.com" {
+		t.Errorf("expected only !other to be allowed, got %+v", allowed)
+	}
+	refusedMessages := strings.Join(refused, "\n")
+	for _, expected := range []string{
+		"#important-news:example.com matches", "#important-chat:example.com matches", "#important-room:example.com matches", "its room id is protected",
+	} {
+		if !strings.Contains(refusedMessages, expected) {
+			t.Errorf("expected '%s' in %s", expected, refusedMessages)
+		}
+	}
+
+	// an alias that is added later is noticed before the room is deleted, even though the list pages still have it cached
+	_, err = janitor.DB.DB.Exec("INSERT INTO room_aliases (room_alias, room_id) VALUES ('#important-other:example.com', '!other:example.com')")
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowed, _, err = removeProtectedRooms(janitor.DB, janitor.Config, []MatrixRoom{{Id: "!other:example.com"}})
+	if err != nil || len(allowed) != 0 {
+		t.Errorf("the new alias of !other was not noticed: %+v %v", allowed, err)
+	}
+}
+
+func TestRoomProtectionWithoutDatabase(t *testing.T) {
+	newTestJanitor(t, nil)
+	protection := RoomProtection{ProtectedRoomAliasPatterns: []string{"#important-*:example.com"}}
+
+	err := protection.loadAliases([]string{"!a:example.com"}, false)
+	if err == nil {
+		t.Errorf("loadAliases without a database didn't return an error")
+	}
+	protected, reason := protection.isRoomProtected("!a:example.com")
+	if !protected {
+		t.Errorf("a room whose aliases can't be checked is not protected")
+	}
+	if reason != "its aliases could not be checked" {
+		t.Errorf("unexpected reason '%s'", reason)
+	}
+}
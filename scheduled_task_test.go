@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRunScheduledTaskCountsStateGroupsStateRows(t *testing.T) {
+	janitor := newTestJanitor(t, newTestDatabase(t))
+	janitor.addRoom(t, "!a:example.com", "A", 10, 3, "@alice:example.com")
+	janitor.addRoom(t, "!b:example.com", "B", 2, 4, "@alice:example.com")
+
+	runScheduledTask(janitor.DB, janitor.Config, true, true)
+
+	rowCountByRoom, err := ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowCountByRoom) != 2 || rowCountByRoom["!a:example.com"] != 30 || rowCountByRoom["!b:example.com"] != 8 {
+		t.Errorf("unexpected row counts after a full scan: %v", rowCountByRoom)
+	}
+
+	janitorState, err := ReadJsonFile[JanitorState]("data/janitorState.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if janitorState.LastScheduledTaskRunUnixMilli == 0 || janitorState.LastStateGroupsStateScanSuccessUnixMilli == 0 {
+		t.Errorf("the run was not recorded: %+v", janitorState)
+	}
+	if isRunningScheduledTask {
+		t.Errorf("isRunningScheduledTask is still set")
+	}
+
+	tables, err := ReadJsonFile[[]DBTableSize]("data/dbTableSizes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasStateGroupsState := false
+	for _, table := range tables {
+		hasStateGroupsState = hasStateGroupsState || table.Name == "state_groups_state"
+	}
+	if !hasStateGroupsState {
+		t.Errorf("state_groups_state is not in the table sizes: %+v", tables)
+	}
+
+	history, err := ReadJsonLines[HistorySnapshot]("data/history.jsonl")
+	if err != nil || len(history) != 1 {
+		t.Errorf("expected 1 history snapshot, got %d %v", len(history), err)
+	}
+
+	// the next run only counts the state groups that were added since, and marks their rooms as estimated
+	janitor.addRoom(t, "!c:example.com", "C", 1, 5, "@alice:example.com")
+	runScheduledTask(janitor.DB, janitor.Config, false, false)
+
+	rowCountByRoom, err = ReadJsonFile[map[string]int]("data/stateGroupsStateRowCountByRoom.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rowCountByRoom) != 3 || rowCountByRoom["!a:example.com"] != 30 || rowCountByRoom["!c:example.com"] != 5 {
+		t.Errorf("unexpected row counts after an incremental scan: %v", rowCountByRoom)
+	}
+	scanState, err := ReadJsonFile[StateGroupsStateScanState]("data/stateGroupsStateScan.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scanState.EstimatedRoomIds["!c:example.com"] || scanState.EstimatedRoomIds["!a:example.com"] {
+		t.Errorf("unexpected estimated rooms %v", scanState.EstimatedRoomIds)
+	}
+	if scanState.LastIncrementalScanUnixMilli == 0 {
+		t.Errorf("the incremental scan was not recorded: %+v", scanState)
+	}
+}
@@ -1,51 +1,168 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
-	"os"
-	"path/filepath"
+	stderrors "errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
 
 	errors "git.sequentialread.com/forest/pkg-errors"
+	bolt "go.etcd.io/bbolt"
 )
 
-func WriteJsonFile[T any](path string, object T) error {
-	mutex.Lock()
-	defer mutex.Unlock()
-	currentDirectory, err := os.Getwd()
-	if err != nil {
-		return err
+// Storage holds all of the janitor's own state: sessions, janitor state, history snapshots, delete jobs etc.
+// Keys look like the file paths that were used before there was more than one kind of storage, for example data/deleteRooms.json
+type Storage interface {
+	// Get returns nil and no error when the key does not exist
+	Get(key string) ([]byte, error)
+	// Put replaces the whole value. Readers see either the old value or the new one, never a partially written one
+	Put(key string, value []byte) error
+	Append(key string, value []byte) error
+	Delete(key string) error
+	Close() error
+}
+
+var storage Storage
+
+func initStorage(config *Config) Storage {
+	switch config.StorageType {
+	case "", "file":
+		return NewFileStorage()
+	case "bolt":
+		storagePath := config.StoragePath
+		if storagePath == "" {
+			storagePath = "data/janitor.db"
+		}
+		boltStorage, err := NewBoltStorage(storagePath)
+		if err != nil && stderrors.Is(err, bolt.ErrTimeout) {
+			log.Fatalf(
+				"failed to open bolt storage %s: another process has it open. "+
+					"the running janitor keeps it locked, stop it before using the command line tools, or use the API instead", storagePath,
+			)
+		}
+		if err != nil {
+			log.Fatalf("failed to open bolt storage %s: %+v", storagePath, err)
+		}
+		err = migrateDataFolderToStorage("data", boltStorage, storagePath)
+		if err != nil {
+			log.Fatalf("failed to migrate the data folder into bolt storage %s: %+v", storagePath, err)
+		}
+		return boltStorage
+	default:
+		log.Fatalf("unknown StorageType '%s', it has to be 'file' or 'bolt'", config.StorageType)
+		return nil
 	}
-	path = filepath.Join(currentDirectory, path)
-	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+}
+
+func WriteJsonFile[T any](path string, object T) error {
+	jsonBytes, err := json.Marshal(object)
 	if err != nil {
-		return err
+		return errors.Wrapf(err, "can't serialize %s as json", path)
 	}
-	defer file.Close()
-
-	return json.NewEncoder(file).Encode(object)
+	return storage.Put(path, append(jsonBytes, '\n'))
 }
 
 func ReadJsonFile[T any](path string) (T, error) {
-	mutex.Lock()
-	defer mutex.Unlock()
 	var object T
-	currentDirectory, err := os.Getwd()
+	jsonBytes, err := storage.Get(path)
 	if err != nil {
 		return object, err
 	}
-	path = filepath.Join(currentDirectory, path)
-	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
-	if err != nil && os.IsNotExist(err) {
+	if jsonBytes == nil {
 		return object, nil
 	}
-	if err != nil {
-		return object, err
-	}
-	defer file.Close()
 
-	err = json.NewDecoder(file).Decode(&object)
+	err = json.Unmarshal(jsonBytes, &object)
 	if err != nil {
 		return object, errors.Wrapf(err, "json parse error on %s", path)
 	}
 	return object, nil
 }
+
+func RemoveJsonFile(path string) error {
+	return storage.Delete(path)
+}
+
+// AppendJsonLine adds one object to the end of a file with one json object per line
+func AppendJsonLine[T any](path string, object T) error {
+	jsonBytes, err := json.Marshal(object)
+	if err != nil {
+		return errors.Wrapf(err, "can't serialize %s line as json", path)
+	}
+	return storage.Append(path, append(jsonBytes, '\n'))
+}
+
+func ReadJsonLines[T any](path string) ([]T, error) {
+	objects := []T{}
+	jsonBytes, err := storage.Get(path)
+	if err != nil {
+		return nil, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	for decoder.More() {
+		var object T
+		err := decoder.Decode(&object)
+		if err != nil {
+			return nil, errors.Wrapf(err, "json parse error on %s", path)
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// WriteJsonLines replaces the whole file, the existing lines are never lost if the process dies halfway through.
+func WriteJsonLines[T any](path string, objects []T) error {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, object := range objects {
+		err := encoder.Encode(object)
+		if err != nil {
+			return err
+		}
+	}
+
+	return storage.Put(path, buffer.Bytes())
+}
+
+// WriteStateGroupIdsFile writes one state group id per line
+func WriteStateGroupIdsFile(path string, stateGroupIds []int64) error {
+	var buffer bytes.Buffer
+	for _, stateGroupId := range stateGroupIds {
+		fmt.Fprintf(&buffer, "%d\n", stateGroupId)
+	}
+	return storage.Put(path, buffer.Bytes())
+}
+
+func ReadStateGroupIdsFile(path string) ([]int64, error) {
+	fileBytes, err := storage.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if fileBytes == nil {
+		return nil, fmt.Errorf("%s does not exist", path)
+	}
+
+	stateGroupIds := []int64{}
+	scanner := bufio.NewScanner(bytes.NewReader(fileBytes))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		stateGroupId, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't parse state group id '%s' in %s", line, path)
+		}
+		stateGroupIds = append(stateGroupIds, stateGroupId)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "can't read %s", path)
+	}
+
+	return stateGroupIds, nil
+}